@@ -511,9 +511,16 @@ def generate_readline_actions() -> str:
         ActionBackspace
         ActionDelete
         ActionMoveToStartOfLine
+        ActionMoveToFirstNonBlank
         ActionMoveToEndOfLine
+        ActionHome
+        ActionEnd
         ActionMoveToStartOfDocument
         ActionMoveToEndOfDocument
+        ActionMoveToFirstLine
+        ActionMoveToLastLine
+        ActionMoveToNextParagraph
+        ActionMoveToPreviousParagraph
         ActionMoveToEndOfWord
         ActionMoveToStartOfWord
         ActionCursorLeft
@@ -524,6 +531,18 @@ def generate_readline_actions() -> str:
         ActionHistoryPreviousOrCursorUp
         ActionCursorDown
         ActionHistoryNextOrCursorDown
+        ActionMoveLineUp
+        ActionMoveLineDown
+        ActionDuplicateLine
+        ActionOpenLineBelow
+        ActionOpenLineAbove
+        ActionCopyFromLineAbove
+        ActionCopyFromLineBelow
+        ActionTransposeLines
+        ActionJumpToPreviousEdit
+        ActionJumpToNextEdit
+        ActionNextTemplateField
+        ActionPreviousTemplateField
         ActionHistoryNext
         ActionHistoryPrevious
         ActionHistoryFirst
@@ -533,18 +552,57 @@ def generate_readline_actions() -> str:
         ActionTerminateHistorySearchAndApply
         ActionTerminateHistorySearchAndRestore
         ActionClearScreen
+        ActionToggleHorizontalScroll
         ActionAddText
+        ActionInsertTab
+        ActionInsertDateTime
+        ActionInsertCodePoint
+        ActionInsertCommandOutput
+        ActionFilterThroughCommand
+        ActionExpandGlob
+        ActionSetMark
+        ActionSortLines
+        ActionUniqueLines
+        ActionDeleteTrailingWhitespace
+        ActionDeleteBlankLines
+        ActionCapitalizeLines
+        ActionSwapCase
+        ActionIndent
+        ActionDedent
+        ActionDeleteIndentation
         ActionAbortCurrentLine
 
         ActionStartKillActions
         ActionKillToEndOfLine
+        ActionTruncateAtCursor
+        ActionKillToEndOfScreenLine
         ActionKillToStartOfLine
         ActionKillNextWord
         ActionKillPreviousWord
         ActionKillPreviousSpaceDelimitedWord
+        ActionWordErase
+        ActionKillNextParagraph
+        ActionKillPreviousParagraph
+        ActionKillInsideQuotes
+        ActionKillAroundQuotes
+        ActionKillRegion
+        ActionZapBackToChar
+        ActionZapBackUpToChar
         ActionEndKillActions
+        ActionKillInput
         ActionYank
         ActionPopYank
+        ActionPreviousArgument
+        ActionNextArgument
+        ActionCopyToClipboard
+        ActionSurround
+        ActionCycleQuotes
+        ActionExpandAbbreviation
+        ActionQueryReplace
+        ActionStartKeyboardMacro
+        ActionEndKeyboardMacro
+        ActionCallKeyboardMacro
+        ActionRepeatLastChange
 
         ActionNumericArgumentDigit0
         ActionNumericArgumentDigit1
@@ -560,6 +618,14 @@ def generate_readline_actions() -> str:
 
         ActionCompleteForward
         ActionCompleteBackward
+        ActionPossibleCompletions
+        ActionMenuComplete
+        ActionMenuCompleteBackward
+        ActionDismissCompletions
+        ActionShowMoreCompletions
+
+        ActionAcceptAutoSuggestion
+        ActionAcceptAutoSuggestionWord
     ''')
 
 
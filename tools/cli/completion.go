@@ -16,6 +16,15 @@ var _ = fmt.Print
 type Match struct {
 	Word        string `json:"word,omitempty"`
 	Description string `json:"description,omitempty"`
+	// Displayed instead of Word, which is what is inserted, if not empty
+	Display string `json:"display,omitempty"`
+}
+
+func (self *Match) DisplayText() string {
+	if self.Display != "" {
+		return self.Display
+	}
+	return self.Word
 }
 
 type MatchGroup struct {
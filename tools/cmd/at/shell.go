@@ -69,7 +69,7 @@ func shell_loop(rl *readline.Readline, kill_if_signaled bool) (int, error) {
 			return err
 		}
 		if event.Handled {
-			rl.Redraw()
+			rl.ScheduleRedraw()
 			return nil
 		}
 		return nil
@@ -78,7 +78,7 @@ func shell_loop(rl *readline.Readline, kill_if_signaled bool) (int, error) {
 	lp.OnText = func(text string, from_key_event, in_bracketed_paste bool) error {
 		err := rl.OnText(text, from_key_event, in_bracketed_paste)
 		if err == nil {
-			rl.Redraw()
+			rl.ScheduleRedraw()
 		}
 		return err
 	}
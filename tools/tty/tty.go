@@ -156,6 +156,20 @@ func (self *Term) Tcsetattr(when uintptr, ans *unix.Termios) error {
 	return eintr_retry_noret(func() error { return Tcsetattr(self.Fd(), when, ans) })
 }
 
+// The word erase (WERASE) character of the terminal, zero if it is disabled,
+// and whether word erase stops at non-alphanumeric characters rather than at
+// whitespace
+func (self *Term) WordErase() (ch byte, stops_at_non_alnum bool, err error) {
+	var t unix.Termios
+	if err = self.Tcgetattr(&t); err != nil {
+		return
+	}
+	if ch = t.Cc[unix.VWERASE]; ch == posix_vdisable {
+		ch = 0
+	}
+	return ch, werase_stops_at_non_alnum(&t), nil
+}
+
 func (self *Term) set_termios_attrs(when uintptr, modify func(*unix.Termios)) (err error) {
 	var state unix.Termios
 	if err = self.Tcgetattr(&state); err != nil {
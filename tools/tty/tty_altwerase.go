@@ -0,0 +1,11 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+//go:build darwin || freebsd || openbsd || dragonfly
+// +build darwin freebsd openbsd dragonfly
+
+package tty
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const altwerase = unix.ALTWERASE
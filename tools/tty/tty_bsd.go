@@ -25,3 +25,7 @@ func Tcsetattr(fd int, opt uintptr, argp *unix.Termios) error {
 	}
 	return unix.IoctlSetTermios(fd, uint(opt), argp)
 }
+
+const posix_vdisable = 0xff
+
+func werase_stops_at_non_alnum(t *unix.Termios) bool { return t.Lflag&altwerase != 0 }
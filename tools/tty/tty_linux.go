@@ -36,3 +36,9 @@ func Tcsetattr(fd int, action uintptr, argp *unix.Termios) error {
 	}
 	return unix.IoctlSetTermios(fd, request, argp)
 }
+
+const posix_vdisable = 0
+
+// The Linux line discipline always stops at non-alphanumeric characters, the
+// equivalent of ALTWERASE on the BSDs
+func werase_stops_at_non_alnum(t *unix.Termios) bool { return true }
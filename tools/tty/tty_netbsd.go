@@ -0,0 +1,7 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package tty
+
+// x/sys/unix does not define ALTWERASE for NetBSD, this is its value from
+// sys/termios.h
+const altwerase = 0x00000200
@@ -5,8 +5,10 @@ package loop
 import (
 	"encoding/base64"
 	"fmt"
+	"io"
 	"kitty/tools/tty"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -49,13 +51,18 @@ type Loop struct {
 	terminal_options                       TerminalStateOptions
 	screen_size                            ScreenSize
 	escape_code_parser                     wcswidth.EscapeCodeParser
+	escape_timeout                         time.Duration
+	escape_timer_id                        IdType
 	keep_going                             bool
 	death_signal                           unix.Signal
 	exit_code                              int
 	timers, timers_temp                    []*timer
 	timer_id_counter, write_msg_id_counter IdType
 	wakeup_channel                         chan byte
+	main_thread_callbacks                  []func() error
+	main_thread_callbacks_lock             sync.Mutex
 	pending_writes                         []*write_msg
+	write_mirror                           io.Writer
 	on_SIGTSTP                             func() error
 
 	// Send strings to this channel to queue writes in a thread safe way
@@ -142,6 +149,26 @@ func FullKeyboardProtocol(self *Loop) {
 	self.terminal_options.kitty_keyboard_mode = 0b11111
 }
 
+// How long to wait after a bare Esc from a terminal that does not use the
+// kitty keyboard protocol. A key received within the timeout is reported as
+// Alt+key, as such terminals send Esc followed by the key for it, otherwise
+// the Esc is reported as the Escape key. This is opt-in: the default of zero
+// turns off the handling of Esc prefixed keys, dropping the Esc as before.
+// Values around 100ms work well for interactive use.
+func (self *Loop) EscapeTimeout(timeout time.Duration) *Loop {
+	self.escape_timeout = timeout
+	if timeout > 0 {
+		self.escape_code_parser.HandleEscPrefixedByte = self.handle_esc_prefixed_byte
+	} else {
+		self.escape_code_parser.HandleEscPrefixedByte = nil
+	}
+	return self
+}
+
+func EscapeTimeout(self *Loop, timeout time.Duration) {
+	self.EscapeTimeout(timeout)
+}
+
 func (self *Loop) MouseTrackingMode(mt MouseTracking) *Loop {
 	self.terminal_options.mouse_tracking = mt
 	return self
@@ -229,6 +256,16 @@ func (self *Loop) WakeupMainThread() bool {
 	}
 }
 
+// Call callback on the loop's goroutine, before OnWakeup. Safe to call from
+// any goroutine. Callbacks scheduled while the loop is not running are
+// called once it is woken up after it starts.
+func (self *Loop) CallOnMainThread(callback func() error) {
+	self.main_thread_callbacks_lock.Lock()
+	self.main_thread_callbacks = append(self.main_thread_callbacks, callback)
+	self.main_thread_callbacks_lock.Unlock()
+	self.WakeupMainThread()
+}
+
 func (self *Loop) QueueWriteString(data string) IdType {
 	self.write_msg_id_counter++
 	msg := write_msg{str: data, bytes: nil, id: self.write_msg_id_counter}
@@ -259,6 +296,13 @@ func (self *Loop) Beep() {
 	self.QueueWriteString("\a")
 }
 
+// Also write everything queued for writing to the terminal to w, as it is
+// queued. Use nil to stop. Returns the previous mirror, if any.
+func (self *Loop) MirrorWritesTo(w io.Writer) (previous io.Writer) {
+	previous, self.write_mirror = self.write_mirror, w
+	return
+}
+
 func (self *Loop) StartAtomicUpdate() {
 	self.QueueWriteString(PENDING_UPDATE.EscapeCodeToSet())
 }
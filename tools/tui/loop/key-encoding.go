@@ -268,6 +268,29 @@ func ParseShortcut(spec string) *ParsedShortcut {
 	return &ans
 }
 
+// The key event for Alt and the key that sends ch, for terminals that send
+// Esc followed by ch for it
+func KeyEventFromEscPrefixedByte(ch byte) *KeyEvent {
+	ans := KeyEvent{Type: PRESS, Mods: ALT}
+	switch {
+	case ch == '\r':
+		ans.Key = "ENTER"
+	case ch == '\t':
+		ans.Key = "TAB"
+	case ch == 0x7f:
+		ans.Key = "BACKSPACE"
+	case ch == 0:
+		ans.Key, ans.Mods = " ", ALT|CTRL
+	case 1 <= ch && ch <= 26:
+		ans.Key, ans.Mods = string(rune('a'+ch-1)), ALT|CTRL
+	case 'A' <= ch && ch <= 'Z':
+		ans.Key, ans.ShiftedKey, ans.Mods = string(rune(ch+'a'-'A')), string(rune(ch)), ALT|SHIFT
+	default:
+		ans.Key = string(rune(ch))
+	}
+	return &ans
+}
+
 func (self *KeyEvent) MatchesParsedShortcut(ps *ParsedShortcut, event_type KeyEventType) bool {
 	if self.Type&event_type == 0 {
 		return false
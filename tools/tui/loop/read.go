@@ -22,11 +22,19 @@ func (self *Loop) dispatch_input_data(data []byte) error {
 			return err
 		}
 	}
+	if self.escape_timer_id != 0 {
+		self.remove_timer(self.escape_timer_id)
+		self.escape_timer_id = 0
+	}
 	err := self.escape_code_parser.Parse(data)
 	if err != nil {
 		return err
 	}
-	return nil
+	// a bare Esc is the Escape key unless a key quickly follows it
+	if self.escape_timeout > 0 && len(data) > 0 && data[len(data)-1] == 0x1b && self.escape_code_parser.PendingEsc() {
+		self.escape_timer_id, err = self.add_timer(self.escape_timeout, false, self.handle_escape_timeout)
+	}
+	return err
 }
 
 func read_ignoring_temporary_errors(f *tty.Term, buf []byte) (int, error) {
@@ -148,6 +148,19 @@ func (self *Loop) handle_rune(raw rune) error {
 	return nil
 }
 
+func (self *Loop) handle_esc_prefixed_byte(ch byte) error {
+	return self.handle_key_event(KeyEventFromEscPrefixedByte(ch))
+}
+
+func (self *Loop) handle_escape_timeout(IdType) error {
+	self.escape_timer_id = 0
+	if !self.escape_code_parser.PendingEsc() {
+		return nil
+	}
+	self.escape_code_parser.Reset()
+	return self.handle_key_event(&KeyEvent{Type: PRESS, Key: "ESCAPE"})
+}
+
 func (self *Loop) handle_end_of_bracketed_paste() {
 	if self.OnText != nil {
 		self.OnText("", false, false)
@@ -326,6 +339,8 @@ func (self *Loop) run() (err error) {
 			if err != nil {
 				return err
 			}
+			// timer callbacks may have queued writes
+			self.flush_pending_writes(tty_write_channel)
 			var timeout time.Duration
 			if len(self.timers) > 0 {
 				timeout = self.timers[0].deadline.Sub(now)
@@ -341,6 +356,15 @@ func (self *Loop) run() (err error) {
 			for len(self.wakeup_channel) > 0 {
 				<-self.wakeup_channel
 			}
+			self.main_thread_callbacks_lock.Lock()
+			callbacks := self.main_thread_callbacks
+			self.main_thread_callbacks = nil
+			self.main_thread_callbacks_lock.Unlock()
+			for _, callback := range callbacks {
+				if err = callback(); err != nil {
+					return err
+				}
+			}
 			if self.OnWakeup != nil {
 				err = self.OnWakeup()
 				if err != nil {
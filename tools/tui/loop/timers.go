@@ -37,7 +37,7 @@ func (self *Loop) dispatch_timers(now time.Time) error {
 	updated := false
 	self.timers_temp = self.timers_temp[:0]
 	self.timers_temp = append(self.timers_temp, self.timers...)
-	for i, t := range self.timers_temp {
+	for _, t := range self.timers_temp {
 		if now.After(t.deadline) {
 			err := t.callback(t.id)
 			if err != nil {
@@ -47,7 +47,8 @@ func (self *Loop) dispatch_timers(now time.Time) error {
 				t.update_deadline(now)
 				updated = true
 			} else {
-				self.timers = append(self.timers[:i], self.timers[i+1:]...)
+				// by id as earlier callbacks may have changed the timers
+				self.remove_timer(t.id)
 			}
 		}
 	}
@@ -97,6 +97,13 @@ func (self *Loop) wait_for_write_to_complete(sentinel IdType, tty_write_channel
 }
 
 func (self *Loop) add_write_to_pending_queue(data *write_msg) {
+	if self.write_mirror != nil {
+		if data.bytes == nil {
+			io.WriteString(self.write_mirror, data.str)
+		} else {
+			self.write_mirror.Write(data.bytes)
+		}
+	}
 	self.pending_writes = append(self.pending_writes, data)
 }
 
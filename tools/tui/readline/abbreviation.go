@@ -0,0 +1,32 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package readline
+
+import (
+	"fmt"
+)
+
+var _ = fmt.Print
+
+// The word ending at the cursor, delimited as for completion, and its start
+// on the current line
+func (self *Readline) word_before_cursor() (string, int) {
+	line := self.input_state.lines[self.input_state.cursor.Y]
+	start := self.line_start(self.input_state.cursor.Y)
+	start += completion_word_start(line[start:self.input_state.cursor.X], self.completions.word_breaks)
+	return line[start:self.input_state.cursor.X], start
+}
+
+// Replace the word before the cursor with its expansion, if it is a
+// registered abbreviation
+func (self *Readline) expand_abbreviation() bool {
+	word, start := self.word_before_cursor()
+	expansion, found := self.abbreviations[word]
+	if word == "" || !found {
+		return false
+	}
+	self.erase_between(Position{X: start, Y: self.input_state.cursor.Y}, self.input_state.cursor)
+	self.input_state.cursor.X = start
+	self.add_text(expansion)
+	return true
+}
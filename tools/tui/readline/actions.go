@@ -5,9 +5,15 @@ package readline
 import (
 	"fmt"
 	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 	"unicode"
+	"unicode/utf8"
 
+	"kitty/tools/tui/loop"
 	"kitty/tools/utils"
 	"kitty/tools/wcswidth"
 )
@@ -52,7 +58,24 @@ func (self *Readline) all_text() string {
 	return strings.Join(self.input_state.lines, "\n")
 }
 
+// The position of the end of the protected prefix, before which the text
+// cannot be edited
+func (self *Readline) start_of_editable_text() Position {
+	return Position{X: len(self.protected_prefix)}
+}
+
+// The first position on line y that the cursor can be moved to
+func (self *Readline) line_start(y int) int {
+	if y == 0 {
+		return len(self.protected_prefix)
+	}
+	return 0
+}
+
 func (self *Readline) add_text(text string) {
+	if p := self.start_of_editable_text(); self.input_state.cursor.Less(p) {
+		self.input_state.cursor = p
+	}
 	new_lines := make([]string, 0, len(self.input_state.lines)+4)
 	new_lines = append(new_lines, self.input_state.lines[:self.input_state.cursor.Y]...)
 	var lines_after []string
@@ -98,7 +121,8 @@ func (self *Readline) add_text(text string) {
 
 func (self *Readline) move_cursor_left(amt uint, traverse_line_breaks bool) (amt_moved uint) {
 	for amt_moved < amt {
-		if self.input_state.cursor.X == 0 {
+		start := self.line_start(self.input_state.cursor.Y)
+		if self.input_state.cursor.X <= start {
 			if !traverse_line_breaks || self.input_state.cursor.Y == 0 {
 				return amt_moved
 			}
@@ -107,9 +131,16 @@ func (self *Readline) move_cursor_left(amt uint, traverse_line_breaks bool) (amt
 			amt_moved++
 			continue
 		}
-		line := self.input_state.lines[self.input_state.cursor.Y]
-		for ci := wcswidth.NewCellIterator(line[:self.input_state.cursor.X]).GotoEnd(); amt_moved < amt && ci.Backward(); amt_moved++ {
-			self.input_state.cursor.X -= len(ci.Current())
+		stops := self.cursor_stops(self.input_state.lines[self.input_state.cursor.Y])
+		before := amt_moved
+		for i := len(stops) - 1; i >= 0 && stops[i] >= start && amt_moved < amt; i-- {
+			if stops[i] < self.input_state.cursor.X {
+				self.input_state.cursor.X = stops[i]
+				amt_moved++
+			}
+		}
+		if amt_moved == before {
+			return amt_moved
 		}
 	}
 	return amt_moved
@@ -127,21 +158,192 @@ func (self *Readline) move_cursor_right(amt uint, traverse_line_breaks bool) (am
 			amt_moved++
 			continue
 		}
-
-		for ci := wcswidth.NewCellIterator(line[self.input_state.cursor.X:]); amt_moved < amt && ci.Forward(); amt_moved++ {
-			self.input_state.cursor.X += len(ci.Current())
+		for _, x := range self.cursor_stops(line) {
+			if amt_moved >= amt {
+				break
+			}
+			if x > self.input_state.cursor.X {
+				self.input_state.cursor.X = x
+				amt_moved++
+			}
 		}
 	}
 	return amt_moved
 }
 
-func (self *Readline) move_cursor_to_target_line(source_line, target_line *ScreenLine) {
+// Call f with each cell of line and the visual column and width of the cell,
+// stopping if f returns false. Tabs are cells on their own, expanded to the
+// next tab stop. The cell iterator would merge them into the following cell.
+func (self *Readline) for_each_cell(line string, f func(cell string, col, width int) bool) {
+	col := 0
+	for {
+		before, after, found := strings.Cut(line, "\t")
+		for ci := wcswidth.NewCellIterator(before); ci.Forward(); {
+			cw := self.stringwidth(ci.Current())
+			if !f(ci.Current(), col, cw) {
+				return
+			}
+			col += cw
+		}
+		if !found {
+			return
+		}
+		cw := self.tab_width - col%self.tab_width
+		if !f("\t", col, cw) {
+			return
+		}
+		col += cw
+		line = after
+	}
+}
+
+// The byte offsets in line at which the cursor can be placed: the start and
+// end of the line and after every cell that takes up space on screen. This
+// keeps the cursor from stopping next to zero width characters, such as the
+// bidi formatting marks in right-to-left text, where moving it would make no
+// visible change.
+func (self *Readline) cursor_stops(line string) []int {
+	ans := []int{0}
+	x := 0
+	self.for_each_cell(line, func(cell string, col, width int) bool {
+		x += len(cell)
+		if width > 0 {
+			ans = append(ans, x)
+		}
+		return true
+	})
+	if ans[len(ans)-1] != len(line) {
+		ans = append(ans, len(line))
+	}
+	return ans
+}
+
+// The byte offset in line of the cell at the specified visual column, with
+// tabs expanded to the next tab stop
+func (self *Readline) x_for_visual_column(line string, col int) (x int) {
+	self.for_each_cell(line, func(cell string, w, cw int) bool {
+		if w+cw > col {
+			return false
+		}
+		x += len(cell)
+		return true
+	})
+	return
+}
+
+// The visual column of the byte offset x in line, the inverse of
+// x_for_visual_column()
+func (self *Readline) visual_column(line string, x int) (w int) {
+	self.for_each_cell(line[:x], func(cell string, col, cw int) bool {
+		w = col + cw
+		return true
+	})
+	return
+}
+
+// Move the cursor to the specified line and visual column, counting from
+// zero and clamped to the text
+func (self *Readline) move_to_line_and_column(y, col int) bool {
+	y = utils.Max(0, utils.Min(y, len(self.input_state.lines)-1))
+	pos := Position{Y: y, X: self.x_for_visual_column(self.input_state.lines[y], utils.Max(0, col))}
+	if pos == self.input_state.cursor {
+		return false
+	}
+	self.input_state.cursor = pos
+	return true
+}
+
+// Move the cursor to the specified line, keeping it in the same visual column
+func (self *Readline) move_to_line(y int) bool {
+	c := self.input_state.cursor
+	return self.move_to_line_and_column(y, self.visual_column(self.input_state.lines[c.Y], c.X))
+}
+
+// The position of the paragraph boundary amt paragraphs away from the cursor.
+// Boundaries are blank lines adjacent to a paragraph and the start and end of
+// the document.
+func (self *Readline) paragraph_boundary(amt int) Position {
+	lines := self.input_state.lines
+	is_blank := func(i int) bool { return strings.TrimSpace(lines[i]) == "" }
+	y := self.input_state.cursor.Y
+	for ; amt > 0; amt-- {
+		for y++; y < len(lines) && !(is_blank(y) && !is_blank(y-1)); y++ {
+		}
+		if y >= len(lines) {
+			return Position{Y: len(lines) - 1, X: len(lines[len(lines)-1])}
+		}
+	}
+	for ; amt < 0; amt++ {
+		for y--; y >= 0 && !(is_blank(y) && !is_blank(y+1)); y-- {
+		}
+		if y < 0 {
+			return Position{}
+		}
+	}
+	return Position{Y: y}
+}
+
+func (self *Readline) move_by_paragraph(amt int) bool {
+	pos := self.paragraph_boundary(amt)
+	if pos == self.input_state.cursor {
+		return false
+	}
+	self.input_state.cursor = pos
+	return true
+}
+
+func (self *Readline) kill_paragraph(amt int) bool {
+	pos := self.paragraph_boundary(amt)
+	if pos == self.input_state.cursor {
+		return false
+	}
+	if amt > 0 {
+		self.kill_text(self.erase_between(self.input_state.cursor, pos))
+	} else {
+		self.kill_text(self.erase_between(pos, self.input_state.cursor))
+	}
+	return true
+}
+
+func (self *Readline) move_cursor_to_target_line(source_line, target_line *ScreenLine, screen_lines []*ScreenLine) {
 	if source_line != target_line {
-		visual_distance_into_text := source_line.CursorCell - source_line.Prompt.Length
+		col := source_line.CursorCell - source_line.Prompt.Length + source_line.ScrolledCells
+		if !self.horizontal_scroll {
+			col = utils.Min(col, target_line.TextLengthInCells)
+		}
+		for _, sl := range screen_lines {
+			if sl.ParentLineNumber == target_line.ParentLineNumber && sl.OffsetInParentLine < target_line.OffsetInParentLine {
+				col += sl.TextLengthInCells
+			}
+		}
 		self.input_state.cursor.Y = target_line.ParentLineNumber
-		tp := wcswidth.TruncateToVisualLength(target_line.Text, visual_distance_into_text)
-		self.input_state.cursor.X = target_line.OffsetInParentLine + len(tp)
+		self.input_state.cursor.X = self.x_for_visual_column(self.input_state.lines[self.input_state.cursor.Y], col)
+	}
+}
+
+// Move the cursor to the text drawn in the cell at row and col, the inverse
+// of the cursor placement in get_screen_lines()
+func (self *Readline) move_cursor_to_screen_cell(row, col int) bool {
+	if self.screen_width == 0 {
+		self.update_current_screen_size()
+	}
+	screen_lines := self.get_screen_lines()
+	if row < 0 || row >= len(screen_lines) {
+		return false
+	}
+	target := screen_lines[row]
+	col = utils.Max(0, utils.Min(col-target.Prompt.Length, target.TextLengthInCells)) + target.ScrolledCells
+	for _, sl := range screen_lines[:row] {
+		if sl.ParentLineNumber == target.ParentLineNumber {
+			col += sl.TextLengthInCells
+		}
 	}
+	self.input_state.cursor.Y = target.ParentLineNumber
+	self.input_state.cursor.X = self.x_for_visual_column(self.input_state.lines[self.input_state.cursor.Y], col)
+	if p := self.start_of_editable_text(); self.input_state.cursor.Less(p) {
+		self.input_state.cursor = p
+	}
+	return true
 }
 
 func (self *Readline) move_cursor_vertically(amt int) (ans int) {
@@ -159,7 +361,7 @@ func (self *Readline) move_cursor_vertically(amt int) (ans int) {
 	target_line_num := utils.Min(utils.Max(0, cursor_line_num+amt), len(screen_lines)-1)
 	ans = target_line_num - cursor_line_num
 	if ans != 0 {
-		self.move_cursor_to_target_line(screen_lines[cursor_line_num], screen_lines[target_line_num])
+		self.move_cursor_to_target_line(screen_lines[cursor_line_num], screen_lines[target_line_num], screen_lines)
 	}
 	return ans
 }
@@ -172,14 +374,205 @@ func (self *Readline) move_cursor_down(amt uint) uint {
 	return ans
 }
 
+// Swap the current line with its neighbors, keeping the cursor on it
+func (self *Readline) move_line(amt int) bool {
+	y := self.input_state.cursor.Y
+	target := utils.Max(0, utils.Min(y+amt, len(self.input_state.lines)-1))
+	if target == y {
+		return false
+	}
+	lines := self.input_state.lines
+	line := lines[y]
+	if target < y {
+		copy(lines[target+1:y+1], lines[target:y])
+	} else {
+		copy(lines[y:target], lines[y+1:target+1])
+	}
+	lines[target] = line
+	self.input_state.cursor.Y = target
+	return true
+}
+
+// Swap the current line with the previous one and move the cursor to the
+// next line, like transpose-lines in emacs
+func (self *Readline) transpose_lines() bool {
+	y := self.input_state.cursor.Y
+	if y == 0 {
+		return false
+	}
+	lines := self.input_state.lines
+	lines[y-1], lines[y] = lines[y], lines[y-1]
+	if y+1 < len(lines) {
+		y++
+	}
+	self.input_state.cursor = Position{Y: y, X: utils.Min(self.input_state.cursor.X, len(lines[y]))}
+	return true
+}
+
+// Like delete-blank-lines in emacs: on a blank line collapse the surrounding
+// blank lines to it, or delete it if it is the only one, on any other line
+// delete the blank lines after it
+func (self *Readline) delete_blank_lines() bool {
+	lines := self.input_state.lines
+	is_blank := func(i int) bool { return strings.TrimSpace(lines[i]) == "" }
+	y := self.input_state.cursor.Y
+	first, last := y, y
+	for last+1 < len(lines) && is_blank(last+1) {
+		last++
+	}
+	if !is_blank(y) {
+		self.input_state.lines = append(lines[:y+1], lines[last+1:]...)
+		return last > y
+	}
+	for first > 0 && is_blank(first-1) {
+		first--
+	}
+	if first < last {
+		lines[first] = ""
+		self.input_state.lines = append(lines[:first+1], lines[last+1:]...)
+		self.input_state.cursor = Position{Y: first}
+		return true
+	}
+	if len(lines) == 1 {
+		return false
+	}
+	self.input_state.lines = append(lines[:y], lines[y+1:]...)
+	if y < len(self.input_state.lines) {
+		self.input_state.cursor = Position{Y: y}
+	} else {
+		self.input_state.cursor = Position{Y: y - 1, X: len(self.input_state.lines[y-1])}
+	}
+	return true
+}
+
+func (self *Readline) duplicate_lines(count int) {
+	first, last := self.input_state.cursor.Y, self.input_state.cursor.Y
+	if start, end, ok := self.active_region(); ok {
+		first, last = start.Y, end.Y
+	}
+	lines := self.input_state.lines
+	n := last - first + 1
+	new_lines := make([]string, 0, len(lines)+count*n)
+	new_lines = append(new_lines, lines[:last+1]...)
+	for i := 0; i < count; i++ {
+		new_lines = append(new_lines, lines[first:last+1]...)
+	}
+	new_lines = append(new_lines, lines[last+1:]...)
+	self.input_state.lines = new_lines
+	self.input_state.cursor.Y += count * n
+}
+
+// Insert count empty lines below or above the current line, like o and O in
+// vi, and move the cursor to the new line next to the current one. Lines
+// opened above the first line go after the protected prefix.
+func (self *Readline) open_lines(count int, below bool) {
+	lines := self.input_state.lines
+	y := self.input_state.cursor.Y
+	at := y
+	if below {
+		at++
+	}
+	new_lines := make([]string, 0, len(lines)+count)
+	new_lines = append(new_lines, lines[:at]...)
+	for i := 0; i < count; i++ {
+		new_lines = append(new_lines, "")
+	}
+	new_lines = append(new_lines, lines[at:]...)
+	if at == 0 && self.protected_prefix != "" {
+		new_lines[0], new_lines[count] = self.protected_prefix, new_lines[count][len(self.protected_prefix):]
+	}
+	self.input_state.lines = new_lines
+	if below {
+		y++
+	} else {
+		y += count - 1
+	}
+	self.input_state.cursor = Position{X: self.line_start(y), Y: y}
+}
+
+// Insert count characters from the line delta lines away, starting at the
+// visual column of the cursor, like ctrl+y and ctrl+e in insert mode in vim
+func (self *Readline) copy_from_adjacent_line(delta, count int) bool {
+	y := self.input_state.cursor.Y + delta
+	if y < 0 || y >= len(self.input_state.lines) {
+		return false
+	}
+	src := self.input_state.lines[y]
+	x := self.x_for_visual_column(src, self.visual_column(self.input_state.lines[self.input_state.cursor.Y], self.input_state.cursor.X))
+	end := x
+	for ci := wcswidth.NewCellIterator(src[x:]); count > 0 && ci.Forward(); count-- {
+		end += len(ci.Current())
+	}
+	if end == x {
+		return false
+	}
+	self.add_text(src[x:end])
+	return true
+}
+
+func (self *Readline) cancel_input() {
+	text := self.all_text()
+	self.queue_write("\r\n")
+	if self.keep_text_on_cancel {
+		input_state := self.input_state.copy()
+		self.ResetText()
+		self.input_state = input_state
+	} else {
+		self.ResetText()
+	}
+	if self.on_cancel != nil {
+		self.on_cancel(text)
+	}
+}
+
+// Give the OnAccept callback, if any, a chance to modify the input or veto
+// accepting it
+func (self *Readline) accept_input() bool {
+	if self.on_accept == nil {
+		return true
+	}
+	text := self.all_text()
+	final_text, accept := self.on_accept(text, self.trim_accepted_text.trim(text))
+	if final_text != text {
+		self.input_state = InputState{lines: []string{""}}
+		self.add_text(final_text)
+	}
+	return accept
+}
+
+// Ask whether to accept input that RlInit.ConfirmAccept considers dangerous,
+// leaving it as it is unless the answer is yes
+func (self *Readline) confirm_and_accept_input() {
+	self.start_query("Really accept this input? [y/n]", yes_no_query(func(yes bool) error {
+		if yes && self.accept_input() {
+			self.clear_recovery()
+			return ErrAcceptInput
+		}
+		return nil
+	}))
+}
+
 func (self *Readline) move_to_start_of_line() bool {
-	if self.input_state.cursor.X > 0 {
-		self.input_state.cursor.X = 0
+	if start := self.line_start(self.input_state.cursor.Y); self.input_state.cursor.X > start {
+		self.input_state.cursor.X = start
 		return true
 	}
 	return false
 }
 
+// Move to the first non-whitespace character of the line, or its end if it
+// is blank
+func (self *Readline) move_to_first_non_blank() bool {
+	start := self.line_start(self.input_state.cursor.Y)
+	line := self.input_state.lines[self.input_state.cursor.Y][start:]
+	x := start + len(line) - len(strings.TrimLeftFunc(line, unicode.IsSpace))
+	if x == self.input_state.cursor.X {
+		return false
+	}
+	self.input_state.cursor.X = x
+	return true
+}
+
 func (self *Readline) move_to_end_of_line() bool {
 	line := self.input_state.lines[self.input_state.cursor.Y]
 	if self.input_state.cursor.X >= len(line) {
@@ -189,8 +582,64 @@ func (self *Readline) move_to_end_of_line() bool {
 	return true
 }
 
+// The byte offsets in the current line of the start and end of the screen row
+// the cursor is on. The end of a row that wraps is its last cell, since the
+// cursor is drawn on the next row after it.
+func (self *Readline) screen_row_bounds() (start, end int) {
+	y := self.input_state.cursor.Y
+	line := self.input_state.lines[y]
+	screen_lines := self.get_screen_lines()
+	col := 0
+	for i, sl := range screen_lines {
+		if sl.ParentLineNumber != y {
+			continue
+		}
+		if sl.CursorCell > -1 {
+			start, end = self.x_for_visual_column(line, col), len(line)
+			if i+1 < len(screen_lines) && screen_lines[i+1].ParentLineNumber == y && sl.TextLengthInCells > 0 {
+				end = self.x_for_visual_column(line, col+sl.TextLengthInCells-1)
+			}
+			return utils.Max(start, self.line_start(y)), utils.Max(end, self.line_start(y))
+		}
+		col += sl.TextLengthInCells
+	}
+	return self.line_start(y), len(line)
+}
+
+func (self *Readline) move_to_x(x int) bool {
+	if x == self.input_state.cursor.X {
+		return false
+	}
+	self.input_state.cursor.X = x
+	return true
+}
+
+func (self *Readline) home() bool {
+	switch self.home_end_behavior {
+	case HomeEndScreenRow:
+		start, _ := self.screen_row_bounds()
+		return self.move_to_x(start)
+	case HomeEndDocument:
+		return self.move_to_start()
+	case HomeEndSmart:
+		return self.move_to_first_non_blank() || self.move_to_start_of_line()
+	}
+	return self.move_to_start_of_line()
+}
+
+func (self *Readline) end() bool {
+	switch self.home_end_behavior {
+	case HomeEndScreenRow:
+		_, end := self.screen_row_bounds()
+		return self.move_to_x(end) || self.accept_autosuggestion()
+	case HomeEndDocument:
+		return self.move_to_end() || self.accept_autosuggestion()
+	}
+	return self.move_to_end_of_line() || self.accept_autosuggestion()
+}
+
 func (self *Readline) move_to_start() bool {
-	if self.input_state.cursor.Y == 0 && self.input_state.cursor.X == 0 {
+	if !self.start_of_editable_text().Less(self.input_state.cursor) {
 		return false
 	}
 	self.input_state.cursor.Y = 0
@@ -212,6 +661,12 @@ func (self *Readline) erase_between(start, end Position) string {
 	if end.Less(start) {
 		start, end = end, start
 	}
+	if p := self.start_of_editable_text(); start.Less(p) {
+		if !p.Less(end) {
+			return ""
+		}
+		start = p
+	}
 	buf := strings.Builder{}
 	if start.Y == end.Y {
 		line := self.input_state.lines[start.Y]
@@ -233,6 +688,7 @@ func (self *Readline) erase_between(start, end Position) string {
 		} else if i == start.Y {
 			lines = append(lines, line[:start.X])
 			buf.WriteString(line[start.X:])
+			buf.WriteString("\n")
 			if self.input_state.cursor.Y == i && self.input_state.cursor.X > start.X {
 				self.input_state.cursor.X = start.X
 			}
@@ -366,12 +822,170 @@ func (self *Readline) move_to_start_of_word(amt uint, traverse_line_breaks bool,
 	return
 }
 
+func (self *Readline) start_of_word_before_cursor(is_word_char func(string) bool) Position {
+	line := self.input_state.lines[self.input_state.cursor.Y]
+	ci := wcswidth.NewCellIterator(line[:self.input_state.cursor.X]).GotoEnd()
+	ans := self.input_state.cursor
+	for ci.Backward() && is_word_char(ci.Current()) {
+		ans.X -= len(ci.Current())
+	}
+	return ans
+}
+
+func (self *Readline) end_of_word_after_cursor(is_word_char func(string) bool) Position {
+	line := self.input_state.lines[self.input_state.cursor.Y]
+	ans := self.input_state.cursor
+	for ci := wcswidth.NewCellIterator(line[ans.X:]); ci.Forward() && is_word_char(ci.Current()); {
+		ans.X += len(ci.Current())
+	}
+	return ans
+}
+
+func (self *Readline) replace_text_before_cursor(start Position, replacement string) {
+	self.erase_between(start, self.input_state.cursor)
+	self.add_text(replacement)
+}
+
+// Replace the text between the byte offsets start and end of all_text(). A
+// cursor inside the replaced text is moved to the end of the replacement,
+// one after it keeps its place relative to the text following it.
+func (self *Readline) replace_range(start, end int, replacement string) bool {
+	text := self.all_text()
+	if start < len(self.protected_prefix) || end < start || end > len(text) || (start < len(text) && !utf8.RuneStart(text[start])) || (end < len(text) && !utf8.RuneStart(text[end])) {
+		return false
+	}
+	cursor := position_to_offset(self.input_state.lines, self.input_state.cursor)
+	if cursor >= end {
+		cursor += len(replacement) - (end - start)
+	} else if cursor > start {
+		cursor = start + len(replacement)
+	}
+	self.erase_between(offset_to_position(text, start), offset_to_position(text, end))
+	self.input_state.cursor = offset_to_position(text, start)
+	self.add_text(replacement)
+	self.input_state.cursor = offset_to_position(self.all_text(), cursor)
+	self.region.active = false
+	return true
+}
+
+func (self *Readline) replace_word_before_cursor(replacement string) {
+	line := self.input_state.lines[self.input_state.cursor.Y]
+	x := completion_word_start(line[:self.input_state.cursor.X], self.completions.word_breaks)
+	self.replace_text_before_cursor(Position{X: x, Y: self.input_state.cursor.Y}, replacement)
+}
+
+// Replace the space delimited word before the cursor with the sorted list of
+// files matching it as a glob pattern relative to glob_base_dir
+func (self *Readline) expand_glob() bool {
+	start := self.start_of_word_before_cursor(has_no_space_chars)
+	pattern := self.input_state.lines[start.Y][start.X:self.input_state.cursor.X]
+	if pattern == "" {
+		return false
+	}
+	base := self.glob_base_dir
+	if base == "" {
+		base = "."
+	}
+	q := pattern
+	if !filepath.IsAbs(pattern) {
+		q = filepath.Join(base, pattern)
+	}
+	matches, err := filepath.Glob(q)
+	if err != nil || len(matches) == 0 {
+		return false
+	}
+	sort.Strings(matches)
+	for i, m := range matches {
+		if !filepath.IsAbs(pattern) {
+			if r, err := filepath.Rel(base, m); err == nil {
+				m = r
+			}
+		}
+		if utils.EscapeSHMetaCharacters(m) != m {
+			m = utils.QuoteStringForSH(m)
+		}
+		matches[i] = m
+	}
+	self.replace_text_before_cursor(start, strings.Join(matches, " "))
+	return true
+}
+
+func (self *Readline) insert_tab() {
+	if !self.insert_spaces_for_tab {
+		self.add_text("\t")
+		return
+	}
+	before, _ := expand_tabs(self.input_state.lines[self.input_state.cursor.Y][:self.input_state.cursor.X], -1, self.tab_width, self.ambiguous_width)
+	self.add_text(strings.Repeat(" ", self.tab_width-self.stringwidth(before)%self.tab_width))
+}
+
+func (self *Readline) insert_date_time() {
+	self.add_text(time.Now().Format(self.date_time_format))
+}
+
+// Parse a code point in hex, optionally prefixed by U+ or 0x. Control
+// characters and surrogates are rejected.
+func parse_code_point(text string) (rune, bool) {
+	text = strings.TrimSpace(text)
+	for _, prefix := range []string{"U+", "u+", "0x", "0X"} {
+		text = strings.TrimPrefix(text, prefix)
+	}
+	n, err := strconv.ParseUint(text, 16, 32)
+	if err != nil || n < 0x20 || (0x7f <= n && n <= 0x9f) || !utf8.ValidRune(rune(n)) {
+		return 0, false
+	}
+	return rune(n), true
+}
+
+func (self *Readline) insert_code_point() {
+	self.read_string("Unicode character (hex): ", "", func(text string) error {
+		if ch, ok := parse_code_point(text); ok {
+			self.add_text(string(ch))
+		} else {
+			self.beep()
+		}
+		return nil
+	})
+}
+
 func (self *Readline) kill_text(text string) {
 	if ActionStartKillActions < self.last_action && self.last_action < ActionEndKillActions {
 		self.kill_ring.append_to_existing_item(text)
 	} else {
 		self.kill_ring.add_new_item(text)
 	}
+	self.copy_kill_to_clipboard()
+}
+
+// Keep the system clipboard in sync with the top of the kill ring, so that it
+// holds the whole of a run of coalesced kills, as a yank would
+func (self *Readline) copy_kill_to_clipboard() {
+	if text := self.kill_ring.yank(); self.kill_to_clipboard && text != "" {
+		self.queue_write(clipboard_escape_code(text))
+	}
+}
+
+// Kill everything after the cursor, on this and all following lines
+func (self *Readline) truncate_at_cursor() bool {
+	last := len(self.input_state.lines) - 1
+	end := Position{X: len(self.input_state.lines[last]), Y: last}
+	if !self.input_state.cursor.Less(end) {
+		return false
+	}
+	self.kill_text(self.erase_between(self.input_state.cursor, end))
+	return true
+}
+
+// Move the entire input into the kill ring as a single new item
+func (self *Readline) kill_input() bool {
+	text := self.all_text()[len(self.protected_prefix):]
+	if text == "" {
+		return false
+	}
+	self.kill_ring.add_new_item(text)
+	self.copy_kill_to_clipboard()
+	self.input_state = InputState{lines: []string{self.protected_prefix}, cursor: self.start_of_editable_text()}
+	return true
 }
 
 func (self *Readline) kill_to_end_of_line() bool {
@@ -384,14 +998,42 @@ func (self *Readline) kill_to_end_of_line() bool {
 	return true
 }
 
+// Kill from the cursor to the end of the screen row it is on, which is
+// different from the end of the line when the line is wrapped
+func (self *Readline) kill_to_end_of_screen_line() bool {
+	screen_lines := self.get_screen_lines()
+	col := -1
+	for _, sl := range screen_lines {
+		if sl.ParentLineNumber != self.input_state.cursor.Y {
+			continue
+		}
+		if col < 0 {
+			col = 0
+		}
+		col += sl.TextLengthInCells
+		if sl.CursorCell > -1 {
+			break
+		}
+	}
+	line := self.input_state.lines[self.input_state.cursor.Y]
+	end := self.x_for_visual_column(line, col)
+	if col < 0 || end <= self.input_state.cursor.X {
+		return false
+	}
+	self.input_state.lines[self.input_state.cursor.Y] = line[:self.input_state.cursor.X] + line[end:]
+	self.kill_text(line[self.input_state.cursor.X:end])
+	return true
+}
+
 func (self *Readline) kill_to_start_of_line() bool {
 	line := self.input_state.lines[self.input_state.cursor.Y]
-	if self.input_state.cursor.X <= 0 {
+	start := self.line_start(self.input_state.cursor.Y)
+	if self.input_state.cursor.X <= start {
 		return false
 	}
-	self.input_state.lines[self.input_state.cursor.Y] = line[self.input_state.cursor.X:]
-	self.kill_text(line[:self.input_state.cursor.X])
-	self.input_state.cursor.X = 0
+	self.input_state.lines[self.input_state.cursor.Y] = line[:start] + line[self.input_state.cursor.X:]
+	self.kill_text(line[start:self.input_state.cursor.X])
+	self.input_state.cursor.X = start
 	return true
 }
 
@@ -431,6 +1073,202 @@ func (self *Readline) kill_previous_space_delimited_word(amt uint, traverse_line
 	return num_killed
 }
 
+// Find where the terminal word erase (WERASE) starting at the end of text
+// stops. By default, as with the Linux line discipline and ALTWERASE on the
+// BSDs, trailing non-word characters and then the word characters before
+// them are erased. With blank_delimited trailing blanks and then the
+// non-blank characters before them are erased, as specified by POSIX.
+func word_erase_start(text string, blank_delimited bool) int {
+	is_blank := func(r rune) bool { return r == ' ' || r == '\t' }
+	seen := false
+	for text != "" {
+		r, sz := utf8.DecodeLastRuneInString(text)
+		var in_word bool
+		if blank_delimited {
+			in_word = !is_blank(r)
+		} else {
+			in_word = r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+		}
+		if in_word {
+			seen = true
+		} else if seen {
+			break
+		}
+		text = text[:len(text)-sz]
+	}
+	return len(text)
+}
+
+// Kill the previous word with the semantics of the terminal's word erase
+// character. Like the terminal, this never crosses a line break.
+func (self *Readline) word_erase(amt uint) bool {
+	line := self.input_state.lines[self.input_state.cursor.Y]
+	x := self.input_state.cursor.X
+	for ; amt > 0 && x > self.line_start(self.input_state.cursor.Y); amt-- {
+		x = word_erase_start(line[:x], self.word_erase_blank_delimited)
+	}
+	if x == self.input_state.cursor.X {
+		return false
+	}
+	self.kill_text(self.erase_between(Position{X: x, Y: self.input_state.cursor.Y}, self.input_state.cursor))
+	return true
+}
+
+const quote_chars = "'\"`"
+
+// Find the quoted string on line that encloses x, or failing that, the first
+// quoted string after x. Returns the byte offsets of the opening and closing
+// quote characters. A backslash escapes the character following it.
+func find_enclosing_quotes(line string, x int) (start, end int, found bool) {
+	var q byte
+	start = -1
+	next_start := -1
+	for i := 0; i < len(line); i++ {
+		ch := line[i]
+		if q == 0 {
+			if strings.IndexByte(quote_chars, ch) > -1 {
+				q = ch
+				start = i
+			} else if ch == '\\' {
+				i++
+			}
+			continue
+		}
+		switch ch {
+		case '\\':
+			i++
+		case q:
+			if start <= x && x <= i {
+				return start, i, true
+			}
+			if next_start < 0 && start > x {
+				next_start, end = start, i
+			}
+			q = 0
+		}
+	}
+	if next_start > -1 {
+		return next_start, end, true
+	}
+	return -1, -1, false
+}
+
+// Kill back to the amt-th previous occurrence of ch on the current line,
+// including ch itself if inclusive
+func (self *Readline) zap_back_to_char(ch string, amt uint, inclusive bool) bool {
+	line := self.input_state.lines[self.input_state.cursor.Y]
+	x := self.input_state.cursor.X
+	for ; amt > 0; amt-- {
+		if x = strings.LastIndex(line[:x], ch); x < 0 {
+			return false
+		}
+	}
+	if !inclusive {
+		x += len(ch)
+	}
+	if x == self.input_state.cursor.X {
+		return true
+	}
+	y := self.input_state.cursor.Y
+	self.kill_text(self.erase_between(Position{X: x, Y: y}, self.input_state.cursor))
+	return true
+}
+
+func (self *Readline) start_zap_back_to_char(ac Action, amt uint, inclusive bool) {
+	self.start_query("Zap back to char:", func(event *loop.KeyEvent) error {
+		if event.Text == "" {
+			return nil
+		}
+		// the previous action determines whether the killed text is
+		// appended to the last kill
+		if self.zap_back_to_char(event.Text, amt, inclusive) {
+			self.last_action = ac
+		} else {
+			self.beep()
+		}
+		return nil
+	})
+}
+
+func (self *Readline) kill_quoted_text(include_quotes bool) bool {
+	line := self.input_state.lines[self.input_state.cursor.Y]
+	start, end, found := find_enclosing_quotes(line, self.input_state.cursor.X)
+	if !found {
+		return false
+	}
+	if include_quotes {
+		end++
+	} else {
+		start++
+	}
+	if start >= end {
+		self.input_state.cursor.X = start
+		return true
+	}
+	y := self.input_state.cursor.Y
+	self.input_state.cursor.X = start
+	self.kill_text(self.erase_between(Position{X: start, Y: y}, Position{X: end, Y: y}))
+	return true
+}
+
+// Change the quotes around text from old to new, removing the backslashes
+// before old and adding them before new. Also returns the new position of the
+// byte offset x in text.
+func requote(text string, x int, old, new byte) (string, int) {
+	buf := strings.Builder{}
+	buf.Grow(len(text) + 8)
+	new_x := -1
+	for i := 0; i < len(text); i++ {
+		if i == x {
+			new_x = buf.Len()
+		}
+		switch ch := text[i]; {
+		case ch == '\\' && i+1 < len(text):
+			if text[i+1] != old {
+				buf.WriteByte(ch)
+			}
+			i++
+			if i == x {
+				new_x = buf.Len()
+			}
+			buf.WriteByte(text[i])
+		case ch == new:
+			buf.WriteByte('\\')
+			buf.WriteByte(ch)
+		default:
+			buf.WriteByte(ch)
+		}
+	}
+	if new_x < 0 {
+		new_x = buf.Len()
+	}
+	return buf.String(), new_x
+}
+
+// Cycle the quotes of the quoted string enclosing the cursor from single to
+// double to backticks, escaping the contents to suit
+func (self *Readline) cycle_quotes() bool {
+	line := self.input_state.lines[self.input_state.cursor.Y]
+	x := self.input_state.cursor.X
+	start, end, found := find_enclosing_quotes(line, x)
+	if !found || x < start || x > end {
+		return false
+	}
+	old := line[start]
+	new := quote_chars[(strings.IndexByte(quote_chars, old)+1)%len(quote_chars)]
+	text, text_x := requote(line[start+1:end], x-start-1, old, new)
+	switch {
+	case x == start:
+	case x == end:
+		x = start + 1 + len(text)
+	default:
+		x = start + 1 + text_x
+	}
+	self.input_state.lines[self.input_state.cursor.Y] = line[:start] + string(new) + text + string(new) + line[end+1:]
+	self.input_state.cursor.X = x
+	return true
+}
+
 func (self *Readline) ensure_position_in_bounds(pos *Position) *Position {
 	pos.Y = utils.Max(0, utils.Min(pos.Y, len(self.input_state.lines)-1))
 	line := self.input_state.lines[pos.Y]
@@ -505,12 +1343,24 @@ func (self *Readline) _perform_action(ac Action, repeat_count uint) (err error,
 		if self.move_to_start_of_line() {
 			return
 		}
+	case ActionMoveToFirstNonBlank:
+		if self.move_to_first_non_blank() {
+			return
+		}
 	case ActionMoveToEndOfLine:
-		if self.move_to_end_of_line() {
+		if self.move_to_end_of_line() || self.accept_autosuggestion() {
+			return
+		}
+	case ActionHome:
+		if self.home() {
+			return
+		}
+	case ActionEnd:
+		if self.end() {
 			return
 		}
 	case ActionMoveToEndOfWord:
-		if self.move_to_end_of_word(repeat_count, true, has_word_chars) > 0 {
+		if self.move_to_end_of_word(repeat_count, true, has_word_chars) > 0 || self.accept_autosuggestion_word(repeat_count) {
 			return
 		}
 	case ActionMoveToStartOfWord:
@@ -525,12 +1375,28 @@ func (self *Readline) _perform_action(ac Action, repeat_count uint) (err error,
 		if self.move_to_end() {
 			return
 		}
+	case ActionMoveToFirstLine:
+		if self.move_to_line(int(repeat_count) - 1) {
+			return
+		}
+	case ActionMoveToLastLine:
+		if self.move_to_line(len(self.input_state.lines) - int(repeat_count)) {
+			return
+		}
+	case ActionMoveToNextParagraph:
+		if self.move_by_paragraph(int(repeat_count)) {
+			return
+		}
+	case ActionMoveToPreviousParagraph:
+		if self.move_by_paragraph(-int(repeat_count)) {
+			return
+		}
 	case ActionCursorLeft:
 		if self.move_cursor_left(repeat_count, true) > 0 {
 			return
 		}
 	case ActionCursorRight:
-		if self.move_cursor_right(repeat_count, true) > 0 {
+		if self.move_cursor_right(repeat_count, true) > 0 || self.accept_autosuggestion() {
 			return
 		}
 	case ActionEndInput:
@@ -543,7 +1409,15 @@ func (self *Readline) _perform_action(ac Action, repeat_count uint) (err error,
 		}
 		return
 	case ActionAcceptInput:
-		err = ErrAcceptInput
+		if self.continue_incomplete_input() {
+			return
+		}
+		if self.confirm_accept != nil && self.confirm_accept(self.all_text()) {
+			self.confirm_and_accept_input()
+		} else if self.accept_input() {
+			err = ErrAcceptInput
+			self.clear_recovery()
+		}
 		return
 	case ActionCursorUp:
 		if self.move_cursor_vertically(-int(repeat_count)) != 0 {
@@ -553,44 +1427,110 @@ func (self *Readline) _perform_action(ac Action, repeat_count uint) (err error,
 		if self.move_cursor_vertically(int(repeat_count)) != 0 {
 			return
 		}
+	case ActionMoveLineUp:
+		if self.move_line(-int(repeat_count)) {
+			return
+		}
+	case ActionMoveLineDown:
+		if self.move_line(int(repeat_count)) {
+			return
+		}
+	case ActionTransposeLines:
+		if self.transpose_lines() {
+			for i := uint(1); i < repeat_count && self.transpose_lines(); i++ {
+			}
+			return
+		}
+	case ActionDuplicateLine:
+		self.duplicate_lines(int(repeat_count))
+		return
+	case ActionOpenLineBelow:
+		self.open_lines(int(repeat_count), true)
+		return
+	case ActionOpenLineAbove:
+		self.open_lines(int(repeat_count), false)
+		return
+	case ActionCopyFromLineAbove:
+		if self.copy_from_adjacent_line(-1, int(repeat_count)) {
+			return
+		}
+	case ActionCopyFromLineBelow:
+		if self.copy_from_adjacent_line(1, int(repeat_count)) {
+			return
+		}
+	case ActionToggleHorizontalScroll:
+		self.horizontal_scroll = !self.horizontal_scroll
+		return
+	case ActionJumpToPreviousEdit:
+		if self.jump_to_edit_location(-int(repeat_count)) {
+			return
+		}
+	case ActionJumpToNextEdit:
+		if self.jump_to_edit_location(int(repeat_count)) {
+			return
+		}
+	case ActionNextTemplateField:
+		if self.goto_template_field(int(repeat_count)) {
+			return
+		}
+	case ActionPreviousTemplateField:
+		if self.goto_template_field(-int(repeat_count)) {
+			return
+		}
 	case ActionHistoryPreviousOrCursorUp:
 		dont_set_last_action = true
-		if self.perform_action(ActionCursorUp, repeat_count) == ErrCouldNotPerformAction {
+		if _, ok := self.recalled_history_display(); ok {
+			// the displayed text is a single entry, not lines to move between
+			err = self.perform_action(ActionHistoryPrevious, repeat_count)
+		} else if err = self.perform_action(ActionCursorUp, repeat_count); err == ErrCouldNotPerformAction && !self.history.disabled {
 			err = self.perform_action(ActionHistoryPrevious, repeat_count)
 		}
 		return
 	case ActionHistoryNextOrCursorDown:
 		dont_set_last_action = true
-		if self.perform_action(ActionCursorDown, repeat_count) == ErrCouldNotPerformAction {
+		if _, ok := self.recalled_history_display(); ok {
+			err = self.perform_action(ActionHistoryNext, repeat_count)
+		} else if err = self.perform_action(ActionCursorDown, repeat_count); err == ErrCouldNotPerformAction && !self.history.disabled {
 			err = self.perform_action(ActionHistoryNext, repeat_count)
 		}
 		return
 	case ActionHistoryFirst:
-		if self.history_first() {
+		if !self.history.disabled && self.history_first() {
 			return
 		}
 	case ActionHistoryPrevious:
-		if self.history_prev(repeat_count) {
+		if !self.history.disabled && self.history_prev(repeat_count) {
 			return
 		}
 	case ActionHistoryNext:
-		if self.history_next(repeat_count) {
+		if !self.history.disabled && self.history_next(repeat_count) {
 			return
 		}
 	case ActionHistoryLast:
-		if self.history_last() {
+		if !self.history.disabled && self.history_last() {
 			return
 		}
 	case ActionClearScreen:
-		self.loop.StartAtomicUpdate()
-		self.loop.ClearScreen()
-		self.RedrawNonAtomic()
-		self.loop.EndAtomicUpdate()
+		if self.loop != nil {
+			defer self.mirror_output()()
+			self.loop.StartAtomicUpdate()
+			self.loop.ClearScreen()
+			self.RedrawNonAtomic()
+			self.loop.EndAtomicUpdate()
+		}
 		return
 	case ActionKillToEndOfLine:
 		if self.kill_to_end_of_line() {
 			return
 		}
+	case ActionTruncateAtCursor:
+		if self.truncate_at_cursor() {
+			return
+		}
+	case ActionKillToEndOfScreenLine:
+		if self.kill_to_end_of_screen_line() {
+			return
+		}
 	case ActionKillToStartOfLine:
 		if self.kill_to_start_of_line() {
 			return
@@ -607,6 +1547,129 @@ func (self *Readline) _perform_action(ac Action, repeat_count uint) (err error,
 		if self.kill_previous_space_delimited_word(repeat_count, true) > 0 {
 			return
 		}
+	case ActionWordErase:
+		if self.word_erase(repeat_count) {
+			return
+		}
+	case ActionKillNextParagraph:
+		if self.kill_paragraph(int(repeat_count)) {
+			return
+		}
+	case ActionKillPreviousParagraph:
+		if self.kill_paragraph(-int(repeat_count)) {
+			return
+		}
+	case ActionZapBackToChar, ActionZapBackUpToChar:
+		if self.history_search == nil {
+			dont_set_last_action = true
+			self.start_zap_back_to_char(ac, repeat_count, ac == ActionZapBackToChar)
+			return
+		}
+	case ActionKillInsideQuotes:
+		if self.kill_quoted_text(false) {
+			return
+		}
+	case ActionKillAroundQuotes:
+		if self.kill_quoted_text(true) {
+			return
+		}
+	case ActionKillRegion:
+		if self.kill_region() {
+			return
+		}
+	case ActionCycleQuotes:
+		if self.cycle_quotes() {
+			return
+		}
+	case ActionExpandAbbreviation:
+		if self.expand_abbreviation() {
+			return
+		}
+	case ActionKillInput:
+		if self.kill_input() {
+			return
+		}
+	case ActionPreviousArgument:
+		if self.history_search == nil && self.cycle_argument_history(int(repeat_count)) {
+			return
+		}
+	case ActionNextArgument:
+		if self.history_search == nil && self.cycle_argument_history(-int(repeat_count)) {
+			return
+		}
+	case ActionCapitalizeLines:
+		if self.capitalize_lines() {
+			return
+		}
+	case ActionSwapCase:
+		if self.swap_case_of_region() {
+			return
+		}
+	case ActionIndent:
+		if self.indent_lines(int(repeat_count)) {
+			return
+		}
+	case ActionDedent:
+		if self.indent_lines(-int(repeat_count)) {
+			return
+		}
+	case ActionDeleteIndentation:
+		if self.delete_indentation() {
+			return
+		}
+	case ActionQueryReplace:
+		if self.history_search == nil {
+			self.start_query_replace()
+			return
+		}
+	case ActionInsertCommandOutput:
+		if self.history_search == nil {
+			self.start_insert_command_output()
+			return
+		}
+	case ActionFilterThroughCommand:
+		if self.history_search == nil {
+			self.start_filter_through_command()
+			return
+		}
+	case ActionInsertCodePoint:
+		if self.history_search == nil {
+			self.insert_code_point()
+			return
+		}
+	case ActionSurround:
+		if self.history_search == nil {
+			// the region must stay active until the delimiter is chosen
+			dont_set_last_action = true
+			self.start_query("Surround with:", self.surround_with_key)
+			return
+		}
+	case ActionStartKeyboardMacro:
+		if self.start_keyboard_macro() {
+			return
+		}
+	case ActionEndKeyboardMacro:
+		if self.end_keyboard_macro() {
+			return
+		}
+	case ActionCallKeyboardMacro:
+		// the last action is that of the replayed keys
+		dont_set_last_action = true
+		var ok bool
+		if ok, err = self.call_keyboard_macro(repeat_count); ok {
+			return
+		}
+	case ActionRepeatLastChange:
+		// the last action is the repeated one
+		dont_set_last_action = true
+		var ok bool
+		if ok, err = self.repeat_last_change(repeat_count); ok {
+			return
+		}
+	case ActionCopyToClipboard:
+		if self.copy_to_clipboard() {
+			return
+		}
 	case ActionYank:
 		if self.yank(repeat_count, false) {
 			return
@@ -615,12 +1678,49 @@ func (self *Readline) _perform_action(ac Action, repeat_count uint) (err error,
 		if self.yank(repeat_count, true) {
 			return
 		}
+	case ActionInsertTab:
+		if self.history_search == nil {
+			self.insert_tab()
+			return
+		}
+	case ActionExpandGlob:
+		if self.history_search == nil && self.expand_glob() {
+			return
+		}
+	case ActionInsertDateTime:
+		if self.history_search == nil {
+			for i := uint(0); i < repeat_count; i++ {
+				self.insert_date_time()
+			}
+			return
+		}
+	case ActionSetMark:
+		self.set_mark()
+		return
+	case ActionDeleteBlankLines:
+		if self.delete_blank_lines() {
+			return
+		}
+	case ActionDeleteTrailingWhitespace:
+		if self.delete_trailing_whitespace(repeat_count > 1) {
+			return
+		}
+	case ActionSortLines:
+		if self.sort_lines() {
+			return
+		}
+	case ActionUniqueLines:
+		if self.unique_lines() {
+			return
+		}
 	case ActionAbortCurrentLine:
-		self.loop.QueueWriteString("\r\n")
-		self.ResetText()
+		self.cancel_input()
 		return
 	case ActionHistoryIncrementalSearchForwards:
 		if self.history_search == nil {
+			if self.history.disabled {
+				break
+			}
 			self.create_history_search(false, repeat_count)
 			return
 		}
@@ -629,6 +1729,9 @@ func (self *Readline) _perform_action(ac Action, repeat_count uint) (err error,
 		}
 	case ActionHistoryIncrementalSearchBackwards:
 		if self.history_search == nil {
+			if self.history.disabled {
+				break
+			}
 			self.create_history_search(true, repeat_count)
 			return
 		}
@@ -641,6 +1744,7 @@ func (self *Readline) _perform_action(ac Action, repeat_count uint) (err error,
 		if self.history_search != nil {
 			self.add_text_to_history_search(text)
 		} else {
+			self.clear_pristine_template_field()
 			self.add_text(text)
 		}
 		return
@@ -654,12 +1758,45 @@ func (self *Readline) _perform_action(ac Action, repeat_count uint) (err error,
 			self.end_history_search(true)
 			return
 		}
+	case ActionPossibleCompletions:
+		if self.history_search == nil && self.possible_completions() {
+			return
+		}
 	case ActionCompleteForward:
-		if self.complete(true, repeat_count) {
+		if self.template != nil && self.goto_template_field(int(repeat_count)) {
+			return
+		}
+		if self.complete(true, repeat_count, self.completions.menu_complete) {
 			return
 		}
 	case ActionCompleteBackward:
-		if self.complete(false, repeat_count) {
+		if self.template != nil && self.goto_template_field(-int(repeat_count)) {
+			return
+		}
+		if self.complete(false, repeat_count, self.completions.menu_complete) {
+			return
+		}
+	case ActionMenuComplete:
+		if self.complete(true, repeat_count, true) {
+			return
+		}
+	case ActionMenuCompleteBackward:
+		if self.complete(false, repeat_count, true) {
+			return
+		}
+	case ActionDismissCompletions:
+		self.dismiss_completions()
+		return
+	case ActionShowMoreCompletions:
+		if self.show_more_completions() {
+			return
+		}
+	case ActionAcceptAutoSuggestion:
+		if self.accept_autosuggestion() {
+			return
+		}
+	case ActionAcceptAutoSuggestionWord:
+		if self.accept_autosuggestion_word(repeat_count) {
 			return
 		}
 	}
@@ -667,12 +1804,62 @@ func (self *Readline) _perform_action(ac Action, repeat_count uint) (err error,
 	return
 }
 
+// Undo any change to the protected prefix made by an action, failing it, and
+// keep the cursor out of the prefix. Text that replaced the input while
+// history searching gets the prefix added instead.
+func (self *Readline) ensure_protected_prefix(restore bool, before InputState, err error) error {
+	if !strings.HasPrefix(self.input_state.lines[0], self.protected_prefix) {
+		if restore {
+			self.input_state = before
+			return ErrCouldNotPerformAction
+		}
+		self.input_state.lines[0] = self.protected_prefix + self.input_state.lines[0]
+		if self.input_state.cursor.Y == 0 {
+			self.input_state.cursor.X += len(self.protected_prefix)
+		}
+	}
+	if p := self.start_of_editable_text(); self.input_state.cursor.Less(p) {
+		self.input_state.cursor = p
+	}
+	return err
+}
+
 func (self *Readline) perform_action(ac Action, repeat_count uint) error {
+	self.message = ""
+	if !is_history_navigation_action(ac) {
+		self.recalled = recalled_history_item{}
+	}
+	protect := self.protected_prefix != "" && self.history_search == nil
+	var before InputState
+	if protect {
+		before = self.input_state.copy()
+	}
+	text_before, text_to_be_added := "", ""
+	record_change := self.history_search == nil && !self.last_change.repeating && is_repeatable_change(ac)
+	if record_change {
+		text_before, text_to_be_added = self.all_text(), strings.Repeat(self.text_to_be_added, int(repeat_count))
+	}
 	err, dont_set_last_action := self._perform_action(ac, repeat_count)
+	if self.protected_prefix != "" && self.history_search == nil {
+		err = self.ensure_protected_prefix(protect, before, err)
+	}
+	if record_change && err == nil && self.history_search == nil && self.all_text() != text_before {
+		self.record_change(ac, repeat_count, text_to_be_added)
+	}
+	if !self.modified && self.history_search == nil && self.all_text() != self.seeded_text {
+		self.modified = true
+	}
+	if self.history_search == nil {
+		self.record_edit_location()
+		self.sync_template()
+	}
 	if err == nil && !dont_set_last_action {
+		if !keeps_region_active(ac) {
+			self.region.active = false
+		}
 		self.last_action = ac
-		if self.completions.current.results != nil && ac != ActionCompleteForward && ac != ActionCompleteBackward {
-			self.completions.current = completion{}
+		if (self.completions.current.results != nil || self.completions.pending != nil) && !is_completion_action(ac) {
+			self.dismiss_completions()
 		}
 	}
 	return err
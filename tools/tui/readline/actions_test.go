@@ -4,15 +4,24 @@ package readline
 
 import (
 	"container/list"
+	"encoding/json"
 	"fmt"
+	"io"
 	"kitty/tools/cli"
 	"kitty/tools/tui/loop"
+	"kitty/tools/utils"
 	"kitty/tools/utils/shlex"
+	"kitty/tools/wcswidth"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
 var _ = fmt.Print
@@ -68,6 +77,21 @@ func TestAddText(t *testing.T) {
 		rl.input_state.cursor.X = 2
 		rl.add_text("12\n34")
 	}, "abcd\nxy12\n34", "z", "abcd\nxy12\n34z")
+	dt("one tw three", func(rl *Readline) {
+		rl.input_state.cursor.X = 6
+		rl.ReplaceWordBeforeCursor("two")
+	}, "one two", " three", "one two three")
+	dt("one ", func(rl *Readline) {
+		rl.ReplaceWordBeforeCursor("two")
+	}, "one two", "", "one two")
+	// . is not a completion word break character, so the whole of b.cd
+	// is replaced
+	dt("a\nb.cd", func(rl *Readline) {
+		rl.ReplaceWordBeforeCursor("xyz")
+	}, "a\nxyz", "", "a\nxyz")
+	dt("a\n--b=c.d", func(rl *Readline) {
+		rl.ReplaceWordBeforeCursor("xyz")
+	}, "a\n--b=xyz", "", "a\n--b=xyz")
 }
 
 func TestGetScreenLines(t *testing.T) {
@@ -139,6 +163,111 @@ func TestGetScreenLines(t *testing.T) {
 	)
 }
 
+func TestExpandGlob(t *testing.T) {
+	rl := new_rl()
+	rl.glob_base_dir = t.TempDir()
+	for _, name := range []string{"b.go", "a.go", "with space.go", "c.txt"} {
+		if err := os.WriteFile(filepath.Join(rl.glob_base_dir, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rl.add_text("ls *.go")
+	if err := rl.perform_action(ActionExpandGlob, 1); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("ls a.go b.go 'with space.go'", rl.all_text()); diff != "" {
+		t.Fatalf("Glob not expanded correctly:\n%s", diff)
+	}
+	rl.add_text(" *.none")
+	if rl.perform_action(ActionExpandGlob, 1) != ErrCouldNotPerformAction {
+		t.Fatalf("Expanding a glob with no matches did not fail")
+	}
+	rl.ResetText()
+	rl.add_text("ls " + filepath.Join(rl.glob_base_dir, "*.txt"))
+	if err := rl.perform_action(ActionExpandGlob, 1); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("ls "+filepath.Join(rl.glob_base_dir, "c.txt"), rl.all_text()); diff != "" {
+		t.Fatalf("Absolute glob not expanded correctly:\n%s", diff)
+	}
+}
+
+func TestInsertDateTime(t *testing.T) {
+	rl := new_rl()
+	rl.add_text("x ")
+	rl.perform_action(ActionInsertDateTime, 1)
+	if _, err := time.Parse(time.RFC3339, strings.TrimPrefix(rl.all_text(), "x ")); err != nil {
+		t.Fatalf("Inserted date/time not in the default format: %#v: %s", rl.all_text(), err)
+	}
+	rl.ResetText()
+	rl.date_time_format = "2006"
+	rl.perform_action(ActionInsertDateTime, 1)
+	if diff := cmp.Diff(strconv.Itoa(time.Now().Year()), rl.all_text()); diff != "" {
+		t.Fatalf("Inserted date/time not in the specified format:\n%s", diff)
+	}
+}
+
+func TestTabs(t *testing.T) {
+	for _, x := range []struct {
+		line            string
+		cursor          int
+		expected        string
+		expected_cursor int
+	}{
+		{"a\tb", 2, "a   b", 4},
+		{"\tab\tc", 0, "    ab  c", 0},
+		{"\tab\tc", 4, "    ab  c", 8},
+		{"abcd\t", 5, "abcd    ", 8},
+	} {
+		actual, actual_cursor := expand_tabs(x.line, x.cursor, 4, 1)
+		if diff := cmp.Diff(x.expected, actual); diff != "" {
+			t.Fatalf("Expanding tabs in %#v failed:\n%s", x.line, diff)
+		}
+		if actual_cursor != x.expected_cursor {
+			t.Fatalf("Cursor position after expanding tabs in %#v not as expected: %d != %d", x.line, x.expected_cursor, actual_cursor)
+		}
+	}
+	rl := new_rl()
+	rl.tab_width = 4
+	rl.add_text("a")
+	rl.perform_action(ActionInsertTab, 1)
+	if diff := cmp.Diff("a\t", rl.all_text()); diff != "" {
+		t.Fatalf("Inserting a tab failed:\n%s", diff)
+	}
+	sl := rl.get_screen_lines()
+	if sl[0].Text != "a   " || sl[0].CursorCell != rl.prompt.Length+4 {
+		t.Fatalf("Tab not expanded in screen lines: %#v", sl[0])
+	}
+	rl.add_text("b\nabcd")
+	rl.perform_action(ActionCursorUp, 1)
+	if diff := cmp.Diff("a\t", rl.text_upto_cursor_pos()); diff != "" {
+		t.Fatalf("Moving the cursor up over a tab failed:\n%s", diff)
+	}
+	rl.ResetText()
+	rl.insert_spaces_for_tab = true
+	rl.add_text("ab")
+	rl.perform_action(ActionInsertTab, 1)
+	if diff := cmp.Diff("ab  ", rl.all_text()); diff != "" {
+		t.Fatalf("Inserting spaces for a tab failed:\n%s", diff)
+	}
+}
+
+func TestAmbiguousWidth(t *testing.T) {
+	rl := new_rl()
+	rl.add_text("\u00a7\u00a7")
+	if sl := rl.get_screen_lines(); sl[0].CursorCell != rl.prompt.Length+2 {
+		t.Fatalf("Cursor position with narrow ambiguous width chars not as expected: %#v", sl[0])
+	}
+	rl.SetAmbiguousWidthIsWide(true)
+	if sl := rl.get_screen_lines(); sl[0].CursorCell != rl.prompt.Length+4 {
+		t.Fatalf("Cursor position with wide ambiguous width chars not as expected: %#v", sl[0])
+	}
+	rl.add_text("\u00a7\u00a7")
+	if sl := rl.get_screen_lines(); len(sl) != 2 || sl[1].Text != "\u00a7" {
+		t.Fatalf("Wrapping with wide ambiguous width chars not as expected: %#v", sl)
+	}
+}
+
 func TestCursorMovement(t *testing.T) {
 	dt := test_func(t)
 
@@ -268,6 +397,268 @@ func TestCursorMovement(t *testing.T) {
 
 }
 
+func TestSortLines(t *testing.T) {
+	rl := new_rl()
+	at := func(expected string) {
+		if diff := cmp.Diff(expected, rl.all_text()); diff != "" {
+			t.Fatalf("Text not as expected:\n%s", diff)
+		}
+	}
+	rl.add_text("c\nb\na\nb")
+	rl.perform_action(ActionSortLines, 1)
+	at("a\nb\nb\nc")
+	if rl.input_state.cursor != (Position{Y: 3, X: 1}) {
+		t.Fatalf("Cursor not in expected position: %+v", rl.input_state.cursor)
+	}
+	rl.perform_action(ActionUniqueLines, 1)
+	at("a\nb\nc")
+	if rl.input_state.cursor != (Position{Y: 2, X: 1}) {
+		t.Fatalf("Cursor not in expected position: %+v", rl.input_state.cursor)
+	}
+
+	rl.ResetText()
+	rl.add_text("z\nc\nb\na")
+	rl.input_state.cursor = Position{Y: 1}
+	rl.perform_action(ActionSetMark, 1)
+	rl.perform_action(ActionCursorDown, 1)
+	rl.perform_action(ActionSortLines, 1)
+	at("z\nb\nc\na")
+	if rl.region.active {
+		t.Fatalf("Region still active after editing")
+	}
+	if rl.perform_action(ActionSetMark, 1); rl.perform_action(ActionSortLines, 1) != ErrCouldNotPerformAction {
+		t.Fatalf("Sorting a region of a single line did not fail")
+	}
+}
+
+func TestDeleteTrailingWhitespace(t *testing.T) {
+	rl := new_rl()
+	rl.add_text("a \nb\t \nc  ")
+	rl.input_state.cursor = Position{Y: 1, X: 3}
+	test := func(repeat_count uint, expected string) {
+		if err := rl.perform_action(ActionDeleteTrailingWhitespace, repeat_count); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(expected, rl.all_text()); diff != "" {
+			t.Fatalf("Trailing whitespace not deleted correctly:\n%s", diff)
+		}
+	}
+	test(1, "a \nb\nc  ")
+	if rl.input_state.cursor != (Position{Y: 1, X: 1}) {
+		t.Fatalf("Cursor not moved out of the deleted whitespace: %+v", rl.input_state.cursor)
+	}
+	if rl.perform_action(ActionDeleteTrailingWhitespace, 1) != ErrCouldNotPerformAction {
+		t.Fatalf("Deleting non-existent trailing whitespace did not fail")
+	}
+	test(2, "a\nb\nc")
+}
+
+func TestMoveLine(t *testing.T) {
+	rl := new_rl()
+	rl.add_text("1\n2\n3\n4")
+	rl.input_state.cursor = Position{Y: 1, X: 1}
+	test := func(ac Action, repeat_count uint, expected string, expected_y int) {
+		rl.perform_action(ac, repeat_count)
+		if diff := cmp.Diff(expected, rl.all_text()); diff != "" {
+			t.Fatalf("Text not as expected after: %#v\n%s", ac, diff)
+		}
+		if rl.input_state.cursor != (Position{Y: expected_y, X: 1}) {
+			t.Fatalf("Cursor not as expected after: %#v: %+v", ac, rl.input_state.cursor)
+		}
+	}
+	test(ActionMoveLineDown, 1, "1\n3\n2\n4", 2)
+	test(ActionMoveLineUp, 2, "2\n1\n3\n4", 0)
+	if rl.perform_action(ActionMoveLineUp, 1) != ErrCouldNotPerformAction {
+		t.Fatalf("Moving the first line up did not fail")
+	}
+	test(ActionMoveLineDown, 5, "1\n3\n4\n2", 3)
+	test(ActionDuplicateLine, 1, "1\n3\n4\n2\n2", 4)
+	rl.input_state.cursor = Position{Y: 1, X: 1}
+	rl.perform_action(ActionSetMark, 1)
+	rl.perform_action(ActionCursorDown, 1)
+	test(ActionDuplicateLine, 1, "1\n3\n4\n3\n4\n2\n2", 4)
+	rl.ResetText()
+	rl.add_text("1\n2\n3")
+	rl.input_state.cursor = Position{Y: 0, X: 1}
+	rl.perform_action(ActionSetMark, 1)
+	rl.perform_action(ActionCursorDown, 1)
+	test(ActionDuplicateLine, 2, "1\n2\n1\n2\n1\n2\n3", 5)
+	rl.ResetText()
+	rl.add_text("1\n2\n3\n4")
+	rl.input_state.cursor = Position{Y: 0, X: 1}
+	if rl.perform_action(ActionTransposeLines, 1) != ErrCouldNotPerformAction {
+		t.Fatalf("Transposing the first line did not fail")
+	}
+	rl.input_state.cursor.Y = 1
+	test(ActionTransposeLines, 1, "2\n1\n3\n4", 2)
+	test(ActionTransposeLines, 2, "2\n3\n4\n1", 3)
+	rl.FeedKeys("ctrl+x ctrl+t")
+	if diff := cmp.Diff("2\n3\n1\n4", rl.all_text()); diff != "" {
+		t.Fatalf("ctrl+x ctrl+t did not transpose lines:\n%s", diff)
+	}
+}
+
+func TestEditLocations(t *testing.T) {
+	rl := new_rl()
+	type_text := func(text string) {
+		rl.text_to_be_added = text
+		rl.perform_action(ActionAddText, 1)
+	}
+	jump := func(ac Action, expected Position) {
+		if err := rl.perform_action(ac, 1); err != nil {
+			t.Fatalf("Failed to perform %#v: %s", ac, err)
+		}
+		if rl.input_state.cursor != expected {
+			t.Fatalf("Cursor not as expected after %#v: %+v != %+v", ac, expected, rl.input_state.cursor)
+		}
+	}
+	type_text("one\ntwo\nthree")
+	rl.input_state.cursor = Position{X: 3}
+	type_text("X")
+	rl.input_state.cursor = Position{Y: 1}
+	type_text("Y")
+	jump(ActionJumpToPreviousEdit, Position{X: 4})
+	jump(ActionJumpToPreviousEdit, Position{Y: 2, X: 5})
+	if rl.perform_action(ActionJumpToPreviousEdit, 1) != ErrCouldNotPerformAction {
+		t.Fatalf("Jumping before the oldest edit did not fail")
+	}
+	jump(ActionJumpToNextEdit, Position{X: 4})
+	jump(ActionJumpToNextEdit, Position{Y: 1, X: 1})
+	if rl.perform_action(ActionJumpToNextEdit, 1) != ErrCouldNotPerformAction {
+		t.Fatalf("Jumping after the newest edit did not fail")
+	}
+	rl.input_state.cursor = Position{Y: 1}
+	rl.perform_action(ActionKillToEndOfLine, 1)
+	if diff := cmp.Diff([]int{11, 4, 5}, rl.edit_locations.offsets); diff != "" {
+		t.Fatalf("Edit locations not adjusted for deleted text:\n%s", diff)
+	}
+}
+
+func TestKeymap(t *testing.T) {
+	rl := new_rl()
+	if err := rl.LoadKeymap(map[string]string{"ctrl+x ctrl+t": "TransposeLines", "ctrl+a": "Nil", "alt+z": "ActionSortLines"}); err != nil {
+		t.Fatal(err)
+	}
+	press := func(key string, mods loop.KeyModifiers) bool {
+		ev := loop.KeyEvent{Type: loop.PRESS, Key: key, Mods: mods}
+		if err := rl.handle_key_event(&ev); err != nil {
+			t.Fatal(err)
+		}
+		return ev.Handled
+	}
+	rl.add_text("1\n2")
+	if press("a", loop.CTRL) || rl.input_state.cursor.X != 1 {
+		t.Fatalf("Unbound key was handled")
+	}
+	press("x", loop.CTRL)
+	press("t", loop.CTRL)
+	if diff := cmp.Diff("2\n1", rl.all_text()); diff != "" {
+		t.Fatalf("Multi-key binding from keymap not used:\n%s", diff)
+	}
+	press("z", loop.ALT)
+	if diff := cmp.Diff("1\n2", rl.all_text()); diff != "" {
+		t.Fatalf("Binding from keymap not used:\n%s", diff)
+	}
+	for spec, name := range map[string]string{"ctrl+q": "NoSuchAction", "nomod+q": "SortLines", " ": "SortLines"} {
+		if err := rl.LoadKeymap(map[string]string{spec: name}); err == nil {
+			t.Fatalf("Invalid keymap entry did not fail: %#v: %#v", spec, name)
+		}
+	}
+	if names := ActionNames(); !utils.Contains(names, "TransposeLines") || utils.Contains(names, "") {
+		t.Fatalf("Action names not as expected: %#v", names)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	rl := new_rl()
+	cancelled := []string{}
+	rl.on_cancel = func(text string) { cancelled = append(cancelled, text) }
+	rl.add_text("abc")
+	if err := rl.perform_action(ActionAbortCurrentLine, 1); err != nil {
+		t.Fatal(err)
+	}
+	if rl.all_text() != "" {
+		t.Fatalf("Text not discarded on cancel: %#v", rl.all_text())
+	}
+	rl.keep_text_on_cancel = true
+	rl.add_text("xyz")
+	rl.perform_action(ActionAbortCurrentLine, 1)
+	if rl.all_text() != "xyz" {
+		t.Fatalf("Text not kept on cancel: %#v", rl.all_text())
+	}
+	if diff := cmp.Diff([]string{"abc", "xyz"}, cancelled); diff != "" {
+		t.Fatalf("Cancel callback not called as expected:\n%s", diff)
+	}
+	rl.ResetText()
+	if err := rl.perform_action(ActionEndInput, 1); err != io.EOF {
+		t.Fatalf("Ending empty input did not return EOF: %v", err)
+	}
+	rl.add_text("a")
+	if err := rl.perform_action(ActionEndInput, 1); err != ErrAcceptInput {
+		t.Fatalf("Ending non-empty input did not accept it: %v", err)
+	}
+}
+
+func TestSpinner(t *testing.T) {
+	rl := new_rl()
+	if rl.spinner_message() != "" {
+		t.Fatalf("Spinner message present without a spinner")
+	}
+	rl.start_spinner("loading")
+	if m := rl.spinner_message(); !strings.HasSuffix(m, " loading") || len(m) <= len(" loading") {
+		t.Fatalf("Spinner message not as expected: %#v", m)
+	}
+	rl.stop_spinner()
+	if rl.spinner_message() != "" {
+		t.Fatalf("Spinner message present after stopping the spinner")
+	}
+}
+
+func TestIdle(t *testing.T) {
+	rl := new_rl()
+	called := 0
+	rl.idle = idle{timeout: time.Second, callback: func() error {
+		called++
+		rl.SetText("idle")
+		return nil
+	}}
+	// the loop is not running so no timer is added
+	rl.start_idle_timer()
+	if rl.idle.timer_id != 0 {
+		t.Fatalf("Idle timer added without a running loop")
+	}
+	rl.idle.timer_id = 1
+	if err := rl.on_idle_timer(1); err != nil {
+		t.Fatal(err)
+	}
+	if called != 1 || rl.idle.timer_id != 0 || rl.all_text() != "idle" {
+		t.Fatalf("Idle callback not called correctly: called: %d timer_id: %d text: %#v", called, rl.idle.timer_id, rl.all_text())
+	}
+}
+
+func TestState(t *testing.T) {
+	rl := new_rl()
+	rl.add_text("one two")
+	rl.perform_action(ActionKillPreviousWord, 1)
+	s := rl.State()
+	rl.ResetText()
+	rl.add_text("other")
+	rl.kill_ring.add_new_item("x")
+	rl.restore_state(s)
+	if rl.all_text() != "one " || rl.input_state.cursor != (Position{X: 4}) || rl.last_action != ActionKillPreviousWord {
+		t.Fatalf("State not restored: %#v %+v %s", rl.all_text(), rl.input_state.cursor, rl.last_action)
+	}
+	if rl.kill_ring.items.Len() != 1 || rl.kill_ring.yank() != "two" {
+		t.Fatalf("Kill ring not restored: %#v", rl.kill_ring.yank())
+	}
+	// the snapshot must not be affected by later edits
+	rl.add_text("three")
+	rl.restore_state(s)
+	if rl.all_text() != "one " {
+		t.Fatalf("State snapshot modified by later edits: %#v", rl.all_text())
+	}
+}
+
 func TestYanking(t *testing.T) {
 	rl := new_rl()
 
@@ -319,6 +710,64 @@ func TestYanking(t *testing.T) {
 	rl.perform_action(ActionKillNextWord, 1)
 	assert_items("three", "one two")
 	assert_text(" ")
+
+	rl.ResetText()
+	rl.add_text("a\nb")
+	rl.perform_action(ActionKillToStartOfLine, 1)
+	rl.perform_action(ActionKillInput, 1)
+	assert_items("a\n", "b", "three", "one two")
+	assert_text("")
+	if rl.perform_action(ActionKillInput, 1) != ErrCouldNotPerformAction {
+		t.Fatalf("Killing empty input did not fail")
+	}
+	rl.perform_action(ActionYank, 1)
+	assert_text("a\n")
+}
+
+func TestKillToEndOfScreenLine(t *testing.T) {
+	rl := new_rl()
+	rl.add_text("abcdefghijklmnop")
+	rl.input_state.cursor.X = 2
+	rl.perform_action(ActionKillToEndOfScreenLine, 1)
+	if diff := cmp.Diff("abhijklmnop", rl.all_text()); diff != "" {
+		t.Fatalf("Killing to the end of the screen line failed:\n%s", diff)
+	}
+	if rl.kill_ring.yank() != "cdefg" {
+		t.Fatalf("Killed text not as expected: %#v", rl.kill_ring.yank())
+	}
+	rl.input_state.cursor.X = 9
+	rl.perform_action(ActionKillToEndOfScreenLine, 1)
+	if diff := cmp.Diff("abhijklmn", rl.all_text()); diff != "" {
+		t.Fatalf("Killing to the end of the last screen line failed:\n%s", diff)
+	}
+	if rl.perform_action(ActionKillToEndOfScreenLine, 1) != ErrCouldNotPerformAction {
+		t.Fatalf("Killing at the end of the line did not fail")
+	}
+}
+
+func TestKillQuotedText(t *testing.T) {
+	dt := test_func(t)
+
+	kill := func(x int, ac Action) func(*Readline) {
+		return func(rl *Readline) {
+			rl.input_state.cursor.X = x
+			rl.perform_action(ac, 1)
+		}
+	}
+	dt(`echo "one two" x`, kill(8, ActionKillInsideQuotes), `echo "`, `" x`)
+	dt(`echo "one two" x`, kill(8, ActionKillAroundQuotes), `echo `, ` x`)
+	dt(`echo "one two" x`, kill(0, ActionKillInsideQuotes), `echo "`, `" x`)
+	dt(`a 'b' "c\"d" e`, kill(8, ActionKillInsideQuotes), `a 'b' "`, `" e`)
+	dt("a `b` c", kill(3, ActionKillAroundQuotes), `a `, ` c`)
+	dt(`a \"b" c`, kill(0, ActionKillInsideQuotes), ``, `a \"b" c`)
+	rl := dt(`x "" y`, kill(0, ActionKillInsideQuotes), `x "`, `" y`)
+	if rl.kill_ring.items.Len() != 0 {
+		t.Fatalf("Killing empty quoted text added to the kill ring")
+	}
+	rl = dt(`say "hi"`, kill(6, ActionKillInsideQuotes), `say "`, `"`)
+	if rl.kill_ring.yank() != "hi" {
+		t.Fatalf("Killed quoted text not in kill ring: %#v", rl.kill_ring.yank())
+	}
 }
 
 func TestEraseChars(t *testing.T) {
@@ -515,6 +964,280 @@ func TestHistory(t *testing.T) {
 	ah("xy", "z2")
 	rl.perform_action(ActionTerminateHistorySearchAndRestore, 1)
 	ah("a", "")
+
+	rl.SetFuzzyMatching(true)
+	rl.perform_action(ActionHistoryIncrementalSearchBackwards, 1)
+	rl.text_to_be_added = "ao"
+	rl.perform_action(ActionAddText, 1)
+	ah("", "a one")
+	rl.perform_action(ActionHistoryIncrementalSearchBackwards, 1)
+	ah("", "a two")
+	rl.perform_action(ActionTerminateHistorySearchAndApply, 1)
+	ah("a two", "")
+}
+
+func TestNoHistory(t *testing.T) {
+	lp, _ := loop.New()
+	rl := New(lp, RlInit{Prompt: "$$ ", NoHistory: true})
+	rl.screen_width, rl.screen_height = 10, 100
+	rl.AddHistoryItem(HistoryItem{Cmd: "item", Timestamp: time.Now()})
+	if len(rl.history.all_items()) != 0 {
+		t.Fatalf("History item added with NoHistory")
+	}
+	rl.add_text("one\ntwo")
+	rl.perform_action(ActionHistoryPreviousOrCursorUp, 1)
+	if rl.input_state.cursor.Y != 0 || rl.all_text() != "one\ntwo" {
+		t.Fatalf("Up did not move the cursor with NoHistory: %+v %#v", rl.input_state.cursor, rl.all_text())
+	}
+	for _, ac := range []Action{ActionHistoryPreviousOrCursorUp, ActionHistoryPrevious, ActionHistoryFirst, ActionHistoryIncrementalSearchBackwards} {
+		if rl.perform_action(ac, 1) != ErrCouldNotPerformAction {
+			t.Fatalf("%s did not fail with NoHistory", ac)
+		}
+	}
+	if rl.history_search != nil || rl.all_text() != "one\ntwo" {
+		t.Fatalf("History actions changed the input with NoHistory")
+	}
+}
+
+func TestCorruptHistoryFile(t *testing.T) {
+	tdir := t.TempDir()
+	path := filepath.Join(tdir, "history.json")
+	data := `[{"cmd":"one","timestamp":"2023-01-01T00:00:00Z"},{"cmd":"tw` + "\xff" + `o","timestamp":"2023-01-02T00:00:00Z"},` +
+		`{"cmd": 3},{"cmd":"four","timestamp":"2023-01-04T00:00:00Z"},{"cmd":"fi`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cmds := func(items []HistoryItem) []string {
+		ans := make([]string, len(items))
+		for i, x := range items {
+			ans[i] = x.Cmd
+		}
+		return ans
+	}
+	h := NewHistory(path, 100)
+	if diff := cmp.Diff([]string{"one", "tw\ufffdo", "four"}, cmds(h.items)); diff != "" {
+		t.Fatalf("Items not recovered from corrupt history file:\n%s", diff)
+	}
+	h.AddItem("five", 0)
+	h.Shutdown()
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []HistoryItem
+	if err = json.Unmarshal(raw, &items); err != nil {
+		t.Fatalf("History file not valid after writing: %s", err)
+	}
+	if diff := cmp.Diff([]string{"one", "tw\ufffdo", "four", "five"}, cmds(items)); diff != "" {
+		t.Fatalf("History file not written correctly:\n%s", diff)
+	}
+	if entries, _ := os.ReadDir(tdir); len(entries) != 1 {
+		t.Fatalf("Temporary files left behind after writing history: %v", entries)
+	}
+}
+
+func TestSharedHistory(t *testing.T) {
+	tdir := t.TempDir()
+	path, shared_path := filepath.Join(tdir, "history.json"), filepath.Join(tdir, "shared.json")
+	shared_data := `[{"cmd":"global","timestamp":"2023-01-01T00:00:00Z"},{"cmd":"common","timestamp":"2023-01-03T00:00:00Z"}]`
+	os.WriteFile(shared_path, []byte(shared_data), 0o600)
+	os.WriteFile(path, []byte(`[{"cmd":"project","timestamp":"2023-01-02T00:00:00Z"},{"cmd":"common","timestamp":"2023-01-04T00:00:00Z"}]`), 0o600)
+	cmds := func(items []HistoryItem) []string {
+		ans := make([]string, len(items))
+		for i, x := range items {
+			ans[i] = x.Cmd
+		}
+		return ans
+	}
+	h := NewHistory(path, 100, shared_path)
+	if diff := cmp.Diff([]string{"global", "project", "common"}, cmds(h.all_items())); diff != "" {
+		t.Fatalf("Merged history not as expected:\n%s", diff)
+	}
+	h.AddItem("new", 0)
+	if diff := cmp.Diff([]string{"global", "project", "common", "new"}, cmds(h.all_items())); diff != "" {
+		t.Fatalf("Merged history not as expected after adding an item:\n%s", diff)
+	}
+	h.Shutdown()
+	if raw, _ := os.ReadFile(shared_path); string(raw) != shared_data {
+		t.Fatalf("The shared history file was modified: %s", raw)
+	}
+	h = NewHistory(path, 100)
+	if diff := cmp.Diff([]string{"project", "common", "new"}, cmds(h.items)); diff != "" {
+		t.Fatalf("History file not as expected:\n%s", diff)
+	}
+}
+
+func TestPinnedHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+	os.WriteFile(path, []byte(`[{"cmd":"one","timestamp":"2023-01-01T00:00:00Z"},{"cmd":"two","timestamp":"2023-01-02T00:00:00Z"}]`), 0o600)
+	cmds := func(items []HistoryItem) []string {
+		ans := make([]string, len(items))
+		for i, x := range items {
+			ans[i] = x.Cmd
+		}
+		return ans
+	}
+	h := NewHistory(path, 2)
+	if !h.SetPinned("one", true) || h.SetPinned("missing", true) {
+		t.Fatalf("Pinning history items did not work")
+	}
+	h.AddItem("three", 0)
+	h.AddItem("four", 0)
+	if diff := cmp.Diff([]string{"one", "three", "four"}, cmds(h.items)); diff != "" {
+		t.Fatalf("Pinned item not retained when trimming:\n%s", diff)
+	}
+	h.Shutdown()
+	h = NewHistory(path, 2)
+	if diff := cmp.Diff([]string{"one", "three", "four"}, cmds(h.items)); diff != "" || !h.items[0].Pinned {
+		t.Fatalf("Pinned item not persisted:\n%s", diff)
+	}
+	h.SetPinnedAt(0, false)
+	h.AddItem("five", 0)
+	if diff := cmp.Diff([]string{"four", "five"}, cmds(h.items)); diff != "" {
+		t.Fatalf("Unpinned item not trimmed:\n%s", diff)
+	}
+	h.Shutdown()
+}
+
+func TestHistoryFormatting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+	h := NewHistory(path, 10)
+	h.AddItem("one  \n", 0)
+	h.Shutdown()
+	raw, _ := os.ReadFile(path)
+	if !strings.Contains(string(raw), `"one  \n"`) || strings.HasSuffix(string(raw), "\n") {
+		t.Fatalf("History file not written as before by default: %s", raw)
+	}
+	h = NewHistory(path, 10)
+	h.trim_entries, h.final_newline = true, true
+	h.AddItem("two \t", 0)
+	h.Shutdown()
+	raw, _ = os.ReadFile(path)
+	if !strings.Contains(string(raw), `"two"`) || !strings.HasSuffix(string(raw), "]\n") {
+		t.Fatalf("History file not formatted as requested: %s", raw)
+	}
+	h = new_history(path, 10, "\n", nil)
+	h.AddItem("three", 0)
+	h.Shutdown()
+	raw, _ = os.ReadFile(path)
+	if !strings.Contains(string(raw), `"two\n"`) || !strings.Contains(string(raw), `"three\n"`) {
+		t.Fatalf("History entries written without the suffix: %s", raw)
+	}
+	h = new_history(path, 10, "\n", nil)
+	cmds := []string{}
+	for _, x := range h.items {
+		cmds = append(cmds, x.Cmd)
+	}
+	if diff := cmp.Diff([]string{"one  ", "one", "two", "three"}, cmds); diff != "" {
+		t.Fatalf("History entries read with the suffix:\n%s", diff)
+	}
+	if err := os.WriteFile(path, []byte(`[{"cmd": "one"}, {"cmd": 1}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var errs []error
+	h = NewHistoryWithErrorHandler(path, 10, func(err error) { errs = append(errs, err) })
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "Ignored 1 corrupted entries") {
+		t.Fatalf("Corrupted entries not reported to the error handler: %v", errs)
+	}
+	h.Shutdown()
+	errs = nil
+	h = NewHistoryWithErrorHandler(filepath.Join(path, "missing"), 10, func(err error) { errs = append(errs, err) })
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "Failed to open history file") {
+		t.Fatalf("Failure to open the history file not reported to the error handler: %v", errs)
+	}
+}
+
+func TestBalanceCheck(t *testing.T) {
+	rl := new_rl()
+	rl.balance_check = &BalanceCheck{}
+	accept := func(text string, expected_err error, expected_text string) {
+		rl.ResetText()
+		rl.add_text(text)
+		err := rl.perform_action(ActionAcceptInput, 1)
+		if err != expected_err {
+			t.Fatalf("Unexpected error accepting %#v: %v", text, err)
+		}
+		if diff := cmp.Diff(expected_text, rl.all_text()); diff != "" {
+			t.Fatalf("Text not as expected after accepting %#v:\n%s", text, diff)
+		}
+	}
+	accept("f(x)", ErrAcceptInput, "f(x)")
+	accept("f(x, [1", nil, "f(x, [1\n        ")
+	accept("f(']')", ErrAcceptInput, "f(']')")
+	accept("x = 'a\\'", nil, "x = 'a\\'\n")
+	accept("x)", ErrAcceptInput, "x)")
+	rl.balance_check = &BalanceCheck{Pairs: "<>", Quotes: "|", Indent: "\t"}
+	accept("<a (", nil, "<a (\n\t")
+	accept("|<|", ErrAcceptInput, "|<|")
+}
+
+func TestIsModified(t *testing.T) {
+	rl := new_rl()
+	check := func(expected bool) {
+		if rl.IsModified() != expected {
+			t.Fatalf("IsModified() was %v for text: %#v", !expected, rl.all_text())
+		}
+	}
+	check(false)
+	rl.SetText("abc")
+	check(false)
+	rl.perform_action(ActionCursorLeft, 1)
+	check(false)
+	rl.perform_action(ActionBackspace, 1)
+	check(true)
+	rl.text_to_be_added = "b"
+	rl.perform_action(ActionAddText, 1)
+	check(true)
+	rl.ResetText()
+	check(false)
+	rl.history.AddItem("xyz", 0)
+	rl.perform_action(ActionHistoryIncrementalSearchBackwards, 1)
+	rl.text_to_be_added = "x"
+	rl.perform_action(ActionAddText, 1)
+	check(false)
+	rl.perform_action(ActionTerminateHistorySearchAndRestore, 1)
+	check(false)
+	rl.perform_action(ActionHistoryPrevious, 1)
+	check(true)
+}
+
+func TestAutoSuggestions(t *testing.T) {
+	rl := new_rl()
+	rl.autosuggestion.enabled = true
+	rl.history.AddItem("git commit -m fix", 0)
+	rl.history.AddItem("git checkout main", 0)
+	rl.history.AddItem("git commit --amend", 0)
+
+	test := func(ac Action, before_cursor, suggestion string) {
+		rl.perform_action(ac, 1)
+		if diff := cmp.Diff(before_cursor, rl.text_upto_cursor_pos()); diff != "" {
+			t.Fatalf("The text before the cursor was not as expected for action: %#v\n%s", ac, diff)
+		}
+		if diff := cmp.Diff(suggestion, rl.current_autosuggestion()); diff != "" {
+			t.Fatalf("The autosuggestion was not as expected for action: %#v\n%s", ac, diff)
+		}
+	}
+
+	if rl.perform_action(ActionAcceptAutoSuggestionWord, 1) != ErrCouldNotPerformAction {
+		t.Fatalf("Accepting a non-existent autosuggestion did not fail")
+	}
+	rl.text_to_be_added = "git c"
+	test(ActionAddText, "git c", "ommit --amend")
+	test(ActionAcceptAutoSuggestionWord, "git commit", " --amend")
+	test(ActionAcceptAutoSuggestionWord, "git commit --amend", "")
+	test(ActionBackspace, "git commit --amen", "d")
+	rl.ResetText()
+	rl.text_to_be_added = "git ch"
+	test(ActionAddText, "git ch", "eckout main")
+	test(ActionMoveToEndOfWord, "git checkout", " main")
+	test(ActionCursorLeft, "git checkou", "")
+	test(ActionCursorRight, "git checkout", " main")
+	test(ActionCursorRight, "git checkout main", "")
+	rl.ResetText()
+	rl.text_to_be_added = "git commit -"
+	test(ActionAddText, "git commit -", "-amend")
+	rl.text_to_be_added = "m"
+	test(ActionAddText, "git commit -m", " fix")
 }
 
 func TestReadlineCompletion(t *testing.T) {
@@ -564,4 +1287,2270 @@ func TestReadlineCompletion(t *testing.T) {
 	ah("a2 ", "")
 	rl.perform_action(ActionCompleteBackward, 1)
 	ah("a11 ", "")
+
+	menu := func(ac Action, before_cursor string) {
+		rl.perform_action(ac, 1)
+		if diff := cmp.Diff(before_cursor, rl.text_upto_cursor_pos()); diff != "" {
+			t.Fatalf("Text before cursor not as expected for action: %#v\n%s", ac, diff)
+		}
+		if actual, _ := rl.completion_screen_lines(); len(actual) > 0 {
+			t.Fatalf("Completion screen lines rendered for menu completion: %#v", actual)
+		}
+	}
+	rl.ResetText()
+	rl.add_text("a")
+	menu(ActionMenuComplete, "a1 ")
+	menu(ActionMenuComplete, "a11 ")
+	menu(ActionMenuCompleteBackward, "a1 ")
+	menu(ActionMenuCompleteBackward, "a2 ")
+	menu(ActionDismissCompletions, "a2 ")
+	rl.ResetText()
+	rl.add_text("a")
+	menu(ActionMenuCompleteBackward, "a2 ")
+
+	rl.ResetText()
+	rl.completions.max_displayed = 2
+	rl.screen_height = 3
+	paging := func(expected_message string, expected_lines ...string) {
+		if diff := cmp.Diff(expected_message, rl.completions_message()); diff != "" {
+			t.Fatalf("Completions message not as expected:\n%s", diff)
+		}
+		lines, _ := rl.completion_screen_lines()
+		lines, _ = rl.completion_page(lines)
+		if diff := cmp.Diff(expected_lines, lines, cmpopts.EquateEmpty()); diff != "" {
+			t.Fatalf("Completion screen lines not as expected:\n%s", diff)
+		}
+	}
+	press := func(key string) {
+		ev := loop.KeyEvent{Type: loop.PRESS, Key: key, Text: key}
+		if err := rl.handle_key_event(&ev); err != nil {
+			t.Fatal(err)
+		}
+		if !ev.Handled {
+			t.Fatalf("The key %#v was not handled", key)
+		}
+	}
+	rl.add_text("a")
+	rl.perform_action(ActionCompleteForward, 1)
+	paging("Display all 3 possibilities? (y or n)")
+	press("n")
+	paging("")
+	rl.perform_action(ActionCompleteForward, 1)
+	press("y")
+	paging("--More--", rl.fmt_ctx.Title("Sub-commands"))
+	press(" ")
+	paging("", "a1 a11 a2 ")
+	if len(rl.keyboard_state.active_shortcut_maps) != 0 {
+		t.Fatalf("Completion paging shortcuts still active after the last page")
+	}
+	rl.ResetText()
+	rl.add_text("a")
+	rl.perform_action(ActionCompleteForward, 1)
+	paging("Display all 3 possibilities? (y or n)")
+	rl.handle_key_event(&loop.KeyEvent{Type: loop.RELEASE, Key: "TAB"})
+	paging("Display all 3 possibilities? (y or n)")
+	if err := rl.handle_key_event(&loop.KeyEvent{Type: loop.PRESS, Key: "LEFT"}); err != nil {
+		t.Fatal(err)
+	}
+	paging("")
+	if rl.input_state.cursor.X != len(rl.all_text())-1 || len(rl.keyboard_state.active_shortcut_maps) != 0 {
+		t.Fatalf("Left not handled normally after dismissing the paging prompt: %#v", rl.input_state.cursor)
+	}
+	rl.ResetText()
+	rl.add_text("a")
+	rl.perform_action(ActionCompleteForward, 1)
+	paging("Display all 3 possibilities? (y or n)")
+	if err := rl.handle_key_event(&loop.KeyEvent{Type: loop.PRESS, Key: "ENTER"}); err != ErrAcceptInput {
+		t.Fatalf("Enter did not accept the input while the paging prompt was shown: %v", err)
+	}
+	paging("")
+
+	rl.ResetText()
+	rl.completions.max_displayed = 0
+	for _, text := range []string{"a", "a2"} {
+		rl.ResetText()
+		rl.add_text(text)
+		if err := rl.perform_action(ActionPossibleCompletions, 1); err != nil {
+			t.Fatal(err)
+		}
+		if lines, _ := rl.completion_screen_lines(); rl.all_text() != text || len(lines) < 2 {
+			t.Fatalf("Possible completions not listed for %#v: %#v %#v", text, rl.all_text(), lines)
+		}
+	}
+	rl.perform_action(ActionCompleteForward, 1)
+	if diff := cmp.Diff("a2 ", rl.all_text()); diff != "" {
+		t.Fatalf("Completing after listing possible completions did not work:\n%s", diff)
+	}
+	rl.ResetText()
+	rl.add_text("a2")
+	rl.perform_action(ActionCompleteForward, 1)
+	if diff := cmp.Diff("a2 ", rl.all_text()); diff != "" {
+		t.Fatalf("Single completion not accepted immediately:\n%s", diff)
+	}
+	rl.ResetText()
+	rl.completions.show_single, rl.completions.no_space_after_single = true, true
+	rl.add_text("a2")
+	rl.perform_action(ActionCompleteForward, 1)
+	if lines, _ := rl.completion_screen_lines(); rl.all_text() != "a2" || len(lines) != 2 {
+		t.Fatalf("Single completion not displayed: %#v %#v", rl.all_text(), lines)
+	}
+	rl.perform_action(ActionCompleteForward, 1)
+	if lines, _ := rl.completion_screen_lines(); rl.all_text() != "a2" || len(lines) != 0 {
+		t.Fatalf("Single completion not accepted: %#v %#v", rl.all_text(), lines)
+	}
+	rl.completions.show_single, rl.completions.no_space_after_single = false, false
+
+	rl.ResetText()
+	rl.screen_width = 20
+	desc := func(word, description string, expected ...string) {
+		actual := rl.format_completion_with_description(&cli.Match{Word: word, Description: description}, 4)
+		if diff := cmp.Diff(expected, actual); diff != "" {
+			t.Fatalf("Completion with description not as expected for %#v:\n%s", word, diff)
+		}
+	}
+	desc("ab", "", "ab")
+	desc("ab", "short\nignored", "ab    "+rl.fmt_ctx.Dim("short"))
+	desc("abcd", "a very long description", "abcd  "+rl.fmt_ctx.Dim("a very long d…"))
+	desc("abcdef", "desc", "abcdef", "      "+rl.fmt_ctx.Dim("desc"))
+	rl.ambiguous_width = 2
+	desc("abcd", "a very long description", "abcd  "+rl.fmt_ctx.Dim("a very long …"))
+	rl.screen_width = 7
+	desc("abcd", "a very long description", "abcd  "+rl.fmt_ctx.Dim("a"))
+	rl.ambiguous_width, rl.screen_width = 1, 20
+}
+
+func TestAsyncCompletion(t *testing.T) {
+	rl := new_rl()
+	var requests []uint64
+	rl.completions.async_completer = func(before_cursor, after_cursor string, generation uint64) {
+		requests = append(requests, generation)
+	}
+	results := func(words ...string) *cli.Completions {
+		g := &cli.MatchGroup{}
+		for _, w := range words {
+			g.AddMatch(w)
+		}
+		return &cli.Completions{Groups: []*cli.MatchGroup{g}}
+	}
+	rl.add_text("a")
+	if err := rl.perform_action(ActionCompleteForward, 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || rl.spinner_message() == "" || rl.all_text() != "a" {
+		t.Fatalf("Async completion not requested correctly: %v %#v", requests, rl.all_text())
+	}
+	// a newer request makes the results of the older one stale
+	rl.perform_action(ActionCursorLeft, 1)
+	rl.perform_action(ActionCursorRight, 1)
+	rl.perform_action(ActionCompleteForward, 1)
+	if len(requests) != 2 || rl.set_completions(requests[0], results("abc")) {
+		t.Fatalf("Stale async completion results were not discarded")
+	}
+	if !rl.set_completions(requests[1], results("abc")) || rl.all_text() != "abc " || rl.spinner_message() != "" {
+		t.Fatalf("Async completion results not applied: %#v", rl.all_text())
+	}
+	// changing the text invalidates the request
+	rl.ResetText()
+	rl.add_text("a")
+	rl.perform_action(ActionCompleteForward, 1)
+	rl.text_to_be_added = "x"
+	rl.perform_action(ActionAddText, 1)
+	if rl.completions.pending != nil || rl.set_completions(requests[2], results("abc")) {
+		t.Fatalf("Async completion results not discarded after the text changed")
+	}
+	rl.ResetText()
+	rl.add_text("a")
+	rl.perform_action(ActionCompleteForward, 1)
+	if !rl.set_completions(requests[3], results("a1", "a2")) || rl.all_text() != "a" {
+		t.Fatalf("Async completion results with multiple candidates not applied: %#v", rl.all_text())
+	}
+	if lines, _ := rl.completion_screen_lines(); len(lines) == 0 {
+		t.Fatalf("Async completion candidates not displayed")
+	}
+	rl.perform_action(ActionCompleteForward, 1)
+	if diff := cmp.Diff("a1 ", rl.all_text()); diff != "" {
+		t.Fatalf("Cycling through async completion candidates failed:\n%s", diff)
+	}
+	// listing possible completions uses the async completer too
+	rl.ResetText()
+	rl.add_text("a")
+	rl.perform_action(ActionPossibleCompletions, 1)
+	if len(requests) != 5 || !rl.set_completions(requests[4], results("a1")) || rl.all_text() != "a" {
+		t.Fatalf("Async possible completions not requested: %v %#v", requests, rl.all_text())
+	}
+	if lines, _ := rl.completion_screen_lines(); len(lines) == 0 {
+		t.Fatalf("Async possible completions not displayed")
+	}
+	// a spinner started by the consumer is left running
+	rl.dismiss_completions()
+	rl.StartSpinner("Loading")
+	rl.ResetText()
+	rl.add_text("a")
+	rl.perform_action(ActionCompleteForward, 1)
+	rl.set_completions(requests[5], results("abc"))
+	if !strings.Contains(rl.spinner_message(), "Loading") {
+		t.Fatalf("Spinner started by the consumer stopped by completion: %#v", rl.spinner_message())
+	}
+	rl.StopSpinner()
+}
+
+func TestFuzzyMatch(t *testing.T) {
+	rank := func(query string, expected ...string) {
+		candidates := utils.Sort(append([]string{}, expected...), func(a, b string) bool { return a < b })
+		type scored struct {
+			text  string
+			score int
+		}
+		actual := make([]scored, 0, len(candidates))
+		for _, c := range candidates {
+			if score, _, ok := FuzzyMatch(query, c); ok {
+				actual = append(actual, scored{c, score})
+			}
+		}
+		actual = utils.StableSort(actual, func(a, b scored) bool { return a.score > b.score })
+		texts := make([]string, len(actual))
+		for i, x := range actual {
+			texts[i] = x.text
+		}
+		if diff := cmp.Diff(expected, texts); diff != "" {
+			t.Fatalf("Fuzzy ranking not as expected for: %#v\n%s", query, diff)
+		}
+	}
+	rank("gc", "gcc", "git checkout", "git commit", "log config")
+	rank("ls", "ls", "ls -la", "lsof", "less")
+	rank("ck", "checkout", "chunk", "clock")
+	rank("ss", "ssh", "set-spacing", "session")
+
+	test_positions := func(query, candidate string, expected ...int) {
+		_, positions, ok := FuzzyMatch(query, candidate)
+		if !ok {
+			t.Fatalf("%#v did not match %#v", query, candidate)
+		}
+		if diff := cmp.Diff(expected, positions); diff != "" {
+			t.Fatalf("Fuzzy match positions not as expected for: %#v in %#v\n%s", query, candidate, diff)
+		}
+	}
+	test_positions("gco", "git checkout", 0, 4, 9)
+	test_positions("ab", "xaàb", 1, 4)
+	if _, _, ok := FuzzyMatch("xyz", "xy"); ok {
+		t.Fatalf("Unexpected fuzzy match")
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	rl := new_rl()
+	type_text := func(text string) {
+		rl.text_to_be_added = text
+		rl.perform_action(ActionAddText, 1)
+	}
+	ah := func(before, after string) {
+		t.Helper()
+		if diff := cmp.Diff(before, rl.text_upto_cursor_pos()); diff != "" {
+			t.Fatalf("Text before cursor not as expected:\n%s", diff)
+		}
+		if diff := cmp.Diff(after, rl.text_after_cursor_pos()); diff != "" {
+			t.Fatalf("Text after cursor not as expected:\n%s", diff)
+		}
+	}
+	rl.add_text("$ ")
+	rl.insert_template("cp ${2:dest} ${1:src} ${x} $")
+	ah("$ cp dest src", " ${x} $")
+	type_text("a.txt")
+	ah("$ cp dest a.txt", " ${x} $")
+	rl.perform_action(ActionCompleteForward, 1)
+	ah("$ cp dest", " a.txt ${x} $")
+	rl.perform_action(ActionBackspace, 1)
+	type_text("ir")
+	ah("$ cp desir", " a.txt ${x} $")
+	if rl.perform_action(ActionNextTemplateField, 2) != nil {
+		t.Fatalf("Moving past the last template field failed")
+	}
+	ah("$ cp desir a.txt", " ${x} $")
+	if rl.template != nil {
+		t.Fatalf("The template was not ended after its last field")
+	}
+	if rl.perform_action(ActionPreviousTemplateField, 1) != ErrCouldNotPerformAction {
+		t.Fatalf("Moving between template fields without a template did not fail")
+	}
+
+	rl.ResetText()
+	rl.template_syntax_override = &TemplateSyntax{Start: "<", Separator: "|", End: ">"}
+	rl.insert_template("<1|one> <2> and <3|three>")
+	type_text("1")
+	rl.perform_action(ActionNextTemplateField, 1)
+	type_text("2")
+	rl.perform_action(ActionNextTemplateField, 1)
+	ah("1 2 and three", "")
+	rl.perform_action(ActionPreviousTemplateField, 2)
+	ah("1", " 2 and three")
+}
+
+func TestWordErase(t *testing.T) {
+	dt := test_func(t)
+
+	werase := func(x int, blank_delimited bool) func(*Readline) {
+		return func(rl *Readline) {
+			rl.word_erase_blank_delimited = blank_delimited
+			rl.input_state.cursor.X = x
+			rl.perform_action(ActionWordErase, 1)
+		}
+	}
+	dt("cd /usr/lib/", werase(12, false), "cd /usr/", "")
+	dt("cd /usr/lib/", werase(12, true), "cd ", "")
+	dt("a foo-bar_1 ", werase(12, false), "a foo-", "")
+	dt("a foo-bar_1 ", werase(12, true), "a ", "")
+	dt("x héllo", werase(8, false), "x ", "")
+	dt("x\nab cd", func(rl *Readline) {
+		rl.perform_action(ActionWordErase, 2)
+		if rl.perform_action(ActionWordErase, 1) != ErrCouldNotPerformAction {
+			t.Fatalf("Word erase at the start of a line did not fail")
+		}
+	}, "x\n", "")
+	rl := dt("one two", werase(7, false), "one ", "")
+	if rl.kill_ring.yank() != "two" {
+		t.Fatalf("Erased word not added to the kill ring: %#v", rl.kill_ring.yank())
+	}
+	if key_for_control_char(0x17) != "ctrl+w" || key_for_control_char(0) != "" {
+		t.Fatalf("Control character not mapped to the expected key")
+	}
+}
+
+func TestQuery(t *testing.T) {
+	rl := new_rl()
+	rl.add_text("abc")
+	answers := []bool{}
+	rl.QueryYesNo("Overwrite? [y/n]", func(yes bool) error {
+		answers = append(answers, yes)
+		return nil
+	})
+	if rl.query_message() != "Overwrite? [y/n]" {
+		t.Fatalf("Query message not displayed: %#v", rl.query_message())
+	}
+	ev := &loop.KeyEvent{Type: loop.PRESS, Key: "y", Text: "y"}
+	if err := rl.OnKeyEvent(ev); err != nil || !ev.Handled {
+		t.Fatalf("Answering the query failed: %v", err)
+	}
+	if rl.query_message() != "" || rl.all_text() != "abc" {
+		t.Fatalf("Query not finished after answering: %#v %#v", rl.query_message(), rl.all_text())
+	}
+	rl.QueryYesNo("Sure?", func(yes bool) error {
+		answers = append(answers, yes)
+		return nil
+	})
+	rl.OnKeyEvent(&loop.KeyEvent{Type: loop.PRESS, Key: "ESCAPE"})
+	rl.QueryYesNo("Sure?", func(yes bool) error {
+		answers = append(answers, yes)
+		return io.EOF
+	})
+	if err := rl.OnText("Y", false, false); err != io.EOF {
+		t.Fatalf("Error from the query callback not returned: %v", err)
+	}
+	if diff := cmp.Diff([]bool{true, false, true}, answers); diff != "" {
+		t.Fatalf("Query answers not as expected:\n%s", diff)
+	}
+	rl.OnKeyEvent(&loop.KeyEvent{Type: loop.PRESS, Key: "BACKSPACE"})
+	if rl.all_text() != "ab" {
+		t.Fatalf("Normal key handling not resumed after the query: %#v", rl.all_text())
+	}
+	var answer *loop.KeyEvent
+	rl.start_query("Key?", func(ev *loop.KeyEvent) error {
+		answer = ev
+		return nil
+	})
+	for _, ev := range []loop.KeyEvent{
+		{Type: loop.PRESS, Mods: loop.SHIFT, Key: "LEFT_SHIFT"},
+		{Type: loop.PRESS, Mods: loop.SHIFT | loop.CTRL, Key: "RIGHT_CONTROL"},
+		{Type: loop.RELEASE, Mods: loop.SHIFT, Key: "RIGHT_CONTROL"},
+	} {
+		rl.OnKeyEvent(&ev)
+	}
+	if answer != nil || rl.query_message() != "Key?" {
+		t.Fatalf("Query answered by a modifier key: %#v", answer)
+	}
+	rl.OnKeyEvent(&loop.KeyEvent{Type: loop.PRESS, Mods: loop.SHIFT, Key: "9", ShiftedKey: "(", Text: "("})
+	if answer == nil || answer.Text != "(" || rl.query_message() != "" {
+		t.Fatalf("Query not answered by a shifted key: %#v", answer)
+	}
+}
+
+func TestStyledPrompt(t *testing.T) {
+	lp, _ := loop.New()
+	rl := New(lp, RlInit{Prompt: "\x1b[1;31m>>\x1b[m \x01\x1b]2;title\x07[x]\x02", ContinuationPrompt: "\x1b[33m..\x1b[39m "})
+	rl.screen_width = 20
+	if rl.prompt.Length != 3 || rl.continuation_prompt.Length != 3 {
+		t.Fatalf("Width of styled prompts not as expected: %d %d", rl.prompt.Length, rl.continuation_prompt.Length)
+	}
+	if strings.ContainsAny(rl.prompt.Text, "\x01\x02") || !strings.Contains(rl.prompt.Text, "[x]") {
+		t.Fatalf("Ignore markers not removed from the prompt: %#v", rl.prompt.Text)
+	}
+	rl.add_text("ab\ncd")
+	rl.input_state.cursor.X = 1
+	sl := rl.get_screen_lines()
+	if sl[0].CursorCell != -1 || sl[1].CursorCell != 4 {
+		t.Fatalf("Cursor not at the expected column: %d %d", sl[0].CursorCell, sl[1].CursorCell)
+	}
+	rl.input_state.cursor = Position{}
+	if sl = rl.get_screen_lines(); sl[0].CursorCell != 3 {
+		t.Fatalf("Cursor not at the expected column: %d", sl[0].CursorCell)
+	}
+}
+
+func TestArgumentHistory(t *testing.T) {
+	rl := new_rl()
+	if rl.perform_action(ActionPreviousArgument, 1) != ErrCouldNotPerformAction {
+		t.Fatalf("Inserting an argument with an empty history did not fail")
+	}
+	rl.history.AddItem("cp a.txt '/tmp/my dir'", 0)
+	rl.history.AddItem("ls -l a.txt", 0)
+	if diff := cmp.Diff([]string{"a.txt", "-l", "/tmp/my dir"}, rl.history.arguments()); diff != "" {
+		t.Fatalf("Argument history not as expected:\n%s", diff)
+	}
+	rl.add_text("cat ")
+	ah := func(expected string) {
+		t.Helper()
+		if diff := cmp.Diff(expected, rl.all_text()); diff != "" {
+			t.Fatalf("Text after cycling through arguments not as expected:\n%s", diff)
+		}
+	}
+	rl.perform_action(ActionPreviousArgument, 1)
+	ah("cat a.txt")
+	rl.perform_action(ActionPreviousArgument, 2)
+	ah("cat '/tmp/my dir'")
+	rl.perform_action(ActionPreviousArgument, 1)
+	ah("cat a.txt")
+	rl.perform_action(ActionNextArgument, 1)
+	ah("cat '/tmp/my dir'")
+	rl.perform_action(ActionCursorLeft, 1)
+	if rl.perform_action(ActionNextArgument, 1) != ErrCouldNotPerformAction {
+		t.Fatalf("Moving to a newer argument outside a cycle did not fail")
+	}
+}
+
+func TestPasteTransform(t *testing.T) {
+	lp, _ := loop.New()
+	rl := New(lp, RlInit{PasteTransform: SanitizePastedText})
+	paste := func(text string) {
+		for _, ch := range text {
+			rl.OnText(string(ch), false, true)
+		}
+		rl.OnText("", false, false)
+	}
+	paste("a\x1b[31mb\x1b[m\r\nc\rd\x07\te")
+	if diff := cmp.Diff("ab\nc\nd\te", rl.all_text()); diff != "" {
+		t.Fatalf("Pasted text not sanitized:\n%s", diff)
+	}
+	rl.OnText("\x07", true, false)
+	if diff := cmp.Diff("ab\nc\nd\te\x07", rl.all_text()); diff != "" {
+		t.Fatalf("Typed text was transformed:\n%s", diff)
+	}
+	rl.paste_transform = func(string) string { return "" }
+	paste("xyz")
+	if diff := cmp.Diff("ab\nc\nd\te\x07", rl.all_text()); diff != "" {
+		t.Fatalf("Paste transformed to nothing inserted text:\n%s", diff)
+	}
+}
+
+func TestMoveToLine(t *testing.T) {
+	rl := new_rl()
+	rl.tab_width = 4
+	rl.add_text("one\n\ttwo\nthree\nx")
+	rl.input_state.cursor = Position{Y: 2, X: 4}
+	rl.perform_action(ActionMoveToFirstLine, 1)
+	if diff := cmp.Diff(Position{Y: 0, X: 3}, rl.input_state.cursor); diff != "" {
+		t.Fatalf("Moving to the first line failed:\n%s", diff)
+	}
+	rl.input_state.cursor.X = 2
+	rl.perform_action(ActionMoveToLastLine, 3)
+	if diff := cmp.Diff(Position{Y: 1, X: 0}, rl.input_state.cursor); diff != "" {
+		t.Fatalf("Moving to the third line from the end failed:\n%s", diff)
+	}
+	if rl.perform_action(ActionMoveToFirstLine, 2) != ErrCouldNotPerformAction {
+		t.Fatalf("Moving to the current line did not fail")
+	}
+	rl.perform_action(ActionMoveToFirstLine, 3)
+	rl.perform_action(ActionMoveToFirstLine, 2)
+	if diff := cmp.Diff(Position{Y: 1, X: 0}, rl.input_state.cursor); diff != "" {
+		t.Fatalf("Moving to a line keeping the visual column failed:\n%s", diff)
+	}
+	rl.perform_action(ActionMoveToLastLine, 1)
+	if diff := cmp.Diff(Position{Y: 3, X: 0}, rl.input_state.cursor); diff != "" {
+		t.Fatalf("Moving to the last line failed:\n%s", diff)
+	}
+	rl.move_to_line_and_column(1, 5)
+	if diff := cmp.Diff(Position{Y: 1, X: 2}, rl.input_state.cursor); diff != "" {
+		t.Fatalf("Moving to a visual column after a tab failed:\n%s", diff)
+	}
+	rl.move_to_line_and_column(10, 10)
+	if diff := cmp.Diff(Position{Y: 3, X: 1}, rl.input_state.cursor); diff != "" {
+		t.Fatalf("Moving to an out of bounds position was not clamped:\n%s", diff)
+	}
+}
+
+func TestScheduleRedraw(t *testing.T) {
+	rl := new_rl()
+	// the loop is not running so the redraw happens immediately
+	rl.ScheduleRedraw()
+	if rl.redraw_timer_id != 0 {
+		t.Fatalf("Redraw scheduled on a loop that is not running")
+	}
+	rl.redraw_timer_id = 1
+	rl.ScheduleRedraw()
+	rl.Redraw()
+	if rl.redraw_timer_id != 0 {
+		t.Fatalf("Redrawing did not cancel the scheduled redraw")
+	}
+}
+
+func TestCopyToClipboard(t *testing.T) {
+	if diff := cmp.Diff("\x1b]52;c;YWJj\x1b\\", clipboard_escape_code("abc")); diff != "" {
+		t.Fatalf("Clipboard escape code not as expected:\n%s", diff)
+	}
+	rl := new_rl()
+	if rl.perform_action(ActionCopyToClipboard, 1) != ErrCouldNotPerformAction {
+		t.Fatalf("Copying an empty line to the clipboard did not fail")
+	}
+	rl.add_text("one two\nthree")
+	rl.kill_ring.add_new_item("killed")
+	if rl.region_or_line_text() != "three" {
+		t.Fatalf("Current line not copied: %#v", rl.region_or_line_text())
+	}
+	if err := rl.perform_action(ActionCopyToClipboard, 1); err != nil {
+		t.Fatal(err)
+	}
+	rl.input_state.cursor = Position{X: 4}
+	rl.perform_action(ActionSetMark, 1)
+	rl.input_state.cursor = Position{Y: 1, X: 2}
+	if rl.region_or_line_text() != "two\nth" {
+		t.Fatalf("Region not copied: %#v", rl.region_or_line_text())
+	}
+	if err := rl.perform_action(ActionCopyToClipboard, 1); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("one two\nthree", rl.all_text()); diff != "" {
+		t.Fatalf("Copying to the clipboard changed the text:\n%s", diff)
+	}
+	if rl.kill_ring.items.Len() != 1 || rl.kill_ring.yank() != "killed" {
+		t.Fatalf("Copying to the clipboard changed the kill ring")
+	}
+}
+
+func TestAutoSuggestionLimits(t *testing.T) {
+	rl := new_rl()
+	rl.autosuggestion = autosuggestion{enabled: true, max_scan: 2, min_length: 3, delay: time.Second}
+	rl.history.AddItem("make install", 0)
+	rl.history.AddItem("ls", 0)
+	rl.history.AddItem("git status", 0)
+	suggest := func(text, expected string) {
+		t.Helper()
+		rl.SetText(text)
+		if diff := cmp.Diff(expected, rl.current_autosuggestion()); diff != "" {
+			t.Fatalf("The autosuggestion for %#v was not as expected:\n%s", text, diff)
+		}
+	}
+	// the loop is not running so the delayed lookup happens immediately
+	suggest("gi", "")
+	suggest("git", " status")
+	suggest("mak", "")
+	if v, found := rl.autosuggestion.cache["git"]; !found || v != "git status" {
+		t.Fatalf("Autosuggestion lookup not cached: %#v", rl.autosuggestion.cache)
+	}
+	rl.autosuggestion.cache["git"] = "git cached"
+	suggest("git", " cached")
+	rl.history.AddItem("git stash", 0)
+	suggest("git", " stash")
+	rl.autosuggestion.max_scan = 0
+	suggest("mak", "e install")
+}
+
+func TestSurround(t *testing.T) {
+	dt := test_func(t)
+
+	surround := func(x int, open, close string) func(*Readline) {
+		return func(rl *Readline) {
+			rl.input_state.cursor.X = x
+			rl.surround_with(open, close)
+		}
+	}
+	dt("cat my file", surround(5, `"`, `"`), `cat "my"`, ` file`)
+	dt("cat my file", surround(4, "(", ")"), `cat (my)`, ` file`)
+	dt("cat  x", surround(4, "[", "]"), `cat [`, `] x`)
+	dt("a b\nc d", func(rl *Readline) {
+		rl.input_state.cursor = Position{X: 2}
+		rl.perform_action(ActionSetMark, 1)
+		rl.input_state.cursor = Position{Y: 1, X: 1}
+		rl.surround_with("<<", ">>")
+		if rl.region.active {
+			t.Fatalf("Region still active after surrounding it")
+		}
+	}, "a <<b\nc>>", " d")
+	dt("echo one", func(rl *Readline) {
+		rl.perform_action(ActionSurround, 1)
+		if rl.query_message() == "" {
+			t.Fatalf("No query for the delimiter")
+		}
+		rl.OnKeyEvent(&loop.KeyEvent{Type: loop.PRESS, Key: "]", Text: "]"})
+	}, "echo [one]", "")
+	dt("echo one", func(rl *Readline) {
+		rl.perform_action(ActionSurround, 1)
+		rl.OnText("'", false, false)
+	}, "echo 'one'", "")
+	dt("echo one two", func(rl *Readline) {
+		rl.input_state.cursor.X = 5
+		rl.perform_action(ActionSetMark, 1)
+		rl.perform_action(ActionMoveToEndOfLine, 1)
+		rl.perform_action(ActionSurround, 1)
+		rl.OnText("{", false, false)
+	}, "echo {one two}", "")
+}
+
+func TestAlignContinuationPrompt(t *testing.T) {
+	lp, _ := loop.New()
+	rl := New(lp, RlInit{Prompt: "\x1b[32mmy-shell\x1b[m $ ", AlignContinuationPrompt: true})
+	if rl.prompt.Length != 11 || rl.continuation_prompt.Length != rl.prompt.Length {
+		t.Fatalf("Continuation prompt not aligned: %d != %d", rl.continuation_prompt.Length, rl.prompt.Length)
+	}
+	if !strings.Contains(rl.continuation_prompt.Text, "         \x1b[") {
+		t.Fatalf("Continuation prompt not padded on the left: %#v", rl.continuation_prompt.Text)
+	}
+	rl.prompt_text = "$ "
+	rl.update_prompts()
+	if rl.continuation_prompt.Length != 2 {
+		t.Fatalf("Continuation prompt padded for a narrower primary prompt: %d", rl.continuation_prompt.Length)
+	}
+	rl = New(lp, RlInit{Prompt: "abc ", EmptyContinuationPrompt: true, AlignContinuationPrompt: true})
+	if rl.continuation_prompt.Length != 4 {
+		t.Fatalf("Empty continuation prompt not aligned: %d", rl.continuation_prompt.Length)
+	}
+}
+
+func TestFeedKeys(t *testing.T) {
+	rl := new_rl()
+	if err := rl.FeedKeys("h i shift+x", "space", "ctrl+a alt+d"); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(" ", rl.all_text()); diff != "" {
+		t.Fatalf("Feeding keys did not edit as expected:\n%s", diff)
+	}
+	if err := rl.FeedKeys("ctrl+y x left left backspace"); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("hXx ", rl.all_text()); diff != "" {
+		t.Fatalf("Feeding keys did not edit as expected:\n%s", diff)
+	}
+	if err := rl.FeedKeys("a notamodifier+b"); err == nil || rl.all_text() != "haXx " {
+		t.Fatalf("Invalid key spec did not fail after the valid keys: %v %#v", err, rl.all_text())
+	}
+	rl.SetText("abc")
+	if err := rl.FeedKeys("enter"); err != ErrAcceptInput {
+		t.Fatalf("Accepting input via fed keys did not return ErrAcceptInput: %v", err)
+	}
+}
+
+func TestKeyboardMacro(t *testing.T) {
+	rl := new_rl()
+	if rl.perform_action(ActionCallKeyboardMacro, 1) != ErrCouldNotPerformAction {
+		t.Fatalf("Calling a macro before recording one did not fail")
+	}
+	rl.SetText("a\nb\nc\nd")
+	rl.input_state.cursor = Position{}
+	if err := rl.FeedKeys("ctrl+x (", "- space down home ctrl+x )"); err != nil {
+		t.Fatal(err)
+	}
+	if rl.perform_action(ActionEndKeyboardMacro, 1) != ErrCouldNotPerformAction {
+		t.Fatalf("Ending a macro when not recording did not fail")
+	}
+	if diff := cmp.Diff(4, len(rl.keyboard_macro.last)); diff != "" {
+		t.Fatalf("Recorded macro not as expected:\n%s", diff)
+	}
+	if err := rl.FeedKeys("alt+2 ctrl+x e"); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("- a\n- b\n- c\nd", rl.all_text()); diff != "" {
+		t.Fatalf("Replaying the macro did not edit as expected:\n%s", diff)
+	}
+	// pasted text is recorded as text
+	rl.FeedKeys("ctrl+x (")
+	rl.OnText("pa", false, true)
+	rl.OnText("ste", false, false)
+	rl.FeedKeys("ctrl+x )")
+	rl.FeedKeys("ctrl+x e")
+	if diff := cmp.Diff("- a\n- b\n- c\npastepasted", rl.all_text()); diff != "" {
+		t.Fatalf("Replaying a macro with pasted text did not edit as expected:\n%s", diff)
+	}
+}
+
+func TestDeleteBlankLines(t *testing.T) {
+	dbl := func(text string, y int, expected string, expected_cursor Position) {
+		t.Helper()
+		rl := new_rl()
+		rl.add_text(text)
+		rl.input_state.cursor = Position{Y: y}
+		if err := rl.perform_action(ActionDeleteBlankLines, 1); err != nil {
+			t.Fatalf("Deleting blank lines in %#v failed: %v", text, err)
+		}
+		if diff := cmp.Diff(expected, rl.all_text()); diff != "" {
+			t.Fatalf("Deleting blank lines in %#v failed:\n%s", text, diff)
+		}
+		if diff := cmp.Diff(expected_cursor, rl.input_state.cursor); diff != "" {
+			t.Fatalf("Cursor after deleting blank lines in %#v not as expected:\n%s", text, diff)
+		}
+	}
+	dbl("a\n\n \n\nb", 2, "a\n\nb", Position{Y: 1})
+	dbl("a\n\nb", 1, "a\nb", Position{Y: 1})
+	dbl("a\n", 1, "a", Position{X: 1})
+	dbl("a\n\n\t\nb\n", 0, "a\nb\n", Position{})
+	rl := new_rl()
+	rl.add_text("a\nb")
+	if rl.perform_action(ActionDeleteBlankLines, 1) != ErrCouldNotPerformAction {
+		t.Fatalf("Deleting blank lines without any did not fail")
+	}
+	rl.SetText("a\n\n\nb")
+	rl.input_state.cursor = Position{}
+	rl.FeedKeys("ctrl+x ctrl+o")
+	if diff := cmp.Diff("a\nb", rl.all_text()); diff != "" {
+		t.Fatalf("ctrl+x ctrl+o did not delete blank lines:\n%s", diff)
+	}
+}
+
+func TestCommentStart(t *testing.T) {
+	rl := new_rl()
+	rl.balance_check = &BalanceCheck{}
+	rl.comment_start = "#"
+	accept := func(text string, expected_err error, is_comment bool) {
+		t.Helper()
+		rl.ResetText()
+		rl.add_text(text)
+		if rl.InputIsComment() != is_comment {
+			t.Fatalf("InputIsComment() was %v for %#v", !is_comment, text)
+		}
+		if err := rl.perform_action(ActionAcceptInput, 1); err != expected_err {
+			t.Fatalf("Unexpected error accepting %#v: %v", text, err)
+		}
+	}
+	accept("# (", ErrAcceptInput, true)
+	accept("  # [\n#{", ErrAcceptInput, true)
+	accept("echo (", nil, false)
+	accept("# x\necho [", nil, false)
+	// lines starting with # inside quotes are not comments
+	accept("echo \"a\n# b\"", ErrAcceptInput, false)
+	accept("echo \"a\n# b\"\n# (", ErrAcceptInput, false)
+	accept("echo 'a\n# '\n(", nil, false)
+	accept("", ErrAcceptInput, false)
+}
+
+func TestParagraphMovement(t *testing.T) {
+	rl := new_rl()
+	rl.add_text("a\nb\n\n\nc\n\nd")
+	rl.input_state.cursor = Position{X: 1}
+	move := func(ac Action, expected Position) {
+		t.Helper()
+		if err := rl.perform_action(ac, 1); err != nil {
+			t.Fatalf("Moving by paragraph failed: %v", err)
+		}
+		if diff := cmp.Diff(expected, rl.input_state.cursor); diff != "" {
+			t.Fatalf("Cursor not as expected after moving by paragraph:\n%s", diff)
+		}
+	}
+	move(ActionMoveToNextParagraph, Position{Y: 2})
+	move(ActionMoveToNextParagraph, Position{Y: 5})
+	move(ActionMoveToNextParagraph, Position{Y: 6, X: 1})
+	if rl.perform_action(ActionMoveToNextParagraph, 1) != ErrCouldNotPerformAction {
+		t.Fatalf("Moving past the end of the document did not fail")
+	}
+	move(ActionMoveToPreviousParagraph, Position{Y: 5})
+	move(ActionMoveToPreviousParagraph, Position{Y: 3})
+	move(ActionMoveToPreviousParagraph, Position{})
+	rl.perform_action(ActionMoveToNextParagraph, 2)
+	if diff := cmp.Diff(Position{Y: 5}, rl.input_state.cursor); diff != "" {
+		t.Fatalf("Cursor not as expected after moving by two paragraphs:\n%s", diff)
+	}
+
+	rl.input_state.cursor = Position{Y: 4}
+	rl.perform_action(ActionKillPreviousParagraph, 1)
+	if diff := cmp.Diff("a\nb\n\nc\n\nd", rl.all_text()); diff != "" {
+		t.Fatalf("Killing the previous paragraph failed:\n%s", diff)
+	}
+	rl.perform_action(ActionKillNextParagraph, 1)
+	if diff := cmp.Diff("a\nb\n\n\nd", rl.all_text()); diff != "" {
+		t.Fatalf("Killing the next paragraph failed:\n%s", diff)
+	}
+	if diff := cmp.Diff("\nc\n", rl.kill_ring.items.Front().Value.(string)); diff != "" {
+		t.Fatalf("Killed text not as expected:\n%s", diff)
+	}
+}
+
+func TestHistorySearchIgnoreCase(t *testing.T) {
+	rl := new_rl()
+	rl.history.AddItem("git status", 0)
+	rl.history.AddItem("make Install", 0)
+	rl.autosuggestion.enabled = true
+	rl.SetText("GIT")
+	if s := rl.current_autosuggestion(); s != "" {
+		t.Fatalf("Case-sensitive autosuggestion found: %#v", s)
+	}
+	rl.SetHistorySearchIgnoreCase(true)
+	if diff := cmp.Diff(" status", rl.current_autosuggestion()); diff != "" {
+		t.Fatalf("Case-insensitive autosuggestion not as expected:\n%s", diff)
+	}
+	rl.perform_action(ActionHistoryPrevious, 1)
+	if diff := cmp.Diff("git status", rl.all_text()); diff != "" {
+		t.Fatalf("Case-insensitive prefix search not as expected:\n%s", diff)
+	}
+
+	rl.ResetText()
+	rl.perform_action(ActionHistoryIncrementalSearchBackwards, 1)
+	rl.text_to_be_added = "INST"
+	rl.perform_action(ActionAddText, 1)
+	if diff := cmp.Diff("make Install", rl.all_text()); diff != "" {
+		t.Fatalf("Case-insensitive incremental search not as expected:\n%s", diff)
+	}
+	if diff := cmp.Diff(Position{X: 5}, rl.input_state.cursor); diff != "" {
+		t.Fatalf("Cursor not at the match:\n%s", diff)
+	}
+	if diff := cmp.Diff("make "+rl.fmt_ctx.Green("Inst")+"all", rl.history_search_highlighter("make Install", 0, 0)); diff != "" {
+		t.Fatalf("The original text of the match was not highlighted:\n%s", diff)
+	}
+	rl.SetHistorySearchIgnoreCase(false)
+	rl.text_to_be_added = "a"
+	rl.perform_action(ActionAddText, 1)
+	if diff := cmp.Diff("No matches for: INSTa", rl.all_text()); diff != "" {
+		t.Fatalf("Case-sensitive incremental search not as expected:\n%s", diff)
+	}
+}
+
+func TestOnAccept(t *testing.T) {
+	rl := new_rl()
+	var received []string
+	rl.on_accept = func(text, expanded string) (string, bool) {
+		received = append(received, text, expanded)
+		if text == "veto" {
+			return "vetoed", false
+		}
+		return strings.TrimSpace(text), true
+	}
+	rl.add_text(" ls ")
+	if err := rl.perform_action(ActionAcceptInput, 1); err != ErrAcceptInput {
+		t.Fatalf("Accepting input failed: %v", err)
+	}
+	if diff := cmp.Diff([]string{" ls ", " ls "}, received); diff != "" {
+		t.Fatalf("OnAccept not called as expected:\n%s", diff)
+	}
+	if diff := cmp.Diff("ls", rl.all_text()); diff != "" {
+		t.Fatalf("OnAccept did not modify the input:\n%s", diff)
+	}
+	rl.SetText("veto")
+	if err := rl.perform_action(ActionAcceptInput, 1); err != nil {
+		t.Fatalf("Vetoed input was accepted: %v", err)
+	}
+	if diff := cmp.Diff("vetoed", rl.all_text()); diff != "" {
+		t.Fatalf("OnAccept did not modify vetoed input:\n%s", diff)
+	}
+}
+
+func TestIndent(t *testing.T) {
+	rl := new_rl()
+	check := func(expected string, expected_cursor Position) {
+		t.Helper()
+		if diff := cmp.Diff(expected, rl.all_text()); diff != "" {
+			t.Fatalf("Text not as expected after changing indentation:\n%s", diff)
+		}
+		if diff := cmp.Diff(expected_cursor, rl.input_state.cursor); diff != "" {
+			t.Fatalf("Cursor not as expected after changing indentation:\n%s", diff)
+		}
+	}
+	rl.add_text("a\n\nb\nc")
+	rl.input_state.cursor = Position{Y: 2, X: 1}
+	rl.perform_action(ActionIndent, 1)
+	check("a\n\n\tb\nc", Position{Y: 2, X: 2})
+	rl.perform_action(ActionDedent, 1)
+	check("a\n\nb\nc", Position{Y: 2, X: 1})
+	if rl.perform_action(ActionDedent, 1) != ErrCouldNotPerformAction {
+		t.Fatalf("Dedenting an unindented line did not fail")
+	}
+
+	rl.insert_spaces_for_tab, rl.shift_width = true, 2
+	rl.input_state.cursor = Position{}
+	rl.perform_action(ActionSetMark, 1)
+	rl.input_state.cursor = Position{Y: 3}
+	// the region is kept so that indenting can be repeated and the last line
+	// is excluded as the region ends at its start
+	rl.perform_action(ActionIndent, 1)
+	rl.perform_action(ActionIndent, 1)
+	check("    a\n\n    b\nc", Position{Y: 3})
+	rl.perform_action(ActionDedent, 1)
+	check("  a\n\n  b\nc", Position{Y: 3})
+	rl.input_state.lines[0] = "\t   a"
+	rl.perform_action(ActionDedent, 2)
+	check(" a\n\nb\nc", Position{Y: 3})
+}
+
+func TestCompletionTriggerCharacters(t *testing.T) {
+	rl := new_rl()
+	var calls []string
+	rl.completions.completer = func(before_cursor, after_cursor string) *cli.Completions {
+		calls = append(calls, before_cursor)
+		g := &cli.MatchGroup{}
+		g.AddMatch("x.one")
+		g.AddMatch("x.two")
+		return &cli.Completions{Groups: []*cli.MatchGroup{g}}
+	}
+	rl.OnText("x", false, false)
+	if len(calls) != 0 {
+		t.Fatalf("Completion triggered without a trigger character: %#v", calls)
+	}
+	rl.SetCompletionTriggerCharacters("./", 0)
+	rl.OnText("x.", false, false)
+	if diff := cmp.Diff([]string{"xx."}, calls); diff != "" {
+		t.Fatalf("Completion not triggered:\n%s", diff)
+	}
+	if diff := cmp.Diff("xx.", rl.all_text()); diff != "" {
+		t.Fatalf("Triggered completion modified the input:\n%s", diff)
+	}
+	if lines, _ := rl.completion_screen_lines(); len(lines) == 0 {
+		t.Fatalf("Triggered completion candidates not displayed")
+	}
+	rl.OnText("y", false, false)
+	if rl.completions.current.results != nil {
+		t.Fatalf("Typing did not dismiss the triggered completion candidates")
+	}
+	// pasted text does not trigger completion
+	rl.OnText("/", false, true)
+	rl.OnText("", false, false)
+	if len(calls) != 1 {
+		t.Fatalf("Pasted text triggered completion: %#v", calls)
+	}
+	// a delayed trigger only completes if the input is unchanged
+	rl.completions.trigger_before_cursor, rl.completions.trigger_after_cursor = "xx.y/", ""
+	rl.on_completion_trigger_timer(0)
+	if len(calls) != 2 {
+		t.Fatalf("Delayed completion not triggered: %#v", calls)
+	}
+	rl.completions.trigger_before_cursor = "xx."
+	rl.on_completion_trigger_timer(0)
+	if len(calls) != 2 {
+		t.Fatalf("Delayed completion triggered after the input changed: %#v", calls)
+	}
+
+	var requests []uint64
+	rl.completions.async_completer = func(before_cursor, after_cursor string, generation uint64) {
+		requests = append(requests, generation)
+	}
+	rl.SetText("a")
+	rl.OnText("/", false, false)
+	g := &cli.MatchGroup{}
+	g.AddMatch("a/b")
+	if len(requests) != 1 || !rl.set_completions(requests[0], &cli.Completions{Groups: []*cli.MatchGroup{g}}) {
+		t.Fatalf("Async completion not triggered: %#v", requests)
+	}
+	if diff := cmp.Diff("a/", rl.all_text()); diff != "" {
+		t.Fatalf("Triggered async completion modified the input:\n%s", diff)
+	}
+}
+
+func TestQueryReplace(t *testing.T) {
+	rl := new_rl()
+	type_text := func(text string) {
+		for _, ch := range text {
+			rl.OnText(string(ch), false, false)
+		}
+	}
+	start := func(text, from, to string) {
+		t.Helper()
+		rl.SetText(text)
+		rl.input_state.cursor = Position{}
+		rl.perform_action(ActionQueryReplace, 1)
+		type_text(from)
+		rl.FeedKeys("enter")
+		type_text(to)
+		rl.FeedKeys("enter")
+	}
+	check := func(expected string) {
+		t.Helper()
+		if diff := cmp.Diff(expected, rl.all_text()); diff != "" {
+			t.Fatalf("Text not as expected after query replace:\n%s", diff)
+		}
+	}
+	start("a.b a.c\na.d", "ax", "")
+	if rl.query_replace != nil || rl.query != nil {
+		t.Fatalf("Query replace without matches did not end")
+	}
+
+	start("a.b a.c\na.d", "a.", "x::")
+	if diff := cmp.Diff(`Replace a. with x::? (y, n, !, ., q)`, rl.query_message()); diff != "" {
+		t.Fatalf("Query replace prompt not as expected:\n%s", diff)
+	}
+	if diff := cmp.Diff(rl.fmt_ctx.Yellow("a.")+"b a.c\na.d", rl.query_replace_highlighter(rl.all_text(), 0, 0)); diff != "" {
+		t.Fatalf("Current match not highlighted:\n%s", diff)
+	}
+	type_text("yz")
+	check("x::b a.c\na.d")
+	if diff := cmp.Diff(Position{X: 5}, rl.input_state.cursor); diff != "" {
+		t.Fatalf("Cursor not at the next match:\n%s", diff)
+	}
+	type_text("n!")
+	check("x::b a.c\nx::d")
+	if rl.query_replace != nil || rl.query != nil {
+		t.Fatalf("Query replace did not end after replacing all")
+	}
+
+	start("aaa", "a", "b")
+	type_text(".")
+	check("baa")
+	start("aaa", "a", "b")
+	type_text("nq")
+	check("aaa")
+	// backspace edits the search string and escape cancels
+	rl.SetText("ab")
+	rl.perform_action(ActionQueryReplace, 1)
+	type_text("bx")
+	rl.FeedKeys("backspace", "enter")
+	if diff := cmp.Diff(`Query replace b with: `, rl.query_message()); diff != "" {
+		t.Fatalf("Query replace prompt not as expected:\n%s", diff)
+	}
+	rl.FeedKeys("escape")
+	if rl.query_replace != nil || rl.query != nil {
+		t.Fatalf("Query replace not cancelled")
+	}
+}
+
+func TestRTLCursorMovement(t *testing.T) {
+	rl := new_rl()
+	// Hebrew with vowel points, a right-to-left mark and Latin text
+	rl.add_text("‏שָׁלוֹם ab")
+	var xs []int
+	for rl.move_cursor_left(1, false) > 0 {
+		xs = append(xs, rl.input_state.cursor.X)
+	}
+	if diff := cmp.Diff([]int{19, 18, 17, 15, 11, 9, 0}, xs); diff != "" {
+		t.Fatalf("Moving left over mixed direction text stopped at the wrong places:\n%s", diff)
+	}
+	xs = nil
+	for rl.move_cursor_right(1, false) > 0 {
+		xs = append(xs, rl.input_state.cursor.X)
+	}
+	if diff := cmp.Diff([]int{9, 11, 15, 17, 18, 19, 20}, xs); diff != "" {
+		t.Fatalf("Moving right over mixed direction text stopped at the wrong places:\n%s", diff)
+	}
+	rl.SetText("‎")
+	rl.input_state.cursor.X = 0
+	if rl.move_cursor_right(1, false) != 1 || rl.input_state.cursor.X != 3 {
+		t.Fatalf("Could not move over a line of only a zero width character")
+	}
+}
+
+func TestMoveToFirstNonBlank(t *testing.T) {
+	dt := test_func(t)
+	move := func(x int) func(*Readline) {
+		return func(rl *Readline) {
+			rl.input_state.cursor.X = x
+			rl.perform_action(ActionMoveToFirstNonBlank, 1)
+		}
+	}
+	dt("  \tab c", move(6), "  \t", "ab c")
+	dt("  \tab c", move(0), "  \t", "ab c")
+	dt("ab", move(2), "", "ab")
+	dt("   ", move(0), "   ", "")
+	dt("a\n  b", func(rl *Readline) {
+		rl.input_state.cursor = Position{Y: 1}
+		rl.perform_action(ActionMoveToFirstNonBlank, 1)
+	}, "a\n  ", "b")
+}
+
+func TestTrimAcceptedText(t *testing.T) {
+	rl := new_rl()
+	rl.add_text("  ls -l \n")
+	for policy, expected := range map[TrimPolicy]string{
+		TrimNone: "  ls -l \n", TrimBoth: "ls -l", TrimLeading: "ls -l \n", TrimTrailing: "  ls -l",
+	} {
+		rl.trim_accepted_text = policy
+		if diff := cmp.Diff(expected, rl.AcceptedText()); diff != "" {
+			t.Fatalf("Accepted text not as expected for policy %d:\n%s", policy, diff)
+		}
+	}
+	if diff := cmp.Diff("  ls -l \n", rl.AllText()); diff != "" {
+		t.Fatalf("Trimming modified the input:\n%s", diff)
+	}
+	var expanded string
+	rl.on_accept = func(text, e string) (string, bool) {
+		expanded = e
+		return text, true
+	}
+	rl.trim_accepted_text = TrimBoth
+	rl.perform_action(ActionAcceptInput, 1)
+	if diff := cmp.Diff("ls -l", expanded); diff != "" {
+		t.Fatalf("OnAccept not called with the trimmed text:\n%s", diff)
+	}
+}
+
+func TestInsertCodePoint(t *testing.T) {
+	for text, expected := range map[string]rune{"e9": 'é', "U+1F600": '😀', " 0x41 ": 'A', "d800": 0, "110000": 0, "xyz": 0, "": 0, "0": 0, "1b": 0, "7f": 0, "9b": 0, "a0": '\u00a0'} {
+		ch, ok := parse_code_point(text)
+		if ok != (expected != 0) || ch != expected {
+			t.Fatalf("Parsing the code point %#v gave: %#v %v", text, ch, ok)
+		}
+	}
+	rl := new_rl()
+	rl.add_text("a")
+	rl.FeedKeys("ctrl+v", "u")
+	for _, ch := range "3b1" {
+		rl.OnText(string(ch), false, false)
+	}
+	rl.FeedKeys("enter")
+	if diff := cmp.Diff("aα", rl.all_text()); diff != "" {
+		t.Fatalf("Inserting a code point failed:\n%s", diff)
+	}
+	rl.FeedKeys("ctrl+x 8 enter")
+	for _, ch := range "1b" {
+		rl.OnText(string(ch), false, false)
+	}
+	rl.FeedKeys("enter")
+	if diff := cmp.Diff("aα", rl.all_text()); diff != "" {
+		t.Fatalf("Inserting a control character did not fail:\n%s", diff)
+	}
+	rl.FeedKeys("ctrl+x 8 enter")
+	for _, ch := range "e9" {
+		rl.OnText(string(ch), false, false)
+	}
+	rl.FeedKeys("enter")
+	if diff := cmp.Diff("aαé", rl.all_text()); diff != "" {
+		t.Fatalf("Inserting a code point with ctrl+x 8 enter failed:\n%s", diff)
+	}
+}
+
+// Wait for the command running in the background, if any, and deliver its
+// output as the loop would
+func wait_for_command(rl *Readline) {
+	if rc := rl.running_command; rc != nil {
+		<-rc.done
+		rl.finish_running_command(rc)
+	}
+}
+
+func TestInsertCommandOutput(t *testing.T) {
+	rl := new_rl()
+	start := func(command string) {
+		rl.FeedKeys("ctrl+v", "!")
+		for _, ch := range command {
+			rl.OnText(string(ch), false, false)
+		}
+		rl.FeedKeys("enter")
+	}
+	run := func(command string) {
+		start(command)
+		wait_for_command(rl)
+	}
+	run("echo hi")
+	if rl.all_text() != "hi" || !rl.IsModified() {
+		t.Fatalf("Inserting command output did not mark the input as modified: %#v", rl.all_text())
+	}
+	rl.ResetText()
+	rl.add_text("a ")
+	run("echo hi")
+	if diff := cmp.Diff("a hi", rl.all_text()); diff != "" {
+		t.Fatalf("Inserting command output failed:\n%s", diff)
+	}
+	run("echo oops >&2; exit 3")
+	if diff := cmp.Diff("a hi", rl.all_text()); diff != "" {
+		t.Fatalf("Failed command changed the text:\n%s", diff)
+	}
+	if diff := cmp.Diff("Command failed: oops", rl.message); diff != "" {
+		t.Fatalf("Failure message not as expected:\n%s", diff)
+	}
+	rl.FeedKeys("ctrl+a")
+	if rl.message != "" {
+		t.Fatalf("Message not cleared by the next action: %#v", rl.message)
+	}
+	rl.keep_output_newline = true
+	run("printf x")
+	run("echo y")
+	if diff := cmp.Diff("xy\na hi", rl.all_text()); diff != "" {
+		t.Fatalf("Inserting command output with newline failed:\n%s", diff)
+	}
+	start("sleep 10; echo z")
+	rc := rl.running_command
+	if rc == nil || !strings.Contains(rl.spinner_message(), "Running: sleep 10") {
+		t.Fatalf("Command not running in the background with a spinner: %#v", rl.spinner_message())
+	}
+	rl.FeedKeys("a")
+	rl.OnText("b", false, false)
+	// give the shell time to start sleep, which must be killed as well
+	time.Sleep(100 * time.Millisecond)
+	rl.FeedKeys("ctrl+c")
+	if rl.running_command != nil || rl.spinner_message() != "" || rl.message != "Command cancelled" {
+		t.Fatalf("Running command not cancelled: %#v", rl.message)
+	}
+	select {
+	case <-rc.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Cancelled command not killed")
+	}
+	rl.finish_running_command(rc)
+	if diff := cmp.Diff("xy\na hi", rl.all_text()); diff != "" {
+		t.Fatalf("Text changed while the command was running or after it was cancelled:\n%s", diff)
+	}
+}
+
+func TestProtectedPrefix(t *testing.T) {
+	rl := New(nil, RlInit{Prompt: "$ ", ProtectedPrefix: "> "})
+	ah := func(expected string, cursor int) {
+		t.Helper()
+		if diff := cmp.Diff(expected, rl.all_text()); diff != "" {
+			t.Fatalf("Text not as expected:\n%s", diff)
+		}
+		if c := position_to_offset(rl.input_state.lines, rl.input_state.cursor); c != cursor {
+			t.Fatalf("Cursor at %d not %d for: %#v", c, cursor, expected)
+		}
+	}
+	ah("> ", 2)
+	rl.add_text("ab")
+	rl.FeedKeys("home")
+	ah("> ab", 2)
+	if err := rl.perform_action(ActionBackspace, 1); err != ErrCouldNotPerformAction {
+		t.Fatalf("Backspace into the protected prefix did not fail: %v", err)
+	}
+	if err := rl.perform_action(ActionCursorLeft, 1); err != ErrCouldNotPerformAction {
+		t.Fatalf("Moving into the protected prefix did not fail: %v", err)
+	}
+	rl.add_text("x")
+	ah("> xab", 3)
+	rl.FeedKeys("end", "ctrl+u")
+	ah("> ", 2)
+	rl.add_text("one\ntwo")
+	rl.FeedKeys("ctrl+home", "ctrl+k")
+	ah("> \ntwo", 2)
+	rl.FeedKeys("down", "home", "up")
+	ah("> \ntwo", 2)
+	rl.SetText("> three")
+	ah("> three", 7)
+	rl.SetProtectedPrefix("$$ ")
+	ah("$$ three", 8)
+	rl.ResetText()
+	ah("$$ ", 3)
+	rl.SetProtectedPrefix("a\r\nb ")
+	ah("ab ", 3)
+	rl = New(nil, RlInit{ProtectedPrefix: "x\ny "})
+	ah("xy ", 3)
+}
+
+func TestReplaceRange(t *testing.T) {
+	rl := new_rl()
+	ah := func(start, end int, replacement, expected string, cursor int) {
+		t.Helper()
+		if !rl.ReplaceRange(start, end, replacement) {
+			t.Fatalf("Replacing %d:%d with %#v failed", start, end, replacement)
+		}
+		if diff := cmp.Diff(expected, rl.AllText()); diff != "" {
+			t.Fatalf("Text not as expected:\n%s", diff)
+		}
+		if c := rl.CursorByteOffset(); c != cursor {
+			t.Fatalf("Cursor at %d not %d for: %#v", c, cursor, expected)
+		}
+	}
+	rl.add_text("one two\nthree")
+	ah(4, 7, "2", "one 2\nthree", 11)
+	ah(0, 3, "1\n", "1\n 2\nthree", 10)
+	rl.input_state.cursor = Position{Y: 2, X: 2}
+	ah(3, 10, "x", "1\n x", 4)
+	ah(4, 4, "yz", "1\n xyz", 6)
+	rl.SetText("aé")
+	for _, r := range [][2]int{{2, 3}, {0, 4}, {2, 1}, {-1, 1}} {
+		if rl.ReplaceRange(r[0], r[1], "") {
+			t.Fatalf("Replacing the invalid range %v succeeded", r)
+		}
+	}
+}
+
+func TestCycleQuotes(t *testing.T) {
+	rl := new_rl()
+	ah := func(expected string, cursor int) {
+		t.Helper()
+		if err := rl.perform_action(ActionCycleQuotes, 1); err != nil {
+			t.Fatalf("Cycling quotes failed for: %#v", rl.all_text())
+		}
+		if diff := cmp.Diff(expected, rl.all_text()); diff != "" {
+			t.Fatalf("Text not as expected:\n%s", diff)
+		}
+		if rl.input_state.cursor.X != cursor {
+			t.Fatalf("Cursor at %d not %d for: %#v", rl.input_state.cursor.X, cursor, expected)
+		}
+	}
+	rl.add_text(`x 'a "b" \'c' y`)
+	rl.input_state.cursor.X = 9
+	ah(`x "a \"b\" 'c" y`, 11)
+	ah("x `a \"b\" 'c` y", 9)
+	ah(`x 'a "b" \'c' y`, 9)
+	rl.input_state.cursor.X = 1
+	if err := rl.perform_action(ActionCycleQuotes, 1); err != ErrCouldNotPerformAction {
+		t.Fatalf("Cycling quotes outside a string did not fail: %v", err)
+	}
+}
+
+func TestMultiRowPrompt(t *testing.T) {
+	lp, _ := loop.New()
+	rl := New(lp, RlInit{Prompt: "\x1b[32mtop row\x1b[m\n$ ", DontMarkPrompts: true})
+	rl.screen_width, rl.screen_height = 5, 100
+	if rl.prompt.Length != 2 || len(rl.prompt.Banner) != 1 || rl.prompt.Banner[0].Length != 7 {
+		t.Fatalf("Multi-row prompt not split as expected: %#v", rl.prompt)
+	}
+	rl.add_text("ab")
+	if sl := rl.get_screen_lines(); len(sl) != 1 || sl[0].CursorCell != 4 {
+		t.Fatalf("Cursor not placed after the last row of the prompt: %#v", sl)
+	}
+	rl.redraw()
+	// the banner row wraps onto two screen rows
+	if rl.cursor_y != 2 {
+		t.Fatalf("Cursor not below the banner: %d", rl.cursor_y)
+	}
+	rl.add_text("\nc")
+	rl.redraw()
+	if rl.cursor_y != 3 {
+		t.Fatalf("Cursor not on the second line of input: %d", rl.cursor_y)
+	}
+	rl.input_state.cursor = Position{}
+	rl.keyboard_state.current_numeric_argument = "2"
+	if p := rl.prompt_for_line_number(0); len(p.Banner) != 1 || !strings.Contains(p.Text, "arg") {
+		t.Fatalf("Banner lost when the prompt was replaced: %#v", p)
+	}
+}
+
+func TestTruncateAtCursor(t *testing.T) {
+	rl := new_rl()
+	rl.add_text("one two\nthree\nfour")
+	rl.input_state.cursor = Position{X: 4}
+	if err := rl.perform_action(ActionTruncateAtCursor, 1); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("one ", rl.all_text()); diff != "" {
+		t.Fatalf("Text not as expected:\n%s", diff)
+	}
+	if rl.input_state.cursor != (Position{X: 4}) {
+		t.Fatalf("Cursor moved: %+v", rl.input_state.cursor)
+	}
+	if diff := cmp.Diff("two\nthree\nfour", rl.kill_ring.yank()); diff != "" {
+		t.Fatalf("Kill ring not as expected:\n%s", diff)
+	}
+	if err := rl.perform_action(ActionTruncateAtCursor, 1); err != ErrCouldNotPerformAction {
+		t.Fatalf("Truncating at the end did not fail: %v", err)
+	}
+}
+
+func TestPlaceholder(t *testing.T) {
+	rl := New(nil, RlInit{Prompt: "$ ", Placeholder: "Type a command\nmore"})
+	if diff := cmp.Diff("Type a command", rl.current_placeholder()); diff != "" {
+		t.Fatalf("Placeholder not as expected:\n%s", diff)
+	}
+	if rl.AllText() != "" {
+		t.Fatalf("Placeholder is part of the input: %#v", rl.AllText())
+	}
+	rl.OnText("a", true, false)
+	rl.FeedKeys("backspace")
+	if p := rl.current_placeholder(); p != "" {
+		t.Fatalf("Placeholder shown after editing: %#v", p)
+	}
+	rl.ResetText()
+	if p := rl.current_placeholder(); p == "" {
+		t.Fatalf("Placeholder not shown after resetting the text")
+	}
+	rl.SetText("x")
+	if p := rl.current_placeholder(); p != "" {
+		t.Fatalf("Placeholder shown with text: %#v", p)
+	}
+}
+
+func TestDeleteIndentation(t *testing.T) {
+	rl := new_rl()
+	rl.add_text("\t  one\n    two\nthree")
+	rl.input_state.cursor = Position{X: 1}
+	if err := rl.perform_action(ActionDeleteIndentation, 1); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("one\n    two\nthree", rl.all_text()); diff != "" {
+		t.Fatalf("Text not as expected:\n%s", diff)
+	}
+	if rl.input_state.cursor != (Position{}) {
+		t.Fatalf("Cursor not on the first character: %+v", rl.input_state.cursor)
+	}
+	rl.set_mark()
+	rl.input_state.cursor = Position{X: 5, Y: 1}
+	if err := rl.perform_action(ActionDeleteIndentation, 1); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("one\ntwo\nthree", rl.all_text()); diff != "" {
+		t.Fatalf("Text not as expected:\n%s", diff)
+	}
+	if rl.input_state.cursor != (Position{X: 1, Y: 1}) {
+		t.Fatalf("Cursor not moved with the text: %+v", rl.input_state.cursor)
+	}
+	if err := rl.perform_action(ActionDeleteIndentation, 1); err != ErrCouldNotPerformAction {
+		t.Fatalf("Deleting missing indentation did not fail: %v", err)
+	}
+}
+
+func TestCompletionWordBreaks(t *testing.T) {
+	rl := new_rl()
+	for text, expected := range map[string]int{"": 0, "ls --opt=val": 9, "a b-c": 2, "x\\ y": 0, "a\nb:c": 4, "é:ü": 3} {
+		if actual := rl.CompletionWordStart(text); actual != expected {
+			t.Fatalf("Start of completion word in %#v was %d not %d", text, actual, expected)
+		}
+	}
+	rl = New(nil, RlInit{CompletionWordBreaks: " ,"})
+	if actual := rl.CompletionWordStart("a=b,c"); actual != 4 {
+		t.Fatalf("Custom word breaks not used: %d", actual)
+	}
+}
+
+func TestActionMiddleware(t *testing.T) {
+	rl := new_rl()
+	var seen []Action
+	vetoed := 0
+	rl.AddActionMiddleware(ActionMiddleware{
+		Before: func(ac Action, repeat_count uint) bool {
+			if ac == ActionHistoryPreviousOrCursorUp {
+				vetoed++
+				return false
+			}
+			return true
+		},
+		After: func(ac Action, repeat_count uint, err error) {
+			if err == nil {
+				seen = append(seen, ac)
+			}
+		},
+	})
+	rl.AddHistoryItem(HistoryItem{Cmd: "old"})
+	rl.OnText("ab", true, false)
+	rl.FeedKeys("up", "left")
+	if vetoed != 1 {
+		t.Fatalf("Action not vetoed")
+	}
+	if diff := cmp.Diff("ab", rl.AllText()); diff != "" {
+		t.Fatalf("Text not as expected:\n%s", diff)
+	}
+	if diff := cmp.Diff([]Action{ActionAddText, ActionCursorLeft}, seen); diff != "" {
+		t.Fatalf("Observed actions not as expected:\n%s", diff)
+	}
+}
+
+func TestRepeatLastChange(t *testing.T) {
+	rl := new_rl()
+	ah := func(expected string) {
+		t.Helper()
+		if diff := cmp.Diff(expected, rl.all_text()); diff != "" {
+			t.Fatalf("Text not as expected:\n%s", diff)
+		}
+	}
+	if err := rl.perform_action(ActionRepeatLastChange, 1); err != ErrCouldNotPerformAction {
+		t.Fatalf("Repeating with no change did not fail: %v", err)
+	}
+	rl.FeedKeys("a b c", "left")
+	rl.perform_action(ActionRepeatLastChange, 1)
+	ah("ababcc")
+	rl.FeedKeys("ctrl+e", "alt+2", "backspace", "home")
+	ah("abab")
+	rl.perform_action(ActionRepeatLastChange, 1)
+	ah("abab")
+	rl.FeedKeys("end")
+	rl.perform_action(ActionRepeatLastChange, 1)
+	ah("ab")
+	rl.FeedKeys("x")
+	rl.perform_action(ActionRepeatLastChange, 3)
+	ah("abxxxx")
+}
+
+func TestOutputMirror(t *testing.T) {
+	lp, _ := loop.New()
+	buf := strings.Builder{}
+	rl := New(lp, RlInit{Prompt: "$ ", DontMarkPrompts: true, OutputMirror: &buf})
+	rl.screen_width, rl.screen_height = 20, 10
+	rl.OnText("hello", false, false)
+	rl.Redraw()
+	out := buf.String()
+	if !strings.Contains(out, "$ hello") || !strings.HasPrefix(out, loop.PENDING_UPDATE.EscapeCodeToSet()) || !strings.HasSuffix(out, loop.PENDING_UPDATE.EscapeCodeToReset()) {
+		t.Fatalf("Redraw not mirrored: %#v", out)
+	}
+	buf.Reset()
+	lp.QueueWriteString("not from readline")
+	if buf.Len() != 0 {
+		t.Fatalf("Output not written by readline was mirrored: %#v", buf.String())
+	}
+	rl.End()
+	if !strings.Contains(buf.String(), "\r\n") {
+		t.Fatalf("End() not mirrored: %#v", buf.String())
+	}
+}
+
+func TestKillToClipboard(t *testing.T) {
+	lp, _ := loop.New()
+	buf := strings.Builder{}
+	rl := New(lp, RlInit{Prompt: "$ ", DontMarkPrompts: true, OutputMirror: &buf, KillToClipboard: true})
+	rl.add_text("one two three")
+	rl.input_state.cursor.X = 0
+	rl.perform_action(ActionKillNextWord, 1)
+	rl.perform_action(ActionKillNextWord, 1)
+	if !strings.HasSuffix(buf.String(), clipboard_escape_code(rl.kill_ring.yank())) || rl.kill_ring.yank() != "one two" {
+		t.Fatalf("Coalesced kill %#v not copied to the clipboard: %#v", rl.kill_ring.yank(), buf.String())
+	}
+	buf.Reset()
+	rl.perform_action(ActionCursorRight, 1)
+	rl.perform_action(ActionKillToEndOfLine, 1)
+	if diff := cmp.Diff(clipboard_escape_code("three"), buf.String()); diff != "" {
+		t.Fatalf("New kill not copied to the clipboard:\n%s", diff)
+	}
+	buf.Reset()
+	rl = New(lp, RlInit{Prompt: "$ ", DontMarkPrompts: true, OutputMirror: &buf})
+	rl.add_text("one")
+	rl.perform_action(ActionKillToStartOfLine, 1)
+	if buf.Len() != 0 {
+		t.Fatalf("Kill copied to the clipboard by default: %#v", buf.String())
+	}
+}
+
+func TestExpandAbbreviation(t *testing.T) {
+	lp, _ := loop.New()
+	rl := New(lp, RlInit{Prompt: "$ ", Abbreviations: map[string]string{"gco": "git checkout", "ml": "a\nb"}})
+	rl.add_text("echo 'gco")
+	if err := rl.perform_action(ActionExpandAbbreviation, 1); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("echo 'git checkout", rl.all_text()); diff != "" {
+		t.Fatalf("Abbreviation not expanded:\n%s", diff)
+	}
+	if rl.perform_action(ActionExpandAbbreviation, 1) != ErrCouldNotPerformAction {
+		t.Fatalf("Expanding a word that is not an abbreviation did not fail")
+	}
+	rl.SetAbbreviation("gco", "")
+	rl.ResetText()
+	rl.add_text("gco x")
+	rl.input_state.cursor.X = 3
+	if rl.perform_action(ActionExpandAbbreviation, 1) != ErrCouldNotPerformAction {
+		t.Fatalf("Expanding a removed abbreviation did not fail")
+	}
+	rl.input_state.cursor.X = 5
+	rl.add_text(" ml")
+	rl.input_state.cursor.X = 5
+	rl.SetAbbreviation("x", "xyz")
+	if err := rl.perform_action(ActionExpandAbbreviation, 1); err != nil || rl.all_text() != "gco xyz ml" || rl.input_state.cursor.X != 7 {
+		t.Fatalf("Abbreviation in the middle of the line not expanded: %#v %+v %v", rl.all_text(), rl.input_state.cursor, err)
+	}
+	rl.input_state.cursor.X = len(rl.input_state.lines[0])
+	rl.perform_action(ActionExpandAbbreviation, 1)
+	if diff := cmp.Diff([]string{"gco xyz a", "b"}, rl.input_state.lines); diff != "" {
+		t.Fatalf("Multi-line abbreviation not expanded:\n%s", diff)
+	}
+}
+
+func TestMoveCursorToScreenCell(t *testing.T) {
+	rl := new_rl()
+	rl.add_text("a\t界b\nabcdefghijk")
+	ah := func(row, col int, expected Position) {
+		t.Helper()
+		if !rl.MoveCursorToScreenCell(row, col) {
+			t.Fatalf("Moving to %d, %d failed", row, col)
+		}
+		if rl.input_state.cursor != expected {
+			t.Fatalf("Cursor at %+v not %+v after moving to %d, %d", rl.input_state.cursor, expected, row, col)
+		}
+	}
+	// the tab expands to 7 spaces and the prompt is three cells wide
+	ah(0, 0, Position{})
+	ah(0, 4, Position{X: 1})
+	ah(0, 9, Position{X: 1})
+	ah(0, 10, Position{X: 1})
+	ah(1, 0, Position{X: 1})
+	ah(1, 1, Position{X: 2})
+	ah(1, 2, Position{X: 2})
+	ah(1, 3, Position{X: 5})
+	ah(1, 9, Position{X: 6})
+	ah(2, 5, Position{X: 3, Y: 1})
+	ah(3, 1, Position{X: 9, Y: 1})
+	if rl.MoveCursorToScreenCell(5, 0) {
+		t.Fatalf("Moving to a row after the input succeeded")
+	}
+}
+
+func TestMouseSelection(t *testing.T) {
+	rl := new_rl()
+	rl.add_text("one two\nthree")
+	selected := func() string {
+		start, end, ok := rl.active_region()
+		if !ok {
+			return ""
+		}
+		text := rl.all_text()
+		return text[position_to_offset(rl.input_state.lines, start):position_to_offset(rl.input_state.lines, end)]
+	}
+	// the prompt is three cells wide and the continuation prompt two
+	rl.MousePress(0, 4, 1)
+	rl.MouseDrag(1, 3)
+	rl.MouseRelease(1, 4)
+	if diff := cmp.Diff("ne two\nth", selected()); diff != "" {
+		t.Fatalf("Selection not as expected:\n%s", diff)
+	}
+	lines, _ := rl.apply_syntax_highlighting()
+	if diff := cmp.Diff([]string{"o" + rl.fmt_ctx.Reverse("ne two"), rl.fmt_ctx.Reverse("th") + "ree"}, lines); diff != "" {
+		t.Fatalf("Selection not highlighted:\n%s", diff)
+	}
+	rl.syntax_highlighted.highlighter = func(text string, x, y int) string {
+		return strings.ReplaceAll(text, "e", "\x1b[31me\x1b[m")
+	}
+	lines, _ = rl.apply_syntax_highlighting()
+	if diff := cmp.Diff([]string{"o" + rl.fmt_ctx.Reverse("n\x1b[31m\x1b[7me\x1b[m\x1b[7m two"), rl.fmt_ctx.Reverse("th") + "r\x1b[31me\x1b[m\x1b[31me\x1b[m"}, lines); diff != "" {
+		t.Fatalf("Selection not highlighted on top of syntax highlighting:\n%s", diff)
+	}
+	rl.syntax_highlighted.highlighter = nil
+	rl.perform_action(ActionKillRegion, 1)
+	if diff := cmp.Diff("oree", rl.all_text()); diff != "" {
+		t.Fatalf("Killing the selection failed:\n%s", diff)
+	}
+	if err := rl.perform_action(ActionKillRegion, 1); err != ErrCouldNotPerformAction {
+		t.Fatalf("Killing with no selection did not fail: %v", err)
+	}
+	rl.SetText("one two\nthree")
+	rl.MousePress(0, 9, 2)
+	rl.MouseRelease(0, 9)
+	if diff := cmp.Diff("two", selected()); diff != "" {
+		t.Fatalf("Word selection not as expected:\n%s", diff)
+	}
+	rl.MousePress(1, 3, 3)
+	rl.MouseRelease(1, 3)
+	if diff := cmp.Diff("three", selected()); diff != "" {
+		t.Fatalf("Line selection not as expected:\n%s", diff)
+	}
+	rl.MousePress(1, 3, 1)
+	rl.MouseRelease(1, 3)
+	if _, _, ok := rl.active_region(); ok || rl.input_state.cursor != (Position{X: 1, Y: 1}) {
+		t.Fatalf("Click did not just move the cursor: %+v", rl.input_state.cursor)
+	}
+	if rl.MouseDrag(0, 0) {
+		t.Fatalf("Drag without a press succeeded")
+	}
+}
+
+func TestKeyBindings(t *testing.T) {
+	rl := new_rl()
+	b := rl.KeyBindings()
+	if diff := cmp.Diff([]string{"ctrl+u"}, b[ActionKillToStartOfLine]); diff != "" {
+		t.Fatalf("Default bindings not as expected:\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"ctrl+v tab"}, b[ActionInsertTab]); diff != "" {
+		t.Fatalf("Multi-key binding not as expected:\n%s", diff)
+	}
+	if err := rl.LoadKeymap(map[string]string{"ctrl+x ctrl+t": "TransposeLines", "ctrl+u": "Nil"}); err != nil {
+		t.Fatal(err)
+	}
+	b = rl.KeyBindings()
+	if _, found := b[ActionKillToStartOfLine]; found {
+		t.Fatalf("Removed bindings still present: %#v", b[ActionKillToStartOfLine])
+	}
+	if _, found := b[ActionNil]; found {
+		t.Fatalf("Nil action has bindings")
+	}
+	if diff := cmp.Diff([]string{"ctrl+x ctrl+t"}, b[ActionTransposeLines]); diff != "" {
+		t.Fatalf("Custom binding not as expected:\n%s", diff)
+	}
+}
+
+func TestOpenLine(t *testing.T) {
+	rl := new_rl()
+	rl.add_text("one\ntwo")
+	rl.input_state.cursor = Position{X: 1}
+	rl.perform_action(ActionOpenLineBelow, 1)
+	if diff := cmp.Diff([]string{"one", "", "two"}, rl.input_state.lines); diff != "" || rl.input_state.cursor != (Position{Y: 1}) {
+		t.Fatalf("Line not opened below, cursor: %+v\n%s", rl.input_state.cursor, diff)
+	}
+	rl.input_state.cursor = Position{X: 2, Y: 2}
+	rl.perform_action(ActionOpenLineAbove, 2)
+	if diff := cmp.Diff([]string{"one", "", "", "", "two"}, rl.input_state.lines); diff != "" || rl.input_state.cursor != (Position{Y: 3}) {
+		t.Fatalf("Lines not opened above, cursor: %+v\n%s", rl.input_state.cursor, diff)
+	}
+	rl.SetProtectedPrefix("$$ ")
+	rl.SetText("$$ one")
+	rl.perform_action(ActionOpenLineAbove, 1)
+	if diff := cmp.Diff([]string{"$$ ", "one"}, rl.input_state.lines); diff != "" || rl.input_state.cursor != (Position{X: 3}) {
+		t.Fatalf("Line not opened above the first line after the protected prefix, cursor: %+v\n%s", rl.input_state.cursor, diff)
+	}
+}
+
+func TestHistoryMetadata(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+	os.WriteFile(path, []byte(`[{"cmd":"old","timestamp":"2023-01-01T00:00:00Z","exit_code":0}]`), 0o600)
+	lp, _ := loop.New()
+	rl := New(lp, RlInit{HistoryPath: path})
+	rl.AddHistoryItem(HistoryItem{Cmd: "new", Cwd: "/tmp", Timestamp: time.Now(), Metadata: map[string]string{"session": "1"}})
+	rl.Shutdown()
+	rl = New(lp, RlInit{HistoryPath: path})
+	items := rl.HistoryItems(nil)
+	if len(items) != 2 || items[0].Metadata != nil {
+		t.Fatalf("History without metadata not read: %#v", items)
+	}
+	items = rl.HistoryItems(func(hi *HistoryItem) bool { return hi.Metadata["session"] == "1" })
+	if len(items) != 1 || items[0].Cmd != "new" || items[0].Cwd != "/tmp" {
+		t.Fatalf("History metadata not persisted: %#v", items)
+	}
+}
+
+func TestFilterThroughCommand(t *testing.T) {
+	rl := new_rl()
+	start := func(command string) {
+		rl.FeedKeys("ctrl+v", "|")
+		for _, ch := range command {
+			rl.OnText(string(ch), false, false)
+		}
+		rl.FeedKeys("enter")
+	}
+	run := func(command string) {
+		start(command)
+		wait_for_command(rl)
+	}
+	rl.add_text("b\na\nc")
+	rl.seeded_text, rl.modified = rl.all_text(), false
+	run("sort")
+	if diff := cmp.Diff("a\nb\nc", rl.all_text()); diff != "" {
+		t.Fatalf("Filtering the text failed:\n%s", diff)
+	}
+	if !rl.IsModified() {
+		t.Fatalf("Filtering the text did not mark the input as modified")
+	}
+	run("cat; exit 1")
+	if diff := cmp.Diff("a\nb\nc", rl.all_text()); diff != "" || !strings.HasPrefix(rl.message, "Command failed:") {
+		t.Fatalf("Failed filter changed the text or showed no message: %#v\n%s", rl.message, diff)
+	}
+	rl.input_state.cursor = Position{X: 0, Y: 1}
+	rl.perform_action(ActionSetMark, 1)
+	rl.input_state.cursor = Position{X: 1, Y: 2}
+	run("tr a-z A-Z")
+	if diff := cmp.Diff("a\nB\nC", rl.all_text()); diff != "" {
+		t.Fatalf("Filtering the region failed:\n%s", diff)
+	}
+	rl.ResetText()
+	rl.add_text("x")
+	run("printf '\\033[31mred'")
+	if diff := cmp.Diff("red", rl.all_text()); diff != "" {
+		t.Fatalf("Filter output not sanitized:\n%s", diff)
+	}
+	rl.ResetText()
+	rl.add_text("a\nB\nC")
+	start("sleep 10; echo x")
+	rc := rl.running_command
+	if rc == nil {
+		t.Fatalf("Filter not running in the background")
+	}
+	rl.FeedKeys("ctrl+g")
+	<-rc.done
+	rl.finish_running_command(rc)
+	if diff := cmp.Diff("a\nB\nC", rl.all_text()); diff != "" || rl.message != "Command cancelled" {
+		t.Fatalf("Cancelled filter changed the text: %#v\n%s", rl.message, diff)
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recovery")
+	lp, _ := loop.New()
+	rl := New(lp, RlInit{RecoveryPath: path, ProtectedPrefix: "> "})
+	if _, found := rl.RecoveredText(); found {
+		t.Fatalf("Recovered text found without a recovery file")
+	}
+	rl.add_text("one\ntwo")
+	rl.save_recovery()
+	if text, found := New(lp, RlInit{RecoveryPath: path}).RecoveredText(); !found || text != "one\ntwo" {
+		t.Fatalf("Input not saved for recovery: %#v", text)
+	}
+	rl.add_text("x")
+	rl.save_recovery()
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Fatalf("Temporary files left behind when saving for recovery: %v", entries)
+	}
+	rl.perform_action(ActionBackspace, 1)
+	if err := rl.perform_action(ActionAcceptInput, 1); err != ErrAcceptInput {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Fatalf("Recovery file not removed after accepting input")
+	}
+	rl.ResetText()
+	rl.add_text("three")
+	rl.save_recovery()
+	rl.ResetText()
+	rl.save_recovery()
+	if _, found := rl.RecoveredText(); found {
+		t.Fatalf("Recovery file not removed when there is no input")
+	}
+	rl.add_text("four")
+	rl.save_recovery()
+	rl.Shutdown()
+	if _, found := rl.RecoveredText(); found {
+		t.Fatalf("Recovery file not removed on shutdown")
+	}
+}
+
+func TestSwapCase(t *testing.T) {
+	rl := new_rl()
+	rl.add_text("hello Wörld ǅ\nÉcole --")
+	rl.input_state.cursor = Position{X: 9}
+	if err := rl.perform_action(ActionSwapCase, 1); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("hello wÖRLD ǅ\nÉcole --", rl.all_text()); diff != "" || rl.input_state.cursor != (Position{X: 9}) {
+		t.Fatalf("Case of the word at the cursor not swapped, cursor: %+v\n%s", rl.input_state.cursor, diff)
+	}
+	rl.input_state.cursor = Position{X: 13}
+	rl.perform_action(ActionSetMark, 1)
+	rl.input_state.cursor = Position{X: 6, Y: 1}
+	rl.perform_action(ActionSwapCase, 1)
+	if diff := cmp.Diff("hello wÖRLD ǆ\néCOLE --", rl.all_text()); diff != "" {
+		t.Fatalf("Case of the region not swapped:\n%s", diff)
+	}
+	rl.input_state.cursor = Position{X: 7, Y: 1}
+	if rl.perform_action(ActionSwapCase, 1) != ErrCouldNotPerformAction {
+		t.Fatalf("Swapping case with no region or word at the cursor did not fail")
+	}
+}
+
+func TestHomeEnd(t *testing.T) {
+	rl := new_rl()
+	rl.add_text("one\n  abcdefghijk")
+	ah := func(behavior HomeEndBehavior, start Position, key string, expected Position) {
+		t.Helper()
+		rl.home_end_behavior = behavior
+		rl.input_state.cursor = start
+		rl.FeedKeys(key)
+		if rl.input_state.cursor != expected {
+			t.Fatalf("Cursor at %+v not %+v after %s from %+v with behavior: %d", rl.input_state.cursor, expected, key, start, behavior)
+		}
+	}
+	ah(HomeEndLine, Position{X: 10, Y: 1}, "home", Position{Y: 1})
+	ah(HomeEndLine, Position{X: 1, Y: 1}, "ctrl+e", Position{X: 13, Y: 1})
+	ah(HomeEndDocument, Position{X: 10, Y: 1}, "ctrl+a", Position{})
+	ah(HomeEndDocument, Position{X: 1}, "end", Position{X: 13, Y: 1})
+	ah(HomeEndSmart, Position{X: 10, Y: 1}, "home", Position{X: 2, Y: 1})
+	ah(HomeEndSmart, Position{X: 2, Y: 1}, "home", Position{Y: 1})
+	ah(HomeEndSmart, Position{Y: 1}, "home", Position{X: 2, Y: 1})
+	ah(HomeEndSmart, Position{Y: 1}, "end", Position{X: 13, Y: 1})
+	// the second line wraps after abcdef as the continuation prompt leaves
+	// room for 8 cells on its first screen row
+	ah(HomeEndScreenRow, Position{X: 11, Y: 1}, "home", Position{X: 8, Y: 1})
+	ah(HomeEndScreenRow, Position{X: 9, Y: 1}, "end", Position{X: 13, Y: 1})
+	ah(HomeEndScreenRow, Position{X: 3, Y: 1}, "end", Position{X: 7, Y: 1})
+	ah(HomeEndScreenRow, Position{X: 3, Y: 1}, "home", Position{Y: 1})
+}
+
+func TestCopyFromAdjacentLine(t *testing.T) {
+	rl := new_rl()
+	rl.add_text("a界cd\nx\n12")
+	rl.input_state.cursor = Position{X: 1, Y: 1}
+	if err := rl.perform_action(ActionCopyFromLineAbove, 2); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("x界c", rl.input_state.lines[1]); diff != "" || rl.input_state.cursor.X != 5 {
+		t.Fatalf("Text not copied from the line above, cursor: %+v\n%s", rl.input_state.cursor, diff)
+	}
+	if rl.perform_action(ActionCopyFromLineBelow, 1) != ErrCouldNotPerformAction {
+		t.Fatalf("Copying from beyond the end of the line below did not fail")
+	}
+	rl.input_state.cursor = Position{X: 0, Y: 1}
+	rl.perform_action(ActionCopyFromLineBelow, 1)
+	if diff := cmp.Diff("1x界c", rl.input_state.lines[1]); diff != "" {
+		t.Fatalf("Text not copied from the line below:\n%s", diff)
+	}
+	rl.input_state.cursor = Position{X: 1, Y: 2}
+	if rl.perform_action(ActionCopyFromLineBelow, 1) != ErrCouldNotPerformAction {
+		t.Fatalf("Copying from below the last line did not fail")
+	}
+	rl.input_state.cursor = Position{}
+	if rl.perform_action(ActionCopyFromLineAbove, 1) != ErrCouldNotPerformAction {
+		t.Fatalf("Copying from above the first line did not fail")
+	}
+}
+
+func TestHistoryDisplay(t *testing.T) {
+	lp, _ := loop.New()
+	rl := New(lp, RlInit{Prompt: "$ ", HistoryDisplay: func(cmd string) string {
+		if first, _, multiline := strings.Cut(cmd, "\n"); multiline {
+			return first + " ..."
+		}
+		return cmd
+	}})
+	rl.screen_width, rl.screen_height = 80, 24
+	rl.history.AddItem("a", 0)
+	rl.history.AddItem("one\ntwo", 0)
+	screen_text := func() (ans []string) {
+		for _, sl := range rl.get_screen_lines() {
+			ans = append(ans, sl.Text)
+		}
+		return
+	}
+	rl.FeedKeys("up")
+	if diff := cmp.Diff([]string{"one ..."}, screen_text()); diff != "" || rl.AllText() != "one\ntwo" {
+		t.Fatalf("Recalled item not displayed as transformed: %#v\n%s", rl.AllText(), diff)
+	}
+	rl.FeedKeys("up")
+	if diff := cmp.Diff([]string{"a"}, screen_text()); diff != "" {
+		t.Fatalf("Navigation did not move to the previous item:\n%s", diff)
+	}
+	rl.FeedKeys("down", "left")
+	if diff := cmp.Diff([]string{"one", "two"}, screen_text()); diff != "" || rl.AllText() != "one\ntwo" {
+		t.Fatalf("Real text not displayed after an action other than history navigation:\n%s", diff)
+	}
+}
+
+func TestConfirmAccept(t *testing.T) {
+	lp, _ := loop.New()
+	rl := New(lp, RlInit{Prompt: "$ ", ConfirmAccept: regexp.MustCompile(`\brm\s+-rf\b`).MatchString})
+	rl.add_text("ls")
+	if err := rl.FeedKeys("enter"); err != ErrAcceptInput {
+		t.Fatalf("Safe input not accepted: %v", err)
+	}
+	rl.ResetText()
+	rl.add_text("rm -rf /")
+	if err := rl.FeedKeys("enter"); err != nil || rl.query == nil {
+		t.Fatalf("Dangerous input accepted without confirmation: %v", err)
+	}
+	if err := rl.FeedKeys("n"); err != nil || rl.AllText() != "rm -rf /" || rl.query != nil {
+		t.Fatalf("Declining did not leave the input unchanged: %v %#v", err, rl.AllText())
+	}
+	if err := rl.FeedKeys("enter", "y"); err != ErrAcceptInput {
+		t.Fatalf("Confirmed input not accepted: %v", err)
+	}
+}
+
+func TestHorizontalScroll(t *testing.T) {
+	rl := new_rl()
+	rl.add_text("abcdefghijklmnop\nxy")
+	rl.input_state.cursor = Position{X: 16}
+	if len(rl.get_screen_lines()) != 3 {
+		t.Fatalf("Long line not wrapped by default")
+	}
+	rl.perform_action(ActionToggleHorizontalScroll, 1)
+	// the screen is 10 cells wide, leaving 6 cells after the prompt and
+	// before the last column
+	ah := func(expected string, cursor_cell int) {
+		t.Helper()
+		sls := rl.get_screen_lines()
+		if len(sls) != 2 {
+			t.Fatalf("Lines not drawn on one row each: %d", len(sls))
+		}
+		if diff := cmp.Diff(expected, sls[0].Text); diff != "" {
+			t.Fatalf("Scrolled line not as expected:\n%s", diff)
+		}
+		if sls[0].CursorCell != cursor_cell {
+			t.Fatalf("Cursor in cell %d not %d", sls[0].CursorCell, cursor_cell)
+		}
+	}
+	ah("<nop", 7)
+	rl.FeedKeys("home")
+	ah("abcde\x1b[m>", 3)
+	rl.FeedKeys("right right right right")
+	ah("abcde\x1b[m>", 7)
+	rl.FeedKeys("right")
+	ah("<cdef\x1b[m>", 7)
+	rl.FeedKeys("down")
+	if rl.input_state.cursor != (Position{X: 2, Y: 1}) {
+		t.Fatalf("Cursor not moved down to the end of the next line: %+v", rl.input_state.cursor)
+	}
+	ah("abcde\x1b[m>", -1)
+	rl.input_state.cursor = Position{X: 12}
+	if !rl.MoveCursorToScreenCell(0, 4) || rl.input_state.cursor != (Position{X: 9}) {
+		t.Fatalf("Cursor not moved to the cell in the scrolled line: %+v", rl.input_state.cursor)
+	}
+	rl.Redraw()
+	rl.perform_action(ActionToggleHorizontalScroll, 1)
+	if len(rl.get_screen_lines()) != 3 {
+		t.Fatalf("Long line not wrapped after toggling scrolling off")
+	}
+}
+
+func TestTextWidth(t *testing.T) {
+	rl := new_rl()
+	if rl.LineWidth(0) != 0 || rl.TextWidth() != 0 || rl.LineWidth(1) != -1 {
+		t.Fatalf("Width of empty input not zero")
+	}
+	rl.add_text("a\tb\n界±")
+	if rl.LineWidth(0) != 9 || rl.LineWidth(1) != 3 || rl.TextWidth() != 9 {
+		t.Fatalf("Widths not as expected: %d %d %d", rl.LineWidth(0), rl.LineWidth(1), rl.TextWidth())
+	}
+	rl.ambiguous_width = 2
+	if rl.LineWidth(1) != 4 {
+		t.Fatalf("Width does not use the ambiguous width: %d", rl.LineWidth(1))
+	}
+	for _, sl := range rl.get_screen_lines() {
+		if sl.ParentLineNumber == 1 && sl.TextLengthInCells != 4 {
+			t.Fatalf("Width not the same as when drawn: %d", sl.TextLengthInCells)
+		}
+	}
+}
+
+func TestMultiKeyShortcutsWithReleaseEvents(t *testing.T) {
+	rl := new_rl()
+	rl.add_text("a")
+	for _, ev := range []loop.KeyEvent{
+		{Type: loop.PRESS, Mods: loop.CTRL, Key: "v"},
+		{Type: loop.RELEASE, Mods: loop.CTRL, Key: "v"},
+		{Type: loop.RELEASE, Key: "LEFT_CONTROL"},
+		{Type: loop.PRESS, Key: "TAB"},
+		{Type: loop.RELEASE, Key: "TAB"},
+	} {
+		rl.OnKeyEvent(&ev)
+	}
+	if diff := cmp.Diff("a\t", rl.all_text()); diff != "" {
+		t.Fatalf("Multi-key shortcut cancelled by key release events:\n%s", diff)
+	}
+	rl.ResetText()
+	rl.add_text("a")
+	for _, ev := range []loop.KeyEvent{
+		{Type: loop.PRESS, Mods: loop.CTRL, Key: "v"},
+		{Type: loop.RELEASE, Mods: loop.CTRL, Key: "v"},
+		{Type: loop.PRESS, Mods: loop.SHIFT, Key: "LEFT_SHIFT"},
+		{Type: loop.PRESS, Mods: loop.SHIFT, Key: ".", ShiftedKey: ">", Text: ">"},
+		{Type: loop.RELEASE, Mods: loop.SHIFT, Key: ".", ShiftedKey: ">"},
+		{Type: loop.RELEASE, Key: "LEFT_SHIFT"},
+	} {
+		rl.OnKeyEvent(&ev)
+	}
+	if diff := cmp.Diff(rl.indent_unit()+"a", rl.all_text()); diff != "" {
+		t.Fatalf("Multi-key shortcut cancelled by modifier key press:\n%s", diff)
+	}
+	if len(rl.keyboard_state.current_pending_keys) != 0 {
+		t.Fatalf("Pending keys not cleared: %#v", rl.keyboard_state.current_pending_keys)
+	}
+}
+
+func TestKillAcrossLines(t *testing.T) {
+	rl := new_rl()
+	original := "one\ntwo\nthree\nfour"
+	for _, x := range []struct {
+		start, end Position
+		killed     string
+	}{
+		{Position{X: 1, Y: 0}, Position{X: 2, Y: 1}, "ne\ntw"},
+		{Position{X: 3, Y: 0}, Position{X: 0, Y: 1}, "\n"},
+		{Position{X: 2, Y: 0}, Position{X: 4, Y: 3}, "e\ntwo\nthree\nfour"},
+	} {
+		rl.ResetText()
+		rl.kill_ring.clear()
+		rl.add_text(original)
+		rl.input_state.cursor = x.start
+		rl.perform_action(ActionSetMark, 1)
+		rl.input_state.cursor = x.end
+		if err := rl.perform_action(ActionKillRegion, 1); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(x.killed, rl.kill_ring.yank()); diff != "" {
+			t.Fatalf("Killed text not as expected:\n%s", diff)
+		}
+		rl.perform_action(ActionYank, 1)
+		if diff := cmp.Diff(original, rl.all_text()); diff != "" {
+			t.Fatalf("Yanking the killed text did not restore the original:\n%s", diff)
+		}
+		if rl.input_state.cursor != x.end {
+			t.Fatalf("Cursor not after the yanked text: %#v", rl.input_state.cursor)
+		}
+	}
+}
+
+func TestEscPrefixedKeys(t *testing.T) {
+	rl := new_rl()
+	rl.add_text("one two")
+	rl.OnKeyEvent(loop.KeyEventFromEscPrefixedByte('b'))
+	if diff := cmp.Diff("one ", rl.text_upto_cursor_pos()); diff != "" {
+		t.Fatalf("Esc b not handled as alt+b:\n%s", diff)
+	}
+	rl.OnKeyEvent(loop.KeyEventFromEscPrefixedByte(0x7f))
+	if diff := cmp.Diff("two", rl.all_text()); diff != "" {
+		t.Fatalf("Esc backspace not handled as alt+backspace:\n%s", diff)
+	}
+	for ch, expected := range map[byte]string{'U': "alt+shift+u", 0x1: "ctrl+alt+a", '\r': "alt+enter", '.': "alt+."} {
+		if ev := loop.KeyEventFromEscPrefixedByte(ch); !ev.MatchesPressOrRepeat(expected) || ev.Text != "" {
+			t.Fatalf("Esc %#v does not match %s: %s", ch, expected, ev)
+		}
+	}
+}
+
+func TestPromptMarks(t *testing.T) {
+	lp, _ := loop.New()
+	end := func(rl *Readline) string {
+		buf := strings.Builder{}
+		rl.output_mirror = &buf
+		rl.End()
+		rl.output_mirror = nil
+		return buf.String()
+	}
+	rl := New(lp, RlInit{Prompt: "$ ", ContinuationPrompt: "> "})
+	if diff := cmp.Diff(PROMPT_MARK+"A"+ST+"$ ", rl.prompt.Text); diff != "" {
+		t.Fatalf("Default prompt marks not as expected:\n%s", diff)
+	}
+	if diff := cmp.Diff(PROMPT_MARK+"A;k=s"+ST+"> ", rl.continuation_prompt.Text); diff != "" {
+		t.Fatalf("Default continuation prompt marks not as expected:\n%s", diff)
+	}
+	if !strings.HasSuffix(end(rl), MarkOutputStart()) {
+		t.Fatalf("Output start not marked by default")
+	}
+	rl = New(lp, RlInit{Prompt: "$ ", ContinuationPrompt: "> ", MarkPromptEnd: true, DontMarkOutputStart: true, PromptMarkAttributes: "x=y", PromptMarkCommandId: "42"})
+	if diff := cmp.Diff(PROMPT_MARK+"A;x=y;aid=42"+ST+"$ "+PROMPT_MARK+"B"+ST, rl.prompt.Text); diff != "" {
+		t.Fatalf("Configured prompt marks not as expected:\n%s", diff)
+	}
+	if diff := cmp.Diff(PROMPT_MARK+"A;k=s;x=y;aid=42"+ST+"> "+PROMPT_MARK+"B"+ST, rl.continuation_prompt.Text); diff != "" {
+		t.Fatalf("Configured continuation prompt marks not as expected:\n%s", diff)
+	}
+	if rl.prompt.Length != 2 || rl.continuation_prompt.Length != 2 {
+		t.Fatalf("Prompt marks counted in the prompt length: %d %d", rl.prompt.Length, rl.continuation_prompt.Length)
+	}
+	if strings.Contains(end(rl), MarkOutputStart()) {
+		t.Fatalf("Output start marked when disabled")
+	}
+	rl.SetPromptMarkCommandId("")
+	if diff := cmp.Diff(PROMPT_MARK+"A;x=y"+ST+"$ "+PROMPT_MARK+"B"+ST, rl.prompt.Text); diff != "" {
+		t.Fatalf("Prompt marks not updated after changing the command id:\n%s", diff)
+	}
+	rl = New(lp, RlInit{Prompt: "$ ", DontMarkPrompts: true, MarkPromptEnd: true})
+	if rl.prompt.Text != "$ " || strings.Contains(end(rl), PROMPT_MARK) {
+		t.Fatalf("Prompt marked when marking is disabled: %#v", rl.prompt.Text)
+	}
+}
+
+func TestCommandFinishedMarker(t *testing.T) {
+	if diff := cmp.Diff(PROMPT_MARK+"D;0"+ST, MarkCommandFinished(0)); diff != "" {
+		t.Fatalf("Command finished marker not as expected:\n%s", diff)
+	}
+	rl := New(nil, RlInit{Prompt: "$ "})
+	if diff := cmp.Diff(PROMPT_MARK+"D;1"+ST, rl.CommandFinishedMarker(1)); diff != "" {
+		t.Fatalf("Command finished marker not as expected:\n%s", diff)
+	}
+	rl.SetPromptMarkCommandId("42")
+	if diff := cmp.Diff(PROMPT_MARK+"D;127;aid=42"+ST, rl.CommandFinishedMarker(127)); diff != "" {
+		t.Fatalf("Command finished marker without the command id:\n%s", diff)
+	}
+	rl = New(nil, RlInit{Prompt: "$ ", DontMarkPrompts: true, PromptMarkCommandId: "42"})
+	if m := rl.CommandFinishedMarker(0); m != "" {
+		t.Fatalf("Command finished marker returned when marking is disabled: %#v", m)
+	}
+}
+
+func TestCurrentLine(t *testing.T) {
+	rl := new_rl()
+	check := func(line, before, after string) {
+		t.Helper()
+		if diff := cmp.Diff([]string{line, before, after}, []string{rl.CurrentLine(), rl.CurrentLineBeforeCursor(), rl.CurrentLineAfterCursor()}); diff != "" {
+			t.Fatalf("Current line not as expected:\n%s", diff)
+		}
+	}
+	check("", "", "")
+	rl.add_text("one\ntwo\nthree")
+	check("three", "three", "")
+	rl.perform_action(ActionCursorUp, 1)
+	rl.perform_action(ActionCursorLeft, 1)
+	check("two", "tw", "o")
+	rl.perform_action(ActionMoveToStartOfDocument, 1)
+	check("one", "", "one")
+	if rl.TextAfterCursor() != "one\ntwo\nthree" || rl.CursorPosition() != (Position{}) {
+		t.Fatalf("Reading the current line changed the input")
+	}
+}
+
+func TestEditingWithoutLoop(t *testing.T) {
+	rl := New(nil, RlInit{Prompt: "$ ", AutoSuggestions: true, AutoSuggestionDelay: time.Second, IdleTimeout: time.Second, OnIdle: func() error { return nil }})
+	rl.AddHistoryItem(HistoryItem{Cmd: "echo hello world"})
+	for _, ch := range "echo hello" {
+		rl.OnText(string(ch), true, false)
+	}
+	// timers cannot be used so the autosuggestion is looked up immediately
+	if diff := cmp.Diff(" world", rl.current_autosuggestion()); diff != "" {
+		t.Fatalf("Autosuggestion not as expected:\n%s", diff)
+	}
+	rl.FeedKeys("alt+b", "ctrl+k", "ctrl+a", "ctrl+l")
+	if diff := cmp.Diff("echo ", rl.AllText()); diff != "" {
+		t.Fatalf("Text not as expected:\n%s", diff)
+	}
+	if diff := cmp.Diff(Position{}, rl.CursorPosition()); diff != "" {
+		t.Fatalf("Cursor not as expected:\n%s", diff)
+	}
+	// beeps and redraws do nothing
+	rl.FeedKeys("left")
+	rl.Redraw()
+	rl.ScheduleRedraw()
+}
+
+func TestCursorByteOffset(t *testing.T) {
+	rl := new_rl()
+	rl.add_text("ab\nçd\n\nef")
+	for _, pos := range []Position{{}, {X: 2}, {Y: 1}, {Y: 1, X: 2}, {Y: 2}, {Y: 3, X: 1}, {Y: 3, X: 2}} {
+		rl.input_state.cursor = pos
+		if diff := cmp.Diff(len(rl.TextBeforeCursor()), rl.CursorByteOffset()); diff != "" {
+			t.Fatalf("Byte offset of the cursor at %#v not as expected:\n%s", pos, diff)
+		}
+	}
+}
+
+func TestCapitalizeLines(t *testing.T) {
+	rl := new_rl()
+	rl.add_text("one\n  - two\n\n3 éclair\nǆungla\nAlready")
+	rl.input_state.cursor = Position{Y: 3, X: 4}
+	if err := rl.perform_action(ActionCapitalizeLines, 1); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("One\n  - Two\n\n3 Éclair\nǅungla\nAlready", rl.all_text()); diff != "" {
+		t.Fatalf("Lines not capitalized as expected:\n%s", diff)
+	}
+	if diff := cmp.Diff(Position{Y: 3, X: 4}, rl.input_state.cursor); diff != "" {
+		t.Fatalf("Cursor moved:\n%s", diff)
+	}
+	if rl.perform_action(ActionCapitalizeLines, 1) != ErrCouldNotPerformAction {
+		t.Fatalf("Capitalizing already capitalized lines did not fail")
+	}
+	rl.SetText("a\nb\nc")
+	rl.input_state.cursor = Position{Y: 1}
+	rl.perform_action(ActionSetMark, 1)
+	rl.input_state.cursor = Position{Y: 2}
+	rl.perform_action(ActionCapitalizeLines, 1)
+	if diff := cmp.Diff("a\nB\nC", rl.all_text()); diff != "" {
+		t.Fatalf("Lines in the region not capitalized as expected:\n%s", diff)
+	}
+}
+
+func TestCompletionDisplayText(t *testing.T) {
+	rl := new_rl()
+	rl.screen_width = 80
+	rl.completions.completer = func(before_cursor, after_cursor string) *cli.Completions {
+		g := &cli.MatchGroup{NoTrailingSpace: true}
+		g.AddMatch("foo(").Display = "func foo(x int)"
+		g.AddMatch("fob(").Display = "func fob()"
+		return &cli.Completions{Groups: []*cli.MatchGroup{g}, CurrentWordIdx: strings.LastIndex(before_cursor, " ") + 1}
+	}
+	rl.add_text("x fo")
+	rl.perform_action(ActionCompleteForward, 1)
+	lines, _ := rl.completion_screen_lines()
+	if text := wcswidth.StripEscapeCodes(strings.Join(lines, "\n")); !strings.Contains(text, "func foo(x int)") || strings.Contains(text, "foo(  ") {
+		t.Fatalf("Display text of candidates not rendered: %#v", text)
+	}
+	rl.perform_action(ActionCompleteForward, 1)
+	if diff := cmp.Diff("x foo(", rl.all_text()); diff != "" {
+		t.Fatalf("Insertion text of candidate not inserted:\n%s", diff)
+	}
+}
+
+func TestZapBackToChar(t *testing.T) {
+	rl := new_rl()
+	zap := func(ac Action, repeat_count uint, ch, expected string) {
+		t.Helper()
+		rl.SetText("a, b, c, d")
+		rl.kill_ring.items.Init()
+		rl.perform_action(ac, repeat_count)
+		if rl.query_message() == "" {
+			t.Fatalf("No query for the character")
+		}
+		rl.OnText(ch, false, false)
+		if diff := cmp.Diff(expected, rl.all_text()); diff != "" {
+			t.Fatalf("Text not as expected after zapping back to %#v:\n%s", ch, diff)
+		}
+	}
+	zap(ActionZapBackToChar, 1, ",", "a, b, c")
+	if diff := cmp.Diff(", d", rl.kill_ring.yank()); diff != "" {
+		t.Fatalf("Killed text not as expected:\n%s", diff)
+	}
+	zap(ActionZapBackUpToChar, 1, ",", "a, b, c,")
+	zap(ActionZapBackUpToChar, 2, ",", "a, b,")
+	zap(ActionZapBackToChar, 3, "b", "a, b, c, d")
+	if rl.kill_ring.items.Len() != 0 {
+		t.Fatalf("Text killed when the character was not found")
+	}
+	zap(ActionZapBackToChar, 1, "a", "")
 }
@@ -5,11 +5,16 @@ package readline
 import (
 	"container/list"
 	"fmt"
+	"io"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"kitty/tools/cli"
 	"kitty/tools/cli/markup"
 	"kitty/tools/tui/loop"
+	"kitty/tools/utils"
 	"kitty/tools/wcswidth"
 )
 
@@ -20,16 +25,143 @@ const PROMPT_MARK = "\x1b]133;"
 
 type SyntaxHighlightFunction = func(text string, x, y int) string
 type CompleterFunction = func(before_cursor, after_cursor string) *cli.Completions
+type HintFunction = func(before_cursor, after_cursor string) string
+type CancelFunction = func(text string)
+
+// Hooks called around every action performed in response to the user's
+// input, including the action that inserts typed text
+type ActionMiddleware struct {
+	// Return false to veto the action, which then fails
+	Before func(ac Action, repeat_count uint) bool
+	// Called with the result of the action
+	After func(ac Action, repeat_count uint, err error)
+}
+
+// Called when the input is accepted with the text as typed and the text as it
+// should be executed, AcceptedText(), which differs only by trimming as no
+// expansions are performed.
+// The returned text replaces the input and accepting it proceeds only if
+// accept is true.
+type AcceptFunction = func(text, expanded string) (final_text string, accept bool)
+type PasteTransformFunction = func(text string) string
+
+// Returns the text to draw instead of a history item recalled by history
+// navigation, for example, with long lines collapsed. It is drawn until
+// the next action that is not history navigation, the item itself is what is
+// edited and accepted.
+type HistoryDisplayFunction = func(cmd string) string
+
+// Returns true if accepting text, such as a dangerous command, must be
+// confirmed by pressing y, for example:
+// regexp.MustCompile(`\brm\s+-rf\s+/`).MatchString
+type ConfirmAcceptFunction = func(text string) bool
+
+// Which whitespace to trim from the accepted text
+type TrimPolicy int
+
+const (
+	TrimNone TrimPolicy = iota
+	TrimBoth
+	TrimLeading
+	TrimTrailing
+)
+
+func (self TrimPolicy) trim(text string) string {
+	switch self {
+	case TrimBoth:
+		return strings.TrimSpace(text)
+	case TrimLeading:
+		return strings.TrimLeftFunc(text, unicode.IsSpace)
+	case TrimTrailing:
+		return strings.TrimRightFunc(text, unicode.IsSpace)
+	}
+	return text
+}
+
+// What ActionHome and ActionEnd, bound to home, end, ctrl+a and ctrl+e,
+// move the cursor to
+type HomeEndBehavior int
+
+const (
+	// The start and end of the current line
+	HomeEndLine HomeEndBehavior = iota
+	// The start and end of the screen row the cursor is on, which differs
+	// from the line when it wraps
+	HomeEndScreenRow
+	// The start and end of all the text
+	HomeEndDocument
+	// Home moves to the first non-blank character of the line and, when
+	// already there, to the start of the line. End moves to the end of the line.
+	HomeEndSmart
+)
 
 type RlInit struct {
-	Prompt                  string
-	HistoryPath             string
-	HistoryCount            int
-	ContinuationPrompt      string
-	EmptyContinuationPrompt bool
-	DontMarkPrompts         bool
-	SyntaxHighlighter       SyntaxHighlightFunction
-	Completer               CompleterFunction
+	Prompt                       string
+	HistoryPath                  string
+	NoHistory                    bool
+	SharedHistoryPath            string
+	HistoryCount                 int
+	ContinuationPrompt           string
+	EmptyContinuationPrompt      bool
+	AlignContinuationPrompt      bool
+	DontMarkPrompts              bool
+	MarkPromptEnd                bool
+	DontMarkOutputStart          bool
+	EndWithoutNewline            bool
+	ProtectedPrefix              string
+	OutputMirror                 io.Writer
+	KillToClipboard              bool
+	HomeEndBehavior              HomeEndBehavior
+	HistoryDisplay               HistoryDisplayFunction
+	ConfirmAccept                ConfirmAcceptFunction
+	HorizontalScroll             bool
+	Abbreviations                map[string]string
+	Placeholder                  string
+	KeepCommandOutputNewline     bool
+	PromptMarkAttributes         string
+	PromptMarkCommandId          string
+	SyntaxHighlighter            SyntaxHighlightFunction
+	Completer                    CompleterFunction
+	Hinter                       HintFunction
+	HintBelowInput               bool
+	FuzzyMatching                bool
+	HistorySearchIgnoreCase      bool
+	AutoSuggestions              bool
+	AutoSuggestionMaxScan        int
+	AutoSuggestionMinLength      int
+	AutoSuggestionDelay          time.Duration
+	MenuComplete                 bool
+	BalanceCheck                 *BalanceCheck
+	CommentStart                 string
+	MaxDisplayedCompletions      int
+	AsyncCompleter               AsyncCompleterFunction
+	CompletionTriggerCharacters  string
+	CompletionTriggerDelay       time.Duration
+	CompletionWordBreaks         string
+	ShowSingleCompletion         bool
+	NoSpaceAfterSingleCompletion bool
+	TabWidth                     int
+	InsertSpacesForTab           bool
+	ShiftWidth                   int
+	AmbiguousWidthIsWide         bool
+	OnCancel                     CancelFunction
+	OnAccept                     AcceptFunction
+	TrimAcceptedText             TrimPolicy
+	KeepTextOnCancel             bool
+	IdleTimeout                  time.Duration
+	OnIdle                       IdleFunction
+	RecoveryPath                 string
+	RecoveryInterval             time.Duration
+	DateTimeFormat               string
+	GlobBaseDir                  string
+	WordEraseBlankDelimited      bool
+	TemplateSyntax               *TemplateSyntax
+	PinnedHistoryFirst           bool
+	TrimHistoryEntries           bool
+	HistoryFinalNewline          bool
+	HistoryEntrySuffix           string
+	PasteTransform               PasteTransformFunction
+	OnHistoryError               HistoryErrorFunction
 }
 
 type Position struct {
@@ -49,6 +181,7 @@ func (self *kill_ring) append_to_existing_item(text string) {
 	e := self.items.Front()
 	if e == nil {
 		self.add_new_item(text)
+		return
 	}
 	e.Value = e.Value.(string) + text
 }
@@ -83,6 +216,17 @@ func (self *kill_ring) clear() {
 type Prompt struct {
 	Text   string
 	Length int
+	// The rows of a prompt containing newlines above the row on which the
+	// input starts. Text and Length are for the last row.
+	Banner []Prompt
+}
+
+// The number of screen rows used by the banner of the primary prompt
+func (self *Readline) prompt_banner_rows() (ans int) {
+	for _, row := range self.prompt.Banner {
+		ans += utils.Max(1, (row.Length+self.screen_width-1)/self.screen_width)
+	}
+	return
 }
 
 type InputState struct {
@@ -107,10 +251,24 @@ type syntax_highlighted struct {
 	last_highlighter_name  string
 }
 
+type hints struct {
+	hinter                      HintFunction
+	below_input                 bool
+	before_cursor, after_cursor string
+	current                     string
+	is_valid                    bool
+}
+
+type prompt_marks struct {
+	prompt_start, prompt_end, output_start bool
+	attributes, command_id                 string
+}
+
 type Readline struct {
-	prompt, continuation_prompt Prompt
+	prompt, continuation_prompt           Prompt
+	prompt_text, continuation_prompt_text string
 
-	mark_prompts bool
+	prompt_marks prompt_marks
 	loop         *loop.Loop
 	history      *History
 	kill_ring    kill_ring
@@ -122,124 +280,792 @@ type Readline struct {
 	last_yank_extent            struct {
 		start, end Position
 	}
-	bracketed_paste_buffer strings.Builder
-	last_action            Action
-	history_matches        *HistoryMatches
-	history_search         *HistorySearch
-	keyboard_state         KeyboardState
-	fmt_ctx                *markup.Context
-	text_to_be_added       string
-	syntax_highlighted     syntax_highlighted
-	completions            completions
+	bracketed_paste_buffer     strings.Builder
+	last_action                Action
+	history_matches            *HistoryMatches
+	history_search             *HistorySearch
+	keyboard_state             KeyboardState
+	fmt_ctx                    *markup.Context
+	text_to_be_added           string
+	syntax_highlighted         syntax_highlighted
+	completions                completions
+	hints                      hints
+	fuzzy_matching             bool
+	history_search_ignore_case bool
+	autosuggestion             autosuggestion
+	balance_check              *BalanceCheck
+	region                     region
+	shortcuts                  *ShortcutMap
+	spinner                    spinner
+	running_command            *running_command
+	redraw_timer_id            loop.IdType
+	edit_locations             edit_locations
+	template                   *template
+	word_erase_blank_delimited bool
+	query                      *query
+	query_replace              *query_replace
+	message                    string
+	comment_start              string
+	keyboard_macro             keyboard_macro
+	align_continuation_prompt  bool
+	paste_transform            PasteTransformFunction
+	argument_history           argument_history
+	template_syntax_override   *TemplateSyntax
+	on_cancel                  CancelFunction
+	on_accept                  AcceptFunction
+	trim_accepted_text         TrimPolicy
+	end_without_newline        bool
+	keep_output_newline        bool
+	protected_prefix           string
+	placeholder                string
+	action_middleware          []ActionMiddleware
+	last_change                last_change
+	output_mirror              io.Writer
+	mouse_selection            mouse_selection
+	kill_to_clipboard          bool
+	abbreviations              map[string]string
+	home_end_behavior          HomeEndBehavior
+	history_display            HistoryDisplayFunction
+	recalled                   recalled_history_item
+	confirm_accept             ConfirmAcceptFunction
+	horizontal_scroll          bool
+	hscroll                    int
+	keep_text_on_cancel        bool
+	idle                       idle
+	recovery                   recovery
+	date_time_format           string
+	glob_base_dir              string
+	pinned_history_first       bool
+	tab_width                  int
+	insert_spaces_for_tab      bool
+	shift_width                int
+	ambiguous_width            int
+	// The text the input was last set to and whether it has been edited since
+	seeded_text string
+	modified    bool
+}
+
+// As with GNU readline, text in the prompt between \001 and \002 is output
+// but does not count towards its width. Escape codes are recognized and
+// ignored anyway, so this is needed only for other non-printing output.
+func prompt_without_ignore_markers(text string) (string, string) {
+	if !strings.ContainsRune(text, '\001') {
+		return text, text
+	}
+	output, visible := strings.Builder{}, strings.Builder{}
+	ignoring := false
+	for _, ch := range text {
+		switch ch {
+		case '\001':
+			ignoring = true
+		case '\002':
+			ignoring = false
+		default:
+			output.WriteRune(ch)
+			if !ignoring {
+				visible.WriteRune(ch)
+			}
+		}
+	}
+	return output.String(), visible.String()
 }
 
 func (self *Readline) make_prompt(text string, is_secondary bool) Prompt {
-	if self.mark_prompts {
+	text, visible := prompt_without_ignore_markers(text)
+	var banner []Prompt
+	if strings.Contains(text, "\n") && strings.Count(text, "\n") == strings.Count(visible, "\n") {
+		rows, visible_rows := strings.Split(text, "\n"), strings.Split(visible, "\n")
+		last := len(rows) - 1
+		banner = make([]Prompt, last)
+		for i, row := range rows[:last] {
+			banner[i] = Prompt{Text: row, Length: self.stringwidth(visible_rows[i])}
+		}
+		text, visible = rows[last], visible_rows[last]
+	}
+	if self.prompt_marks.prompt_start {
 		m := PROMPT_MARK + "A"
 		if is_secondary {
 			m += ";k=s"
 		}
-		text = m + ST + text
+		if self.prompt_marks.attributes != "" {
+			m += ";" + self.prompt_marks.attributes
+		}
+		if self.prompt_marks.command_id != "" {
+			m += ";aid=" + self.prompt_marks.command_id
+		}
+		if len(banner) > 0 {
+			banner[0].Text = m + ST + banner[0].Text
+		} else {
+			text = m + ST + text
+		}
+		if self.prompt_marks.prompt_end {
+			text += PROMPT_MARK + "B" + ST
+		}
+	}
+	return Prompt{Text: text, Length: self.stringwidth(visible), Banner: banner}
+}
+
+func (self *Readline) update_prompts() {
+	self.prompt = self.make_prompt(self.prompt_text, false)
+	self.continuation_prompt = self.make_prompt(self.continuation_prompt_text, true)
+	if pad := self.prompt.Length - self.continuation_prompt.Length; pad > 0 && self.align_continuation_prompt {
+		self.continuation_prompt = self.make_prompt(strings.Repeat(" ", pad)+self.continuation_prompt_text, true)
 	}
-	return Prompt{Text: text, Length: wcswidth.Stringwidth(text)}
 }
 
+// Create a Readline for use with loop. The loop can be nil, for instance to
+// test editing without a terminal, until ChangeLoopAndResetText() is called,
+// in which case nothing is drawn and timers are not used.
 func New(loop *loop.Loop, r RlInit) *Readline {
+	r.ProtectedPrefix = sanitize_protected_prefix(r.ProtectedPrefix)
 	hc := r.HistoryCount
 	if hc == 0 {
 		hc = 8192
 	}
+	var shared_history_paths []string
+	if r.SharedHistoryPath != "" {
+		shared_history_paths = append(shared_history_paths, r.SharedHistoryPath)
+	}
+	var history *History
+	if r.NoHistory {
+		history = new_disabled_history()
+	} else {
+		history = new_history(r.HistoryPath, hc, r.HistoryEntrySuffix, r.OnHistoryError, shared_history_paths...)
+	}
 	ans := &Readline{
-		mark_prompts: !r.DontMarkPrompts, fmt_ctx: markup.New(true),
-		loop: loop, input_state: InputState{lines: []string{""}}, history: NewHistory(r.HistoryPath, hc),
+		prompt_marks: prompt_marks{
+			prompt_start: !r.DontMarkPrompts, prompt_end: !r.DontMarkPrompts && r.MarkPromptEnd,
+			output_start: !r.DontMarkPrompts && !r.DontMarkOutputStart,
+			attributes:   r.PromptMarkAttributes, command_id: r.PromptMarkCommandId,
+		},
+		fmt_ctx: markup.New(true), loop: loop,
+		input_state: InputState{lines: []string{r.ProtectedPrefix}, cursor: Position{X: len(r.ProtectedPrefix)}}, history: history,
 		syntax_highlighted: syntax_highlighted{highlighter: r.SyntaxHighlighter},
-		completions:        completions{completer: r.Completer},
-		kill_ring:          kill_ring{items: list.New().Init()},
+		completions: completions{
+			completer: r.Completer, menu_complete: r.MenuComplete, max_displayed: r.MaxDisplayedCompletions,
+			show_single: r.ShowSingleCompletion, no_space_after_single: r.NoSpaceAfterSingleCompletion,
+			async_completer: r.AsyncCompleter, trigger_characters: r.CompletionTriggerCharacters,
+			trigger_delay: r.CompletionTriggerDelay, word_breaks: r.CompletionWordBreaks,
+		},
+		hints:          hints{hinter: r.Hinter, below_input: r.HintBelowInput},
+		kill_ring:      kill_ring{items: list.New().Init()},
+		fuzzy_matching: r.FuzzyMatching, history_search_ignore_case: r.HistorySearchIgnoreCase,
+		autosuggestion: autosuggestion{
+			enabled: r.AutoSuggestions, max_scan: r.AutoSuggestionMaxScan, min_length: r.AutoSuggestionMinLength,
+			delay: r.AutoSuggestionDelay,
+		},
+		balance_check:    r.BalanceCheck,
+		idle:             idle{timeout: r.IdleTimeout, callback: r.OnIdle},
+		recovery:         recovery{path: r.RecoveryPath, interval: r.RecoveryInterval},
+		date_time_format: r.DateTimeFormat, glob_base_dir: r.GlobBaseDir,
+		pinned_history_first: r.PinnedHistoryFirst,
+		on_cancel:            r.OnCancel, keep_text_on_cancel: r.KeepTextOnCancel, on_accept: r.OnAccept,
+		tab_width: r.TabWidth, insert_spaces_for_tab: r.InsertSpacesForTab, shift_width: r.ShiftWidth,
+		comment_start: r.CommentStart, align_continuation_prompt: r.AlignContinuationPrompt,
+		paste_transform: r.PasteTransform, template_syntax_override: r.TemplateSyntax,
+		word_erase_blank_delimited: r.WordEraseBlankDelimited, trim_accepted_text: r.TrimAcceptedText,
+		end_without_newline: r.EndWithoutNewline, keep_output_newline: r.KeepCommandOutputNewline,
+		protected_prefix: r.ProtectedPrefix, placeholder: r.Placeholder, output_mirror: r.OutputMirror,
+		kill_to_clipboard: r.KillToClipboard, abbreviations: map[string]string{},
+		home_end_behavior: r.HomeEndBehavior, history_display: r.HistoryDisplay,
+		confirm_accept: r.ConfirmAccept, horizontal_scroll: r.HorizontalScroll,
+	}
+	ans.history.trim_entries, ans.history.final_newline = r.TrimHistoryEntries, r.HistoryFinalNewline
+	for k, v := range r.Abbreviations {
+		ans.SetAbbreviation(k, v)
+	}
+	if ans.tab_width < 1 {
+		ans.tab_width = 8
+	}
+	if ans.shift_width < 1 {
+		ans.shift_width = 4
+	}
+	if ans.completions.word_breaks == "" {
+		ans.completions.word_breaks = DefaultCompletionWordBreaks
+	}
+	if ans.date_time_format == "" {
+		ans.date_time_format = time.RFC3339
 	}
-	ans.prompt = ans.make_prompt(r.Prompt, false)
-	t := ""
+	ans.SetAmbiguousWidthIsWide(r.AmbiguousWidthIsWide)
+	ans.prompt_text = r.Prompt
 	if r.ContinuationPrompt != "" || !r.EmptyContinuationPrompt {
-		t = r.ContinuationPrompt
-		if t == "" {
-			t = ans.fmt_ctx.Yellow(">") + " "
+		ans.continuation_prompt_text = r.ContinuationPrompt
+		if ans.continuation_prompt_text == "" {
+			ans.continuation_prompt_text = ans.fmt_ctx.Yellow(">") + " "
 		}
 	}
-	ans.continuation_prompt = ans.make_prompt(t, true)
+	ans.update_prompts()
 	return ans
 }
 
+// Set the command id reported in the OSC 133;A prompt markers, use an empty
+// string to not report a command id.
+func (self *Readline) SetPromptMarkCommandId(command_id string) {
+	self.prompt_marks.command_id = command_id
+	self.update_prompts()
+}
+
+// Use fuzzy (subsequence) matching rather than exact matching when
+// filtering completion candidates and searching history
+func (self *Readline) SetFuzzyMatching(enabled bool) {
+	self.fuzzy_matching = enabled
+}
+
+// Ignore case when searching history and finding autosuggestions
+func (self *Readline) SetHistorySearchIgnoreCase(ignore_case bool) {
+	if ignore_case != self.history_search_ignore_case {
+		self.history_search_ignore_case = ignore_case
+		self.history_matches = nil
+		self.reset_autosuggestion()
+		self.autosuggestion.cache = nil
+	}
+}
+
+// Set whether East Asian ambiguous width characters are rendered as two cells
+// wide. This must match the setting of the terminal, a mismatch is the usual
+// cause of the cursor drifting away from where text is being edited.
+func (self *Readline) SetAmbiguousWidthIsWide(wide bool) {
+	self.ambiguous_width = 1
+	if wide {
+		self.ambiguous_width = 2
+	}
+	self.update_prompts()
+}
+
+// Add hooks that are called, in the order they were added, around every
+// action dispatched from key presses and text input
+func (self *Readline) AddActionMiddleware(m ActionMiddleware) {
+	self.action_middleware = append(self.action_middleware, m)
+}
+
+// Replace the word before the cursor, as delimited by the completion word
+// break characters, with the specified text. If the cursor is not just after
+// a word, the text is inserted at the cursor.
+func (self *Readline) ReplaceWordBeforeCursor(replacement string) {
+	self.replace_word_before_cursor(replacement)
+}
+
+// The byte offset in before_cursor at which the word to be completed starts,
+// for use as cli.Completions.CurrentWordIdx by completers
+func (self *Readline) CompletionWordStart(before_cursor string) int {
+	return completion_word_start(before_cursor, self.completions.word_breaks)
+}
+
+// Replace the text between the byte offsets start and end of AllText(), as
+// returned by CursorByteOffset(). Returns false, changing nothing, if the
+// offsets are out of range, not on character boundaries or inside the
+// protected prefix.
+func (self *Readline) ReplaceRange(start, end int, replacement string) bool {
+	if !self.replace_range(start, end, replacement) {
+		return false
+	}
+	self.record_text_change()
+	self.Redraw()
+	return true
+}
+
+// Update the modified state and edit locations, as perform_action() does,
+// after the text is changed outside it
+func (self *Readline) record_text_change() {
+	if self.all_text() != self.seeded_text {
+		self.modified = true
+	}
+	self.record_edit_location()
+}
+
 func (self *Readline) Shutdown() {
 	self.history.Shutdown()
+	self.clear_recovery()
 }
 
 func (self *Readline) AddHistoryItem(hi HistoryItem) {
 	self.history.merge_items(hi)
 }
 
+// A copy of the items in the history, oldest first, for which the filter, if
+// any, returns true
+func (self *Readline) HistoryItems(filter func(*HistoryItem) bool) []HistoryItem {
+	ans := make([]HistoryItem, 0, len(self.history.items))
+	for i := range self.history.items {
+		if filter == nil || filter(&self.history.items[i]) {
+			ans = append(ans, self.history.items[i])
+		}
+	}
+	return ans
+}
+
+// Pin or unpin the history item with the specified command so that it is
+// never removed when trimming the history
+func (self *Readline) PinHistoryItem(cmd string, pinned bool) bool {
+	return self.history.SetPinned(cmd, pinned)
+}
+
+// Show an animated activity indicator with the specified message below the
+// input, for example while waiting for data from an asynchronous source.
+// Key handling continues as normal. Call StopSpinner() and Redraw() when
+// the work is done.
+func (self *Readline) StartSpinner(message string) {
+	self.start_spinner(message)
+	self.Redraw()
+}
+
+func (self *Readline) StopSpinner() {
+	self.stop_spinner()
+}
+
+// Deliver the results of a request made to RlInit.AsyncCompleter and redraw.
+// Stale results are discarded, returning false.
+func (self *Readline) SetCompletions(generation uint64, results *cli.Completions) bool {
+	ans := self.set_completions(generation, results)
+	self.Redraw()
+	return ans
+}
+
+// Typing any of the specified characters lists the completion candidates
+// automatically, once no more text has been typed for delay
+func (self *Readline) SetCompletionTriggerCharacters(chars string, delay time.Duration) {
+	self.cancel_completion_trigger()
+	self.completions.trigger_characters, self.completions.trigger_delay = chars, delay
+}
+
+// Bind the word erase (WERASE) character of the controlling terminal to
+// ActionWordErase and use the terminal's word erase semantics for it. Call
+// this after LoadKeymap(), which replaces the key bindings.
+func (self *Readline) UseTerminalWordErase() error {
+	return self.use_terminal_word_erase()
+}
+
+// Display message in the message row below the input and call callback with
+// the next key pressed instead of handling it normally. Afterwards the input
+// is redrawn without the message.
+func (self *Readline) Query(message string, callback QueryFunction) {
+	self.start_query(message, callback)
+	self.Redraw()
+}
+
+// Display message, typically a question such as: Overwrite? [y/n], and call
+// callback with whether the next key pressed was y.
+func (self *Readline) QueryYesNo(message string, callback func(yes bool) error) {
+	self.Query(message, yes_no_query(callback))
+}
+
+// Insert text containing placeholder fields, such as ${1:default}, at the
+// cursor. The cursor is placed at the end of the first field, typing replaces
+// its default text and the next/previous template field actions (and Tab
+// while the template is active) move between fields.
+func (self *Readline) InsertTemplate(text string) {
+	self.insert_template(text)
+	self.Redraw()
+}
+
+// Return a snapshot of the current editing state: the text, the cursor, the
+// kill ring and so on, that can be re-installed with RestoreState()
+func (self *Readline) State() *State {
+	return self.state()
+}
+
+func (self *Readline) RestoreState(s *State) {
+	self.restore_state(s)
+	self.Redraw()
+}
+
 func (self *Readline) ResetText() {
-	self.input_state = InputState{lines: []string{""}}
+	self.input_state = InputState{lines: []string{self.protected_prefix}, cursor: self.start_of_editable_text()}
 	self.last_action = ActionNil
 	self.keyboard_state = KeyboardState{}
 	self.history_search = nil
 	self.completions.current = completion{}
+	if p := self.completions.pending; p != nil {
+		self.completions.pending = nil
+		self.stop_spinner_if_current(p.spinner)
+	}
+	self.cancel_running_command()
+	self.region = region{}
+	self.edit_locations = edit_locations{}
+	self.template = nil
+	self.query, self.query_replace, self.message = nil, nil, ""
+	self.reset_autosuggestion()
+	self.cancel_completion_trigger()
 	self.cursor_y = 0
+	self.seeded_text, self.modified = "", false
+}
+
+// Replace the current input with the specified text, placing the cursor at
+// the end
+func (self *Readline) SetText(text string) {
+	self.ResetText()
+	self.add_text(strings.TrimPrefix(text, self.protected_prefix))
+	self.seeded_text = self.all_text()
+	self.edit_locations.text = self.seeded_text
+}
+
+// Dimmed text shown after the prompt while the input is empty and has not
+// been edited since the last call to SetText() or ResetText(). It is not part
+// of the input.
+func (self *Readline) SetPlaceholder(text string) {
+	self.placeholder = text
+	self.Redraw()
+}
+
+// Register an abbreviation that ActionExpandAbbreviation replaces with
+// expansion. An empty expansion removes the abbreviation.
+func (self *Readline) SetAbbreviation(abbreviation, expansion string) {
+	if expansion == "" {
+		delete(self.abbreviations, abbreviation)
+	} else {
+		self.abbreviations[abbreviation] = expansion
+	}
+}
+
+// The protected prefix must fit on the first line, so line breaks are removed
+// from it
+func sanitize_protected_prefix(prefix string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\r' {
+			return -1
+		}
+		return r
+	}, prefix)
+}
+
+// Text at the start of the first line of the input that is part of the input
+// but cannot be edited. The cursor cannot be moved into it, and actions that
+// would change it fail. Any previous protected prefix is replaced. Line
+// breaks in prefix, as in RlInit.ProtectedPrefix, are removed.
+func (self *Readline) SetProtectedPrefix(prefix string) {
+	prefix = sanitize_protected_prefix(prefix)
+	first_line := strings.TrimPrefix(self.input_state.lines[0], self.protected_prefix)
+	if self.input_state.cursor.Y == 0 {
+		self.input_state.cursor.X = utils.Max(0, self.input_state.cursor.X-len(self.protected_prefix)) + len(prefix)
+	}
+	self.input_state.lines[0] = prefix + first_line
+	self.protected_prefix = prefix
+}
+
+// Whether the input has been edited since the last call to SetText() or
+// ResetText()
+func (self *Readline) IsModified() bool {
+	return self.modified
+}
+
+// The loop may be nil, for instance when testing editing, in which case
+// output and timers are dropped
+func (self *Readline) beep() {
+	if self.loop != nil {
+		defer self.mirror_output()()
+		self.loop.Beep()
+	}
+}
+
+func (self *Readline) queue_write(text string) {
+	if self.loop != nil {
+		defer self.mirror_output()()
+		self.loop.QueueWriteString(text)
+	}
+}
+
+// Copy what is written to the loop to the output mirror, if any, until the
+// returned function is called
+func (self *Readline) mirror_output() func() {
+	if self.output_mirror == nil || self.loop == nil {
+		return func() {}
+	}
+	lp := self.loop
+	previous := lp.MirrorWritesTo(self.output_mirror)
+	return func() { lp.MirrorWritesTo(previous) }
+}
+
+func (self *Readline) add_timer(interval time.Duration, repeats bool, callback loop.TimerCallback) (loop.IdType, error) {
+	if self.loop == nil {
+		return 0, fmt.Errorf("Cannot add a timer without a loop")
+	}
+	return self.loop.AddTimer(interval, repeats, callback)
+}
+
+func (self *Readline) remove_timer(id loop.IdType) {
+	if self.loop != nil {
+		self.loop.RemoveTimer(id)
+	}
 }
 
 func (self *Readline) ChangeLoopAndResetText(lp *loop.Loop) {
+	self.cancel_scheduled_redraw()
+	self.reset_autosuggestion()
+	self.cancel_completion_trigger()
+	self.stop_idle_timer()
+	self.stop_recovery_timer()
+	self.stop_spinner()
 	self.loop = lp
 	self.ResetText()
 }
 
 func (self *Readline) Start() {
+	defer self.mirror_output()()
 	self.loop.SetCursorShape(loop.BAR_CURSOR, true)
 	self.loop.StartBracketedPaste()
 	self.Redraw()
+	self.start_idle_timer()
+	self.start_recovery_timer()
 }
 
 func (self *Readline) End() {
+	self.cancel_scheduled_redraw()
+	self.reset_autosuggestion()
+	self.cancel_completion_trigger()
+	self.stop_idle_timer()
+	self.stop_recovery_timer()
+	self.cancel_running_command()
+	self.stop_spinner()
+	defer self.mirror_output()()
 	self.loop.SetCursorShape(loop.BLOCK_CURSOR, true)
 	self.loop.EndBracketedPaste()
-	self.loop.QueueWriteString("\r\n")
-	if self.mark_prompts {
-		self.loop.QueueWriteString(PROMPT_MARK + "C" + ST)
+	if !self.end_without_newline {
+		self.loop.QueueWriteString("\r\n")
+	}
+	if self.prompt_marks.output_start {
+		self.loop.QueueWriteString(MarkOutputStart())
 	}
 }
 
+// Leave the cursor on the line it is on in End() rather than moving to the
+// next line, so that output can continue the line or overwrite it
+func (self *Readline) SetEndWithoutNewline(without_newline bool) {
+	self.end_without_newline = without_newline
+}
+
 func MarkOutputStart() string {
 	return PROMPT_MARK + "C" + ST
 }
 
+func MarkCommandFinished(exit_status int) string {
+	return PROMPT_MARK + "D;" + strconv.Itoa(exit_status) + ST
+}
+
+// Return the OSC 133;D marker reporting the exit status of the accepted
+// command, to be output once it has finished running. Returns the empty
+// string if prompt marking is disabled.
+func (self *Readline) CommandFinishedMarker(exit_status int) string {
+	if !self.prompt_marks.prompt_start {
+		return ""
+	}
+	if self.prompt_marks.command_id == "" {
+		return MarkCommandFinished(exit_status)
+	}
+	return PROMPT_MARK + "D;" + strconv.Itoa(exit_status) + ";aid=" + self.prompt_marks.command_id + ST
+}
+
 func (self *Readline) Redraw() {
-	self.loop.StartAtomicUpdate()
-	self.RedrawNonAtomic()
-	self.loop.EndAtomicUpdate()
+	if self.loop != nil {
+		defer self.mirror_output()()
+		self.loop.StartAtomicUpdate()
+		self.RedrawNonAtomic()
+		self.loop.EndAtomicUpdate()
+	}
 }
 
 func (self *Readline) RedrawNonAtomic() {
 	self.redraw()
 }
 
+// Redraw when control returns to the event loop, coalescing multiple calls
+// into a single redraw. Use Redraw() to redraw immediately.
+func (self *Readline) ScheduleRedraw() {
+	self.schedule_redraw()
+}
+
+// Handle a key event. The returned error is ErrAcceptInput when the user
+// accepts the input and io.EOF when the user ends input on an empty line
+// (ctrl+d). The OnAccept callback, if any, can veto accepting. Cancelling
+// the current input (ctrl+c) returns nil, the OnCancel callback, if any, is
+// called with the cancelled text instead.
 func (self *Readline) OnKeyEvent(event *loop.KeyEvent) error {
+	self.start_idle_timer()
+	self.record_key_event(event)
+	if self.handle_key_while_running_command(event) {
+		return nil
+	}
+	if handled, err := self.answer_query(event); handled {
+		return err
+	}
 	err := self.handle_key_event(event)
 	if err == ErrCouldNotPerformAction {
 		err = nil
-		self.loop.Beep()
+		self.beep()
 	}
 	return err
 }
 
+// Handle the key event as if it had been typed, passing its text, if any, to
+// OnText() when it is not handled as a shortcut, like the loop does. Safe to
+// call when the loop is not running, the caller is responsible for redrawing.
+func (self *Readline) FeedKeyEvent(event *loop.KeyEvent) error {
+	if err := self.OnKeyEvent(event); err != nil || event.Handled || event.Text == "" {
+		return err
+	}
+	return self.OnText(event.Text, true, false)
+}
+
+// Feed key presses, each specification is one or more keys separated by
+// spaces, for example: FeedKeys("ctrl+a", "h i", "shift+enter"). Stops at the
+// first error.
+func (self *Readline) FeedKeys(specs ...string) error {
+	for _, spec := range specs {
+		for _, key := range strings.Fields(spec) {
+			ev, err := key_event_for_spec(key)
+			if err != nil {
+				return err
+			}
+			if err = self.FeedKeyEvent(ev); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (self *Readline) OnText(text string, from_key_event bool, in_bracketed_paste bool) error {
+	self.start_idle_timer()
+	if !from_key_event {
+		self.record_text(text, in_bracketed_paste)
+	}
+	if self.running_command != nil {
+		return nil
+	}
+	if self.query != nil {
+		// pasted text does not answer a query
+		if !in_bracketed_paste && self.bracketed_paste_buffer.Len() == 0 {
+			_, err := self.answer_query_with_text(text)
+			return err
+		}
+		self.bracketed_paste_buffer.Reset()
+		return nil
+	}
 	if in_bracketed_paste {
 		self.bracketed_paste_buffer.WriteString(text)
 		return nil
 	}
-	if self.bracketed_paste_buffer.Len() > 0 {
+	pasted := self.bracketed_paste_buffer.Len() > 0
+	if pasted {
 		self.bracketed_paste_buffer.WriteString(text)
 		text = self.bracketed_paste_buffer.String()
 		self.bracketed_paste_buffer.Reset()
+		if self.paste_transform != nil {
+			if text = self.paste_transform(text); text == "" {
+				return nil
+			}
+		}
 	}
 	self.text_to_be_added = text
-	return self.dispatch_key_action(ActionAddText)
+	err := self.dispatch_key_action(ActionAddText)
+	if err == nil && !pasted {
+		self.check_completion_trigger(text)
+	}
+	return err
+}
+
+// A PasteTransformFunction that removes escape codes and control characters
+// other than tabs and newlines from pasted text, and converts CRLF and CR line
+// endings to LF
+func SanitizePastedText(text string) string {
+	text = wcswidth.StripEscapeCodes(text)
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\r':
+			return '\n'
+		case r == '\n' || r == '\t':
+			return r
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// Surround the active region or, if there is none, the space delimited word
+// at the cursor with the specified delimiters, for example: SurroundWith("(", ")")
+func (self *Readline) SurroundWith(open, close string) {
+	self.surround_with(open, close)
+	self.Redraw()
+}
+
+// Move the cursor to the specified line and visual column, both counting from
+// one as in editors and clamped to the text. A column of zero or less keeps
+// the cursor in its current visual column.
+func (self *Readline) GoToPosition(line, column int) {
+	if column < 1 {
+		self.move_to_line(line - 1)
+	} else {
+		self.move_to_line_and_column(line-1, column-1)
+	}
+	self.Redraw()
+}
+
+// Move the cursor to the text drawn in the screen cell at row and column, for
+// example, in response to a mouse click. Both are zero based and row counts
+// from the row on which the first line of input starts, below the banner of a
+// multi-row prompt. A column in the prompt or after the end of the text on
+// the row is moved to the nearest text. Returns false if row is not part of
+// the input.
+func (self *Readline) MoveCursorToScreenCell(row, column int) bool {
+	if !self.move_cursor_to_screen_cell(row, column) {
+		return false
+	}
+	self.Redraw()
+	return true
+}
+
+// Handle a press of the left mouse button on the screen cell at row and
+// column, as for MoveCursorToScreenCell(), starting a selection. clicks is 2
+// for a double click, which selects a word, and 3 for a triple click, which
+// selects a line. The selection is the active region so it can be killed or
+// copied.
+func (self *Readline) MousePress(row, column, clicks int) bool {
+	if !self.mouse_press(row, column, clicks) {
+		return false
+	}
+	self.Redraw()
+	return true
+}
+
+// Extend the selection started by MousePress() to the screen cell at row and
+// column
+func (self *Readline) MouseDrag(row, column int) bool {
+	if !self.mouse_drag(row, column) {
+		return false
+	}
+	self.Redraw()
+	return true
+}
+
+// End the selection started by MousePress(). If nothing is selected, this was
+// a click that just moved the cursor.
+func (self *Readline) MouseRelease(row, column int) bool {
+	if !self.mouse_release(row, column) {
+		return false
+	}
+	self.Redraw()
+	return true
+}
+
+func (self *Readline) GoToLine(line int) {
+	self.GoToPosition(line, 0)
+}
+
+// Whether every non-blank line of the input is a comment, that is, starts
+// with RlInit.CommentStart. Such input can be added to the history without
+// being executed. Always false if no comment start is set.
+func (self *Readline) InputIsComment() bool {
+	found := false
+	for _, line := range self.input_state.lines {
+		if strings.TrimSpace(line) != "" {
+			if !self.is_comment_line(line) {
+				return false
+			}
+			found = true
+		}
+	}
+	return found
 }
 
 func (self *Readline) TextBeforeCursor() string {
@@ -254,10 +1080,59 @@ func (self *Readline) AllText() string {
 	return self.all_text()
 }
 
+// The text to use for accepted input, AllText() trimmed as specified by
+// RlInit.TrimAcceptedText. Add AllText() to the history to keep it as typed.
+func (self *Readline) AcceptedText() string {
+	return self.trim_accepted_text.trim(self.all_text())
+}
+
+func (self *Readline) CurrentLine() string {
+	return self.input_state.lines[self.input_state.cursor.Y]
+}
+
+func (self *Readline) CurrentLineBeforeCursor() string {
+	line := self.input_state.lines[self.input_state.cursor.Y]
+	return line[:utils.Min(len(line), self.input_state.cursor.X)]
+}
+
+func (self *Readline) CurrentLineAfterCursor() string {
+	line := self.input_state.lines[self.input_state.cursor.Y]
+	return line[utils.Min(len(line), self.input_state.cursor.X):]
+}
+
 func (self *Readline) MoveCursorToEnd() bool {
 	return self.move_to_end()
 }
 
+func (self *Readline) CursorPosition() Position {
+	return self.input_state.cursor
+}
+
+// The byte offset of the cursor in AllText(), where lines are joined by a
+// single newline
+func (self *Readline) CursorByteOffset() int {
+	return position_to_offset(self.input_state.lines, self.input_state.cursor)
+}
+
+// The number of cells line y of the input takes up when drawn, with tabs
+// expanded and ambiguous width characters measured as they are drawn. -1 if
+// there is no such line.
+func (self *Readline) LineWidth(y int) int {
+	if y < 0 || y >= len(self.input_state.lines) {
+		return -1
+	}
+	line := self.input_state.lines[y]
+	return self.visual_column(line, len(line))
+}
+
+// The width in cells of the widest line of the input, see LineWidth()
+func (self *Readline) TextWidth() (ans int) {
+	for y := range self.input_state.lines {
+		ans = utils.Max(ans, self.LineWidth(y))
+	}
+	return
+}
+
 func (self *Readline) CursorAtEndOfLine() bool {
 	return self.input_state.cursor.X >= len(self.input_state.lines[self.input_state.cursor.Y])
 }
@@ -0,0 +1,76 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package readline
+
+import (
+	"fmt"
+	"strings"
+
+	"kitty/tools/utils"
+	"kitty/tools/utils/shlex"
+)
+
+var _ = fmt.Print
+
+// The arguments of previously accepted commands, most recently used first,
+// and the one currently inserted at the cursor when cycling through them
+type argument_history struct {
+	items   []string
+	current int
+	extent  struct {
+		start, end Position
+	}
+}
+
+// The arguments, that is all words except the first, of the commands in the
+// history, most recent first and without duplicates
+func (self *History) arguments() []string {
+	items := self.all_items()
+	seen := make(map[string]bool, len(items))
+	ans := make([]string, 0, len(items))
+	for i := len(items) - 1; i >= 0; i-- {
+		words, err := shlex.Split(items[i].Cmd)
+		if err != nil {
+			words = strings.Fields(items[i].Cmd)
+		}
+		for j := len(words) - 1; j > 0; j-- {
+			if w := words[j]; w != "" && !seen[w] {
+				seen[w] = true
+				ans = append(ans, w)
+			}
+		}
+	}
+	return ans
+}
+
+// Insert an argument from the argument history at the cursor. Repeating
+// the action replaces it with the next older argument, a negative amt moves
+// towards newer arguments.
+func (self *Readline) cycle_argument_history(amt int) bool {
+	ah := &self.argument_history
+	in_cycle := (self.last_action == ActionPreviousArgument || self.last_action == ActionNextArgument) && len(ah.items) > 0
+	if !in_cycle {
+		if amt < 0 {
+			return false
+		}
+		ah.items = self.history.arguments()
+		if len(ah.items) == 0 {
+			return false
+		}
+		ah.current = (amt - 1) % len(ah.items)
+	} else {
+		ah.current = ((ah.current+amt)%len(ah.items) + len(ah.items)) % len(ah.items)
+		self.ensure_position_in_bounds(&ah.extent.start)
+		self.ensure_position_in_bounds(&ah.extent.end)
+		self.erase_between(ah.extent.start, ah.extent.end)
+		self.input_state.cursor = ah.extent.start
+	}
+	arg := ah.items[ah.current]
+	if utils.EscapeSHMetaCharacters(arg) != arg {
+		arg = utils.QuoteStringForSH(arg)
+	}
+	ah.extent.start = self.input_state.cursor
+	self.add_text(arg)
+	ah.extent.end = self.input_state.cursor
+	return true
+}
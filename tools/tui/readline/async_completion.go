@@ -0,0 +1,65 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package readline
+
+import (
+	"fmt"
+
+	"kitty/tools/cli"
+)
+
+var _ = fmt.Print
+
+// Called to start fetching completions in the background. When they are
+// ready, pass them along with generation to Readline.SetCompletions() from
+// the loop's goroutine.
+type AsyncCompleterFunction = func(before_cursor, after_cursor string, generation uint64)
+
+type pending_completion struct {
+	generation                  uint64
+	before_cursor, after_cursor string
+	forwards, menu              bool
+	// Only display the candidates, as for automatically triggered completion
+	list_only bool
+	// The generation of the spinner shown while waiting, zero if a spinner
+	// started by someone else was already being shown
+	spinner uint64
+}
+
+func (self *Readline) request_async_completions(before, after string, forwards, menu, list_only bool) {
+	c := &self.completions
+	self.dismiss_completions()
+	c.generation++
+	c.pending = &pending_completion{generation: c.generation, before_cursor: before, after_cursor: after, forwards: forwards, menu: menu, list_only: list_only}
+	if self.spinner.spinner == nil {
+		c.pending.spinner = self.start_spinner("Completing…")
+	}
+	c.async_completer(before, after, c.generation)
+}
+
+// Returns false if the results are stale, that is, they are for an older
+// request or the text around the cursor has changed since they were
+// requested
+func (self *Readline) set_completions(generation uint64, results *cli.Completions) bool {
+	c := &self.completions
+	p := c.pending
+	if p == nil || p.generation != generation {
+		return false
+	}
+	c.pending = nil
+	self.stop_spinner_if_current(p.spinner)
+	if p.before_cursor != self.text_upto_cursor_pos() || p.after_cursor != self.text_after_cursor_pos() {
+		return false
+	}
+	if !self.list_completions(p.before_cursor, p.after_cursor, results, p.forwards, p.menu, p.list_only) {
+		return false
+	}
+	if p.list_only {
+		return true
+	}
+	if self.insert_current_completion(p.forwards) && c.current.num_of_matches > 0 {
+		return true
+	}
+	self.beep()
+	return false
+}
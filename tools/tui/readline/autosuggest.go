@@ -0,0 +1,181 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package readline
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"kitty/tools/tui/loop"
+	"kitty/tools/wcswidth"
+)
+
+var _ = fmt.Print
+
+type autosuggestion struct {
+	enabled bool
+	// The history entry being suggested and the input text it was last
+	// matched against. The suggestion is kept as long as the input only
+	// grows towards it, so accepting it in parts does not switch to a
+	// different entry.
+	source, for_text string
+
+	// Lookups scan at most max_scan of the most recent history entries, are
+	// skipped for text shorter than min_length characters and are done only
+	// after typing pauses for delay
+	max_scan, min_length int
+	delay                time.Duration
+	timer_id             loop.IdType
+	// The results of previous lookups, valid while the history is unchanged
+	cache               map[string]string
+	cache_num_items     int
+	cache_last_item_cmd string
+}
+
+const max_autosuggestion_cache_size = 256
+
+// Forget the current suggestion, keeping the configuration and cached lookups
+func (self *Readline) reset_autosuggestion() {
+	a := &self.autosuggestion
+	if a.timer_id != 0 {
+		self.remove_timer(a.timer_id)
+	}
+	self.autosuggestion = autosuggestion{
+		enabled: a.enabled, max_scan: a.max_scan, min_length: a.min_length, delay: a.delay,
+		cache: a.cache, cache_num_items: a.cache_num_items, cache_last_item_cmd: a.cache_last_item_cmd,
+	}
+}
+
+func (self *Readline) cached_autosuggestion(text string) (string, bool) {
+	a := &self.autosuggestion
+	items := self.history.all_items()
+	last_cmd := ""
+	if len(items) > 0 {
+		last_cmd = items[len(items)-1].Cmd
+	}
+	if a.cache == nil || len(a.cache) >= max_autosuggestion_cache_size || a.cache_num_items != len(items) || a.cache_last_item_cmd != last_cmd {
+		a.cache = make(map[string]string)
+		a.cache_num_items, a.cache_last_item_cmd = len(items), last_cmd
+	}
+	ans, found := a.cache[text]
+	return ans, found
+}
+
+// Find the most recent history entry that text is a proper prefix of
+func (self *Readline) lookup_autosuggestion(text string) string {
+	if ans, found := self.cached_autosuggestion(text); found {
+		return ans
+	}
+	a := &self.autosuggestion
+	items := self.history.all_items()
+	limit := 0
+	if a.max_scan > 0 {
+		limit = len(items) - a.max_scan
+	}
+	ans := ""
+	for i := len(items) - 1; i >= 0 && i >= limit; i-- {
+		cmd := items[i].Cmd
+		if len(cmd) > len(text) && has_prefix(cmd, text, self.history_search_ignore_case) {
+			ans = cmd
+			break
+		}
+	}
+	a.cache[text] = ans
+	return ans
+}
+
+func (self *Readline) on_autosuggestion_timer(loop.IdType) error {
+	a := &self.autosuggestion
+	a.timer_id = 0
+	if text := self.all_text(); text == a.for_text && a.source == "" {
+		if a.source = self.lookup_autosuggestion(text); a.source != "" {
+			self.Redraw()
+		}
+	}
+	return nil
+}
+
+func (self *Readline) find_autosuggestion(text string) string {
+	a := &self.autosuggestion
+	if a.source != "" && len(a.source) > len(text) && has_prefix(a.source, text, self.history_search_ignore_case) && strings.HasPrefix(text, a.for_text) {
+		a.for_text = text
+		return a.source
+	}
+	if a.source == "" && a.for_text == text {
+		return ""
+	}
+	a.source, a.for_text = "", text
+	if utf8.RuneCountInString(text) < a.min_length {
+		return ""
+	}
+	if a.delay > 0 {
+		if ans, found := self.cached_autosuggestion(text); found {
+			a.source = ans
+			return ans
+		}
+		if a.timer_id != 0 {
+			self.remove_timer(a.timer_id)
+			a.timer_id = 0
+		}
+		if id, err := self.add_timer(a.delay, false, self.on_autosuggestion_timer); err == nil {
+			a.timer_id = id
+			return ""
+		}
+	}
+	a.source = self.lookup_autosuggestion(text)
+	return a.source
+}
+
+// The text of the current autosuggestion that would be added to the end of
+// the current input, empty if there is no suggestion.
+func (self *Readline) current_autosuggestion() string {
+	if !self.autosuggestion.enabled || self.history_search != nil {
+		return ""
+	}
+	if self.input_state.cursor.Y != len(self.input_state.lines)-1 || self.input_state.cursor.X != len(self.input_state.lines[self.input_state.cursor.Y]) {
+		return ""
+	}
+	text := self.all_text()
+	if text == "" {
+		return ""
+	}
+	if src := self.find_autosuggestion(text); src != "" {
+		return src[len(text):]
+	}
+	return ""
+}
+
+func (self *Readline) accept_autosuggestion() bool {
+	s := self.current_autosuggestion()
+	if s == "" {
+		return false
+	}
+	self.add_text(s)
+	return true
+}
+
+func (self *Readline) accept_autosuggestion_word(amt uint) bool {
+	s := self.current_autosuggestion()
+	if s == "" || amt == 0 {
+		return false
+	}
+	in_word := false
+	sz := 0
+	ci := wcswidth.NewCellIterator(s)
+	for ci.Forward() {
+		if has_word_chars(ci.Current()) {
+			in_word = true
+		} else if in_word {
+			amt--
+			if amt == 0 {
+				break
+			}
+			in_word = false
+		}
+		sz += len(ci.Current())
+	}
+	self.add_text(s[:sz])
+	return true
+}
@@ -0,0 +1,113 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package readline
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+var _ = fmt.Print
+
+// Configuration for a simple check of whether the input has unclosed brackets
+// or quotes, in which case accepting the input inserts a newline instead.
+type BalanceCheck struct {
+	// Pairs of opening and closing characters, defaults to ()[]{}
+	Pairs string
+	// Characters that start and end quoted text, defaults to "'`
+	Quotes string
+	// The indent added for every unclosed bracket, defaults to four spaces
+	Indent string
+}
+
+// Lines starting with comment_start outside quoted text are ignored, so that
+// brackets and quotes in them do not count
+func (self *BalanceCheck) unclosed(text, comment_start string) (open_brackets int, in_quote bool) {
+	pairs, quotes := []rune(self.Pairs), self.Quotes
+	if len(pairs) == 0 {
+		pairs = []rune("()[]{}")
+	}
+	if quotes == "" {
+		quotes = "\"'`"
+	}
+	stack := make([]rune, 0, 8)
+	var quote rune
+	escaped := false
+	check := func(ch rune) {
+		if quote != 0 {
+			switch {
+			case escaped:
+				escaped = false
+			case ch == '\\':
+				escaped = true
+			case ch == quote:
+				quote = 0
+			}
+			return
+		}
+		if strings.ContainsRune(quotes, ch) {
+			quote = ch
+			return
+		}
+		for i := 0; i+1 < len(pairs); i += 2 {
+			if ch == pairs[i] {
+				stack = append(stack, pairs[i+1])
+				break
+			}
+			if ch == pairs[i+1] {
+				if len(stack) > 0 && stack[len(stack)-1] == ch {
+					stack = stack[:len(stack)-1]
+				}
+				break
+			}
+		}
+	}
+	for i, line := range strings.Split(text, "\n") {
+		if i > 0 {
+			check('\n')
+		}
+		if quote == 0 && is_comment_line(line, comment_start) {
+			continue
+		}
+		for _, ch := range line {
+			check(ch)
+		}
+	}
+	return len(stack), quote != 0
+}
+
+func (self *BalanceCheck) indent(open_brackets int) string {
+	indent := self.Indent
+	if indent == "" {
+		indent = "    "
+	}
+	return strings.Repeat(indent, open_brackets)
+}
+
+// Whether line starts with comment_start, ignoring leading whitespace
+func is_comment_line(line, comment_start string) bool {
+	return comment_start != "" && strings.HasPrefix(strings.TrimLeftFunc(line, unicode.IsSpace), comment_start)
+}
+
+// Whether line starts with the comment prefix, ignoring leading whitespace
+func (self *Readline) is_comment_line(line string) bool {
+	return is_comment_line(line, self.comment_start)
+}
+
+// Insert a newline if the input is incomplete, returns false if the input
+// is balanced and should be accepted
+func (self *Readline) continue_incomplete_input() bool {
+	if self.balance_check == nil {
+		return false
+	}
+	if n, q := self.balance_check.unclosed(self.all_text(), self.comment_start); n == 0 && !q {
+		return false
+	}
+	text := "\n"
+	if n, q := self.balance_check.unclosed(self.text_upto_cursor_pos(), self.comment_start); !q {
+		text += self.balance_check.indent(n)
+	}
+	self.add_text(text)
+	return true
+}
@@ -0,0 +1,202 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package readline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"kitty/tools/tui/loop"
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// Run command with the user's shell, returning its output. Its stdin is
+// input, never the terminal, so it cannot interfere with the loop. The
+// command is killed if ctx is cancelled.
+func run_shell_command(ctx context.Context, command, input string) (string, error) {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	cmd := exec.CommandContext(ctx, shell, "-c", command)
+	if input != "" {
+		cmd.Stdin = strings.NewReader(input)
+	}
+	// run in a process group of its own so that the children of the shell,
+	// which keep its output open, are killed along with it
+	cmd.SysProcAttr = &unix.SysProcAttr{Setpgid: true}
+	stdout, stderr := bytes.Buffer{}, bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Start()
+	if err != nil {
+		return "", err
+	}
+	finished := make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = unix.Kill(-cmd.Process.Pid, unix.SIGKILL)
+		case <-finished:
+		}
+	}()
+	err = cmd.Wait()
+	close(finished)
+	if err != nil {
+		var ee *exec.ExitError
+		if errors.As(err, &ee) {
+			msg, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n")
+			if msg == "" {
+				msg = fmt.Sprintf("exit code %d", ee.ExitCode())
+			}
+			err = fmt.Errorf("%s", msg)
+		}
+		return "", err
+	}
+	return utils.UnsafeBytesToString(stdout.Bytes()), nil
+}
+
+// A shell command running in the background, while it runs key presses
+// other than those that cancel it are ignored
+type running_command struct {
+	cancel    context.CancelFunc
+	on_finish func(output string, err error)
+	output    string
+	err       error
+	// closed once output and err are set
+	done chan bool
+}
+
+// Run command in a goroutine with a spinner, calling on_finish with its
+// output on the loop's goroutine when it is done, unless it is cancelled
+// first. Without a loop the command is run synchronously.
+func (self *Readline) run_command_in_background(command, input string, on_finish func(output string, err error)) {
+	self.cancel_running_command()
+	if self.loop == nil {
+		on_finish(run_shell_command(context.Background(), command, input))
+		self.record_text_change()
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	rc := &running_command{cancel: cancel, done: make(chan bool), on_finish: on_finish}
+	self.running_command = rc
+	self.start_spinner("Running: " + command + " (ctrl+c to cancel)")
+	lp := self.loop
+	go func() {
+		rc.output, rc.err = run_shell_command(ctx, command, input)
+		close(rc.done)
+		lp.CallOnMainThread(func() error {
+			self.finish_running_command(rc)
+			return nil
+		})
+	}()
+}
+
+// Must be called on the loop's goroutine after rc.done is closed. Does
+// nothing if rc was cancelled.
+func (self *Readline) finish_running_command(rc *running_command) {
+	if self.running_command != rc {
+		return
+	}
+	self.running_command = nil
+	rc.cancel()
+	self.stop_spinner()
+	rc.on_finish(rc.output, rc.err)
+	self.record_text_change()
+	self.Redraw()
+}
+
+// Kill the running command, if any, discarding its output
+func (self *Readline) cancel_running_command() bool {
+	rc := self.running_command
+	if rc == nil {
+		return false
+	}
+	self.running_command = nil
+	rc.cancel()
+	self.stop_spinner()
+	return true
+}
+
+func (self *Readline) handle_key_while_running_command(event *loop.KeyEvent) bool {
+	if self.running_command == nil {
+		return false
+	}
+	event.Handled = true
+	if event.MatchesPressOrRepeat("ctrl+c") || event.MatchesPressOrRepeat("ctrl+g") {
+		self.cancel_running_command()
+		self.show_message("Command cancelled")
+		self.Redraw()
+	}
+	return true
+}
+
+func (self *Readline) show_command_failure(err error) {
+	self.show_message("Command failed: " + err.Error())
+	self.beep()
+}
+
+func (self *Readline) insert_command_output(command string) {
+	self.run_command_in_background(command, "", func(output string, err error) {
+		if err != nil {
+			self.show_command_failure(err)
+			return
+		}
+		if !self.keep_output_newline {
+			output = strings.TrimRight(output, "\n")
+		}
+		self.add_text(SanitizePastedText(output))
+	})
+}
+
+func (self *Readline) start_insert_command_output() {
+	self.read_string("Insert output of: ", "", func(command string) error {
+		if strings.TrimSpace(command) != "" {
+			self.insert_command_output(command)
+		}
+		return nil
+	})
+}
+
+// Replace the text between the offsets start and end with the output of
+// command run with that text as its input, like ! in vi. The text is left
+// unchanged if the command fails.
+func (self *Readline) filter_through_command(command string, start, end int) {
+	input := self.all_text()[start:end]
+	no_final_newline := !strings.HasSuffix(input, "\n")
+	if no_final_newline {
+		input += "\n"
+	}
+	self.run_command_in_background(command, input, func(output string, err error) {
+		if err != nil {
+			self.show_command_failure(err)
+			return
+		}
+		if no_final_newline {
+			output = strings.TrimSuffix(output, "\n")
+		}
+		self.replace_range(start, end, SanitizePastedText(output))
+	})
+}
+
+// Filter the active region or, if there is none, all the text
+func (self *Readline) start_filter_through_command() {
+	start, end := len(self.protected_prefix), len(self.all_text())
+	if rs, re, ok := self.active_region(); ok {
+		start, end = position_to_offset(self.input_state.lines, rs), position_to_offset(self.input_state.lines, re)
+	}
+	self.read_string("Filter through: ", "", func(command string) error {
+		if strings.TrimSpace(command) != "" {
+			self.filter_through_command(command, start, end)
+		}
+		return nil
+	})
+}
@@ -5,10 +5,12 @@ package readline
 import (
 	"fmt"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"kitty/tools/cli"
+	"kitty/tools/tui/loop"
 	"kitty/tools/utils"
-	"kitty/tools/wcswidth"
 )
 
 var _ = fmt.Print
@@ -21,6 +23,13 @@ type completion struct {
 	rendered_at_screen_width      int
 	rendered_lines                []string
 	last_rendered_above           bool
+	fuzzy_query                   string
+	// Cycle through the candidates inline without displaying them
+	menu bool
+	// Paging through a list of candidates too long to display at once
+	awaiting_display_confirmation, keyboard_map_pushed bool
+	page                                               int
+	no_space_after_single                              bool
 }
 
 func (self *completion) initialize() {
@@ -46,7 +55,7 @@ func (self *completion) current_match_text() string {
 			for _, m := range g.Matches {
 				if i == self.current_match {
 					t := m.Word
-					if !g.NoTrailingSpace {
+					if !g.NoTrailingSpace && !(self.no_space_after_single && self.num_of_matches == 1) {
 						t += " "
 					}
 					return t
@@ -59,18 +68,66 @@ func (self *completion) current_match_text() string {
 }
 
 type completions struct {
-	completer CompleterFunction
-	current   completion
+	completer     CompleterFunction
+	current       completion
+	menu_complete bool
+	max_displayed int
+	// Policy for when there is only a single candidate
+	show_single, no_space_after_single bool
+	async_completer                    AsyncCompleterFunction
+	// The async request whose results are awaited, if any
+	pending    *pending_completion
+	generation uint64
+	// Typing one of these characters lists the candidates automatically,
+	// after the delay, if the input is unchanged by then
+	trigger_characters                          string
+	trigger_delay                               time.Duration
+	trigger_timer_id                            loop.IdType
+	trigger_before_cursor, trigger_after_cursor string
+	// The characters that separate the word to be completed from the text
+	// before it
+	word_breaks string
 }
 
-func (self *Readline) complete(forwards bool, repeat_count uint) bool {
+// Like COMP_WORDBREAKS in bash, so that, for example, the value of
+// --option=value is completed separately from the option name
+const DefaultCompletionWordBreaks = " \t\n\"'><=;|&(:"
+
+// The start of the word that ends text. A break character escaped by a
+// backslash is part of the word.
+func completion_word_start(text, word_breaks string) int {
+	start := 0
+	escaped := false
+	for i, ch := range text {
+		switch {
+		case escaped:
+			escaped = false
+		case ch == '\\':
+			escaped = true
+		case ch == '\n' || strings.ContainsRune(word_breaks, ch):
+			start = i + utf8.RuneLen(ch)
+		}
+	}
+	return start
+}
+
+func is_completion_action(ac Action) bool {
+	switch ac {
+	case ActionCompleteForward, ActionCompleteBackward, ActionMenuComplete, ActionMenuCompleteBackward, ActionShowMoreCompletions,
+		ActionPossibleCompletions:
+		return true
+	}
+	return false
+}
+
+func (self *Readline) complete(forwards bool, repeat_count uint, menu bool) bool {
 	c := &self.completions
-	if c.completer == nil {
+	if c.completer == nil && c.async_completer == nil {
 		return false
 	}
-	if self.last_action == ActionCompleteForward || self.last_action == ActionCompleteBackward {
+	if is_completion_action(self.last_action) {
 		if c.current.num_of_matches == 0 {
-			return false
+			return c.pending != nil
 		}
 		delta := -1
 		if forwards {
@@ -81,48 +138,105 @@ func (self *Readline) complete(forwards bool, repeat_count uint) bool {
 		c.current.current_match = (c.current.current_match + delta + c.current.num_of_matches) % c.current.num_of_matches
 		repeat_count = 0
 	} else {
-		before, after := self.text_upto_cursor_pos(), self.text_after_cursor_pos()
-		c.current = completion{before_cursor: before, after_cursor: after, forwards: forwards, results: c.completer(before, after)}
-		c.current.initialize()
+		if self.request_completions(forwards, menu, false) {
+			// the completion is inserted when the results arrive
+			return true
+		}
 		if repeat_count > 0 {
 			repeat_count--
 		}
-		if c.current.current_match != 0 {
-			if self.loop != nil {
-				self.loop.Beep()
-			}
+	}
+	if !self.insert_current_completion(forwards) {
+		return false
+	}
+	if repeat_count > 0 {
+		self.complete(forwards, repeat_count, menu)
+	}
+	return true
+}
+
+// Ask the completer for the candidates for the word at the cursor, see
+// list_completions(). Returns true if the results will arrive asynchronously.
+func (self *Readline) request_completions(forwards, menu, list_only bool) bool {
+	c := &self.completions
+	before, after := self.text_upto_cursor_pos(), self.text_after_cursor_pos()
+	if c.async_completer != nil {
+		self.request_async_completions(before, after, forwards, menu, list_only)
+		return true
+	}
+	self.list_completions(before, after, c.completer(before, after), forwards, menu, list_only)
+	return false
+}
+
+// Make results the current completion. When list_only is true every
+// candidate is listed, even a single one, and none is selected for insertion,
+// in which case false is returned if there are no candidates.
+func (self *Readline) list_completions(before, after string, results *cli.Completions, forwards, menu, list_only bool) bool {
+	c := &self.completions
+	c.current = completion{
+		before_cursor: before, after_cursor: after, forwards: forwards, results: results, menu: menu,
+		no_space_after_single: c.no_space_after_single,
+	}
+	if self.fuzzy_matching {
+		self.fuzzy_filter_completions(&c.current)
+	}
+	c.current.initialize()
+	switch {
+	case list_only:
+		if c.current.num_of_matches == 0 {
+			return false
+		}
+		c.current.current_match = -1
+	case c.current.num_of_matches == 1 && c.show_single && !menu:
+		c.current.current_match = -1
+	case menu && c.current.num_of_matches > 1:
+		if forwards {
+			c.current.current_match = 0
+		} else {
+			c.current.current_match = c.current.num_of_matches - 1
 		}
 	}
+	if c.current.current_match != 0 && !menu {
+		if !list_only {
+			self.beep()
+		}
+		if c.max_displayed > 0 && c.current.num_of_matches > c.max_displayed {
+			c.current.awaiting_display_confirmation = true
+			self.push_keyboard_map(completion_paging_shortcuts())
+			c.current.keyboard_map_pushed = true
+		}
+	}
+	return true
+}
+
+func (self *Readline) insert_current_completion(forwards bool) bool {
+	c := &self.completions
 	c.current.forwards = forwards
 	if c.current.results == nil {
 		return false
 	}
 	ct := c.current.current_match_text()
 	if ct != "" {
-		before := c.current.before_cursor[:c.current.results.CurrentWordIdx] + ct
-		after := c.current.after_cursor
-		self.input_state.lines = utils.Splitlines(before)
-		if len(self.input_state.lines) == 0 {
-			self.input_state.lines = []string{""}
-		}
-		self.input_state.cursor.Y = len(self.input_state.lines) - 1
-		self.input_state.cursor.X = len(self.input_state.lines[self.input_state.cursor.Y])
-		al := utils.Splitlines(after)
-		if len(al) > 0 {
-			self.input_state.lines[self.input_state.cursor.Y] += al[0]
-			self.input_state.lines = append(self.input_state.lines, al[1:]...)
-		}
-	}
-	if repeat_count > 0 {
-		self.complete(forwards, repeat_count)
+		lines := strings.Split(c.current.before_cursor[:c.current.results.CurrentWordIdx], "\n")
+		start := Position{Y: len(lines) - 1, X: len(lines[len(lines)-1])}
+		self.replace_text_before_cursor(start, ct)
 	}
 	return true
 }
 
+// List the candidates for the word at the cursor without inserting anything
+func (self *Readline) possible_completions() bool {
+	c := &self.completions
+	if c.completer == nil && c.async_completer == nil {
+		return false
+	}
+	return self.request_completions(true, false, true) || c.current.num_of_matches > 0
+}
+
 func (self *Readline) screen_lines_for_match_group_with_descriptions(g *cli.MatchGroup, lines []string) []string {
 	maxw := 0
 	for _, m := range g.Matches {
-		l := wcswidth.Stringwidth(m.Word)
+		l := self.stringwidth(m.DisplayText())
 		if l > 16 {
 			maxw = 16
 			break
@@ -132,11 +246,42 @@ func (self *Readline) screen_lines_for_match_group_with_descriptions(g *cli.Matc
 		}
 	}
 	for _, m := range g.Matches {
-		lines = append(lines, utils.Splitlines(m.FormatForCompletionList(maxw, self.fmt_ctx, self.screen_width))...)
+		lines = append(lines, self.format_completion_with_description(m, maxw)...)
 	}
 	return lines
 }
 
+// Render the candidate with its description dimmed in a second column
+// aligned at max_word_len. Candidates longer than that have their
+// description on the next line.
+func (self *Readline) format_completion_with_description(m *cli.Match, max_word_len int) []string {
+	word := self.highlight_fuzzy_completion(m.DisplayText(), self.completions.current.fuzzy_query)
+	desc, _, _ := utils.Cut(strings.TrimSpace(m.Description), "\n")
+	if desc == "" {
+		return []string{self.truncate_to_visual_length(word, self.screen_width)}
+	}
+	desc = self.fmt_ctx.Prettify(desc)
+	word_len := self.stringwidth(word)
+	available := self.screen_width - max_word_len - 2
+	if available < 1 {
+		return []string{self.truncate_to_visual_length(word, self.screen_width)}
+	}
+	if self.stringwidth(desc) > available {
+		// the ellipsis is two cells wide when ambiguous characters are
+		ellipsis := "…"
+		ew := self.stringwidth(ellipsis)
+		if ew > available {
+			ellipsis, ew = "", 0
+		}
+		desc = self.truncate_to_visual_length(desc, available-ew) + ellipsis
+	}
+	desc = self.fmt_ctx.Dim(desc)
+	if word_len > max_word_len {
+		return []string{self.truncate_to_visual_length(word, self.screen_width), strings.Repeat(" ", max_word_len+2) + desc}
+	}
+	return []string{word + strings.Repeat(" ", max_word_len-word_len+2) + desc}
+}
+
 type cell struct {
 	text   string
 	length int
@@ -196,8 +341,8 @@ func (self *Readline) screen_lines_for_match_group_without_descriptions(g *cli.M
 	lengths := make(map[string]int, len(words))
 	max_length := 0
 	for i, m := range g.Matches {
-		words[i] = m.Word
-		l := wcswidth.Stringwidth(words[i])
+		words[i] = self.highlight_fuzzy_completion(m.DisplayText(), self.completions.current.fuzzy_query)
+		l := self.stringwidth(words[i])
 		lengths[words[i]] = l
 		if l > max_length {
 			max_length = l
@@ -216,7 +361,7 @@ func (self *Readline) screen_lines_for_match_group_without_descriptions(g *cli.M
 	if ans == nil {
 		for _, w := range words {
 			if lengths[w] > self.screen_width {
-				lines = append(lines, wcswidth.TruncateToVisualLength(w, self.screen_width))
+				lines = append(lines, self.truncate_to_visual_length(w, self.screen_width))
 			} else {
 				lines = append(lines, w)
 			}
@@ -239,7 +384,8 @@ func (self *Readline) screen_lines_for_match_group_without_descriptions(g *cli.M
 }
 
 func (self *Readline) completion_screen_lines() ([]string, bool) {
-	if self.completions.current.results == nil || self.completions.current.num_of_matches < 2 {
+	c := &self.completions.current
+	if c.results == nil || c.num_of_matches < 1 || (c.num_of_matches == 1 && c.current_match == 0) || c.menu || c.awaiting_display_confirmation {
 		return []string{}, false
 	}
 	if len(self.completions.current.rendered_lines) > 0 && self.completions.current.rendered_at_screen_width == self.screen_width {
@@ -267,3 +413,116 @@ func (self *Readline) completion_screen_lines() ([]string, bool) {
 	self.completions.current.rendered_at_screen_width = self.screen_width
 	return lines, false
 }
+
+func (self *Readline) completion_page_size() int {
+	if self.completions.max_displayed < 1 {
+		return 0
+	}
+	if self.screen_width == 0 || self.screen_height == 0 {
+		self.update_current_screen_size()
+	}
+	ans := self.screen_height - len(self.get_screen_lines()) - self.prompt_banner_rows() - 1
+	if self.hints.below_input && self.current_hint() != "" {
+		ans--
+	}
+	return utils.Max(1, ans)
+}
+
+// The lines of the current page of completions and whether there are more
+// pages after it
+func (self *Readline) completion_page(lines []string) ([]string, bool) {
+	ps := self.completion_page_size()
+	if ps < 1 || len(lines) <= ps {
+		return lines, false
+	}
+	start := utils.Min(self.completions.current.page*ps, len(lines)-1)
+	end := utils.Min(start+ps, len(lines))
+	return lines[start:end], end < len(lines)
+}
+
+func (self *Readline) show_more_completions() bool {
+	c := &self.completions.current
+	if c.results == nil {
+		return false
+	}
+	lines, _ := self.completion_screen_lines()
+	if c.awaiting_display_confirmation {
+		c.awaiting_display_confirmation = false
+		lines, _ = self.completion_screen_lines()
+	} else {
+		if _, has_more := self.completion_page(lines); !has_more {
+			return false
+		}
+		c.page++
+	}
+	if _, has_more := self.completion_page(lines); !has_more && c.keyboard_map_pushed {
+		self.pop_keyboard_map()
+		c.keyboard_map_pushed = false
+	}
+	return true
+}
+
+func (self *Readline) cancel_completion_trigger() {
+	c := &self.completions
+	if c.trigger_timer_id != 0 {
+		self.remove_timer(c.trigger_timer_id)
+		c.trigger_timer_id = 0
+	}
+}
+
+// Called after text is typed, lists the candidates if the text ends with a
+// trigger character
+func (self *Readline) check_completion_trigger(text string) {
+	c := &self.completions
+	self.cancel_completion_trigger()
+	if c.trigger_characters == "" || (c.completer == nil && c.async_completer == nil) || text == "" || self.history_search != nil {
+		return
+	}
+	if last, _ := utf8.DecodeLastRuneInString(text); !strings.ContainsRune(c.trigger_characters, last) {
+		return
+	}
+	if c.trigger_delay > 0 {
+		c.trigger_before_cursor, c.trigger_after_cursor = self.text_upto_cursor_pos(), self.text_after_cursor_pos()
+		if id, err := self.add_timer(c.trigger_delay, false, self.on_completion_trigger_timer); err == nil {
+			c.trigger_timer_id = id
+			return
+		}
+	}
+	self.trigger_completion()
+}
+
+func (self *Readline) on_completion_trigger_timer(loop.IdType) error {
+	c := &self.completions
+	c.trigger_timer_id = 0
+	if c.trigger_before_cursor == self.text_upto_cursor_pos() && c.trigger_after_cursor == self.text_after_cursor_pos() && self.history_search == nil {
+		self.trigger_completion()
+		self.Redraw()
+	}
+	return nil
+}
+
+func (self *Readline) trigger_completion() {
+	self.request_completions(true, false, true)
+}
+
+func (self *Readline) dismiss_completions() {
+	if self.completions.current.keyboard_map_pushed {
+		self.pop_keyboard_map()
+	}
+	self.completions.current = completion{}
+	if p := self.completions.pending; p != nil {
+		self.completions.pending = nil
+		self.stop_spinner_if_current(p.spinner)
+	}
+}
+
+func (self *Readline) completions_message() string {
+	c := &self.completions.current
+	if c.awaiting_display_confirmation {
+		return fmt.Sprintf("Display all %d possibilities? (y or n)", c.num_of_matches)
+	}
+	if c.keyboard_map_pushed {
+		return "--More--"
+	}
+	return ""
+}
@@ -35,6 +35,7 @@ type ScreenLine struct {
 	TextLengthInCells, CursorCell, CursorTextPos int
 	Text                                         string
 	AfterLineBreak                               bool
+	ScrolledCells                                int
 }
 
 func (self *Readline) format_arg_prompt(cna string) string {
@@ -43,16 +44,22 @@ func (self *Readline) format_arg_prompt(cna string) string {
 
 func (self *Readline) prompt_for_line_number(i int) Prompt {
 	is_line_with_cursor := i == self.input_state.cursor.Y
-	if is_line_with_cursor && self.keyboard_state.current_numeric_argument != "" {
-		return self.make_prompt(self.format_arg_prompt(self.keyboard_state.current_numeric_argument), i > 0)
+	var ans Prompt
+	switch {
+	case is_line_with_cursor && self.keyboard_state.current_numeric_argument != "":
+		ans = self.make_prompt(self.format_arg_prompt(self.keyboard_state.current_numeric_argument), i > 0)
+	case i > 0:
+		return self.continuation_prompt
+	case self.history_search != nil:
+		ans = self.make_prompt(self.history_search_prompt(), false)
+	default:
+		return self.prompt
 	}
 	if i == 0 {
-		if self.history_search != nil {
-			return self.make_prompt(self.history_search_prompt(), i > 0)
-		}
-		return self.prompt
+		// keep the banner of a multi-row prompt when the prompt is replaced
+		ans.Banner = self.prompt.Banner
 	}
-	return self.continuation_prompt
+	return ans
 }
 
 func (self *Readline) apply_syntax_highlighting() (lines []string, cursor Position) {
@@ -61,6 +68,12 @@ func (self *Readline) apply_syntax_highlighting() (lines []string, cursor Positi
 	if self.history_search != nil {
 		highlighter = self.history_search_highlighter
 		highlighter_name = "## history ##"
+	} else if self.query_replace != nil {
+		highlighter = self.query_replace_highlighter
+		highlighter_name = fmt.Sprintf("## query replace %d ##", self.query_replace.offset)
+	} else if start, end, ok := self.active_region(); ok && start != end {
+		highlighter = self.region_highlighter(highlighter)
+		highlighter_name = fmt.Sprintf("## region %v %v ##", start, end)
 	}
 	if highlighter == nil {
 		return self.input_state.lines, self.input_state.cursor
@@ -80,25 +93,124 @@ func (self *Readline) apply_syntax_highlighting() (lines []string, cursor Positi
 		}
 	}
 	line := lines[self.input_state.cursor.Y]
-	w := wcswidth.Stringwidth(self.input_state.lines[self.input_state.cursor.Y][:self.input_state.cursor.X])
-	x := len(wcswidth.TruncateToVisualLength(line, w))
+	w := self.stringwidth(self.input_state.lines[self.input_state.cursor.Y][:self.input_state.cursor.X])
+	x := len(self.truncate_to_visual_length(line, w))
 	return lines, Position{X: x, Y: self.input_state.cursor.Y}
 }
 
+// Replace tabs with spaces up to the next tab stop, adjusting the cursor
+// position, which is a byte offset into line, accordingly
+func expand_tabs(line string, cursor_x, tab_width, ambiguous_width int) (string, int) {
+	if !strings.Contains(line, "\t") {
+		return line, cursor_x
+	}
+	buf := strings.Builder{}
+	buf.Grow(len(line) + 16)
+	col, pos, new_cursor_x := 0, 0, cursor_x
+	for {
+		before, after, found := strings.Cut(line, "\t")
+		buf.WriteString(before)
+		if !found {
+			break
+		}
+		col += wcswidth.StringwidthWithAmbiguousWidth(before, ambiguous_width)
+		n := tab_width - col%tab_width
+		buf.WriteString(strings.Repeat(" ", n))
+		col += n
+		pos += len(before)
+		if pos < cursor_x {
+			new_cursor_x += n - 1
+		}
+		pos++
+		line = after
+	}
+	return buf.String(), new_cursor_x
+}
+
+func (self *Readline) expand_tabs(lines []string, cursor Position) ([]string, Position) {
+	var ans []string
+	for i, line := range lines {
+		x := -1
+		if i == cursor.Y {
+			x = cursor.X
+		}
+		if el, ex := expand_tabs(line, x, self.tab_width, self.ambiguous_width); el != line {
+			if ans == nil {
+				ans = make([]string, len(lines))
+				copy(ans, lines)
+			}
+			ans[i] = el
+			if i == cursor.Y {
+				cursor.X = ex
+			}
+		}
+	}
+	if ans == nil {
+		return lines, cursor
+	}
+	return ans, cursor
+}
+
+func (self *Readline) stringwidth(text string) int {
+	return wcswidth.StringwidthWithAmbiguousWidth(text, self.ambiguous_width)
+}
+
+func (self *Readline) truncate_to_visual_length_with_width(text string, length int) (string, int) {
+	return wcswidth.TruncateToVisualLengthWithAmbiguousWidth(text, length, self.ambiguous_width)
+}
+
+func (self *Readline) truncate_to_visual_length(text string, length int) string {
+	ans, _ := self.truncate_to_visual_length_with_width(text, length)
+	return ans
+}
+
+func (self *Readline) current_hint() string {
+	h := &self.hints
+	if h.hinter == nil || self.history_search != nil {
+		return ""
+	}
+	before, after := self.text_upto_cursor_pos(), self.text_after_cursor_pos()
+	if !h.is_valid || before != h.before_cursor || after != h.after_cursor {
+		h.before_cursor, h.after_cursor, h.is_valid = before, after, true
+		h.current, _, _ = utils.Cut(h.hinter(before, after), "\n")
+	}
+	return h.current
+}
+
+// The placeholder is shown only until the input is first edited
+func (self *Readline) current_placeholder() string {
+	if self.placeholder == "" || self.modified || self.history_search != nil || len(self.input_state.lines) > 1 || self.input_state.lines[0] != self.protected_prefix {
+		return ""
+	}
+	placeholder, _, _ := utils.Cut(self.placeholder, "\n")
+	return placeholder
+}
+
 func (self *Readline) get_screen_lines() []*ScreenLine {
 	if self.screen_width == 0 || self.screen_height == 0 {
 		self.update_current_screen_size()
 	}
-	lines, cursor := self.apply_syntax_highlighting()
+	lines, cursor := self.expand_tabs(self.apply_syntax_highlighting())
+	if display, ok := self.recalled_history_display(); ok {
+		dl := utils.Splitlines(display)
+		if len(dl) == 0 {
+			dl = []string{""}
+		}
+		lines, cursor = self.expand_tabs(dl, Position{Y: len(dl) - 1, X: len(dl[len(dl)-1])})
+	}
 	ans := make([]*ScreenLine, 0, len(lines))
 	found_cursor := false
 	cursor_at_start_of_next_line := false
 	for i, line := range lines {
 		prompt := self.prompt_for_line_number(i)
+		if self.horizontal_scroll {
+			ans = append(ans, self.scrolled_screen_line(i, line, prompt, cursor))
+			continue
+		}
 		offset := 0
 		has_cursor := i == cursor.Y
 		for is_first := true; is_first || offset < len(line); is_first = false {
-			l, width := wcswidth.TruncateToVisualLengthWithWidth(line[offset:], self.screen_width-prompt.Length)
+			l, width := self.truncate_to_visual_length_with_width(line[offset:], self.screen_width-prompt.Length)
 			sl := ScreenLine{
 				ParentLineNumber: i, OffsetInParentLine: offset,
 				Prompt: prompt, TextLengthInCells: width,
@@ -114,7 +226,7 @@ func (self *Readline) get_screen_lines() []*ScreenLine {
 			if has_cursor && !found_cursor && offset <= cursor.X && cursor.X <= offset+len(l) {
 				found_cursor = true
 				ctpos := cursor.X - offset
-				ccell := prompt.Length + wcswidth.Stringwidth(l[:ctpos])
+				ccell := prompt.Length + self.stringwidth(l[:ctpos])
 				if ccell >= self.screen_width {
 					if offset+len(l) < len(line) || i < len(lines)-1 {
 						cursor_at_start_of_next_line = true
@@ -133,24 +245,83 @@ func (self *Readline) get_screen_lines() []*ScreenLine {
 	return ans
 }
 
+// Redraw once control returns to the loop, so that many changes in quick
+// succession, such as input arriving as many separate pieces of text, cause
+// only a single redraw. Redrawing immediately cancels the scheduled redraw.
+func (self *Readline) schedule_redraw() {
+	if self.redraw_timer_id != 0 {
+		return
+	}
+	id, err := self.add_timer(0, false, func(loop.IdType) error {
+		self.redraw_timer_id = 0
+		self.Redraw()
+		return nil
+	})
+	if err != nil {
+		// the loop is not running
+		self.Redraw()
+		return
+	}
+	self.redraw_timer_id = id
+}
+
+func (self *Readline) cancel_scheduled_redraw() {
+	if self.redraw_timer_id != 0 {
+		self.remove_timer(self.redraw_timer_id)
+		self.redraw_timer_id = 0
+	}
+}
+
 func (self *Readline) redraw() {
+	self.cancel_scheduled_redraw()
+	if self.loop == nil {
+		return
+	}
 	if self.screen_width == 0 || self.screen_height == 0 {
 		self.update_current_screen_size()
 	}
 	if self.screen_width < 4 {
 		return
 	}
+	defer self.mirror_output()()
 	if self.cursor_y > 0 {
 		self.loop.MoveCursorVertically(-self.cursor_y)
 	}
 	self.loop.QueueWriteString("\r")
 	self.loop.ClearToEndOfScreen()
 	prompt_lines := self.get_screen_lines()
+	hint := self.current_hint()
+	autosuggestion, _, _ := utils.Cut(self.current_autosuggestion(), "\n")
+	if autosuggestion == "" {
+		// the placeholder is drawn in the same way as an autosuggestion
+		autosuggestion = self.current_placeholder()
+	}
+	num_hint_lines := 0
+	if hint != "" && self.hints.below_input {
+		num_hint_lines = 1
+	}
+	message := self.query_message()
+	if message == "" {
+		message = self.completions_message()
+	}
+	if message == "" {
+		message = self.spinner_message()
+	}
+	if message == "" {
+		message = self.message
+	}
+	num_message_lines := 0
+	if message != "" {
+		num_message_lines = 1
+	}
 	csl, csl_cached := self.completion_screen_lines()
-	render_completion_above := len(csl)+len(prompt_lines) > self.screen_height
+	if self.completions.max_displayed > 0 {
+		csl, _ = self.completion_page(csl)
+	}
+	banner_rows := self.prompt_banner_rows()
+	render_completion_above := len(csl)+banner_rows+len(prompt_lines)+num_hint_lines+num_message_lines > self.screen_height
 	completion_needs_render := len(csl) > 0 && (!render_completion_above || !self.completions.current.last_rendered_above || !csl_cached)
 	final_cursor_x := -1
-	cursor_y := 0
 	move_cursor_up_by := 0
 
 	render_completion_lines := func() int {
@@ -178,6 +349,11 @@ func (self *Readline) redraw() {
 	}
 	self.loop.AllowLineWrapping(true)
 	self.loop.QueueWriteString("\r")
+	for _, row := range prompt_lines[0].Prompt.Banner {
+		self.loop.QueueWriteString(row.Text)
+		self.loop.QueueWriteString("\r\n")
+	}
+	cursor_y := banner_rows
 	text_length := 0
 
 	for i, sl := range prompt_lines {
@@ -203,6 +379,18 @@ func (self *Readline) redraw() {
 			cursor_moved_down = true
 			text_length -= self.screen_width
 		}
+		if autosuggestion != "" && i == len(prompt_lines)-1 {
+			if available := self.screen_width - text_length - 1; available > 0 {
+				as, w := self.truncate_to_visual_length_with_width(autosuggestion, available)
+				self.loop.QueueWriteString(self.fmt_ctx.Dim(as))
+				text_length += w
+			}
+		}
+		if hint != "" && !self.hints.below_input && sl.ParentLineNumber == self.input_state.cursor.Y && (i == len(prompt_lines)-1 || prompt_lines[i+1].ParentLineNumber != sl.ParentLineNumber) {
+			if available := self.screen_width - text_length - 2; available > 0 {
+				self.loop.QueueWriteString(" " + self.fmt_ctx.Dim(self.truncate_to_visual_length(hint, available)))
+			}
+		}
 		if sl.CursorCell > -1 {
 			final_cursor_x = sl.CursorCell
 		} else if final_cursor_x > -1 {
@@ -214,6 +402,22 @@ func (self *Readline) redraw() {
 			cursor_y++
 		}
 	}
+	if num_hint_lines > 0 {
+		self.loop.AllowLineWrapping(false)
+		self.loop.QueueWriteString("\r\n")
+		self.loop.QueueWriteString(self.fmt_ctx.Dim(self.truncate_to_visual_length(hint, self.screen_width-1)))
+		self.loop.AllowLineWrapping(true)
+		move_cursor_up_by++
+		cursor_y++
+	}
+	if num_message_lines > 0 {
+		self.loop.AllowLineWrapping(false)
+		self.loop.QueueWriteString("\r\n")
+		self.loop.QueueWriteString(self.fmt_ctx.Bold(self.truncate_to_visual_length(message, self.screen_width-1)))
+		self.loop.AllowLineWrapping(true)
+		move_cursor_up_by++
+		cursor_y++
+	}
 	if !render_completion_above {
 		move_cursor_up_by += render_completion_lines()
 	}
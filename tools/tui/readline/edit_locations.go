@@ -0,0 +1,109 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package readline
+
+import (
+	"fmt"
+	"strings"
+)
+
+var _ = fmt.Print
+
+const max_edit_locations = 16
+
+// A ring of the cursor positions at which recent edits were made, stored as
+// byte offsets into the full text so they can be adjusted as the text changes
+type edit_locations struct {
+	// The text as of the last recorded edit
+	text    string
+	offsets []int
+	current int
+}
+
+func position_to_offset(lines []string, pos Position) int {
+	ans := 0
+	for _, line := range lines[:pos.Y] {
+		ans += len(line) + 1
+	}
+	return ans + pos.X
+}
+
+func offset_to_position(text string, offset int) Position {
+	before := text[:offset]
+	y := strings.Count(before, "\n")
+	return Position{Y: y, X: len(before) - (strings.LastIndexByte(before, '\n') + 1)}
+}
+
+// The extent of the change from old to new text: the length of their common
+// prefix and the ends of the changed text in old and new
+func text_change(old, new string) (p, old_end, new_end int) {
+	s := 0
+	for p < len(old) && p < len(new) && old[p] == new[p] {
+		p++
+	}
+	for s < len(old)-p && s < len(new)-p && old[len(old)-1-s] == new[len(new)-1-s] {
+		s++
+	}
+	return p, len(old) - s, len(new) - s
+}
+
+// Move offsets to account for the change from old to new text. Offsets
+// inside the changed text are moved to its start.
+func (self *edit_locations) adjust(old, new string) {
+	p, old_end, new_end := text_change(old, new)
+	ans := self.offsets[:0]
+	for _, x := range self.offsets {
+		if x > p {
+			if x >= old_end {
+				x += new_end - old_end
+			} else {
+				x = p
+			}
+		}
+		if len(ans) == 0 || ans[len(ans)-1] != x {
+			ans = append(ans, x)
+		}
+	}
+	self.offsets = ans
+}
+
+// Record an edit, if the text has changed since the last recorded edit.
+// Consecutive edits on the same line are coalesced into a single location.
+func (self *Readline) record_edit_location() {
+	el := &self.edit_locations
+	text := self.all_text()
+	if text == el.text {
+		return
+	}
+	el.adjust(el.text, text)
+	el.text = text
+	offset := position_to_offset(self.input_state.lines, self.input_state.cursor)
+	if n := len(el.offsets); n > 0 && offset_to_position(text, el.offsets[n-1]).Y == self.input_state.cursor.Y {
+		el.offsets = el.offsets[:n-1]
+	}
+	el.offsets = append(el.offsets, offset)
+	if len(el.offsets) > max_edit_locations {
+		el.offsets = el.offsets[len(el.offsets)-max_edit_locations:]
+	}
+	el.current = len(el.offsets)
+}
+
+func (self *Readline) jump_to_edit_location(amt int) bool {
+	self.record_edit_location()
+	el := &self.edit_locations
+	if len(el.offsets) == 0 {
+		return false
+	}
+	idx := el.current
+	if amt < 0 && idx == len(el.offsets) && el.offsets[idx-1] == position_to_offset(self.input_state.lines, self.input_state.cursor) {
+		// the cursor is already at the most recent edit
+		idx--
+	}
+	idx += amt
+	if idx < 0 || idx >= len(el.offsets) {
+		return false
+	}
+	el.current = idx
+	self.input_state.cursor = offset_to_position(el.text, el.offsets[idx])
+	return true
+}
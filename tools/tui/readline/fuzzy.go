@@ -0,0 +1,151 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package readline
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"kitty/tools/cli"
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+const (
+	fuzzy_score_match       = 16
+	fuzzy_bonus_consecutive = 24
+	fuzzy_bonus_first_char  = 32
+	fuzzy_bonus_boundary    = 20
+	fuzzy_bonus_same_case   = 1
+	fuzzy_max_gap_penalty   = 16
+)
+
+func is_fuzzy_boundary(prev, ch rune) bool {
+	if !unicode.IsLetter(prev) && !unicode.IsDigit(prev) {
+		return true
+	}
+	return unicode.IsLower(prev) && unicode.IsUpper(ch)
+}
+
+func fuzzy_match_at(query, candidate []rune, start int) (score int, positions []int, matched bool) {
+	positions = make([]int, 0, len(query))
+	qi := 0
+	prev_match := -1
+	for ci := start; ci < len(candidate) && qi < len(query); ci++ {
+		ch := candidate[ci]
+		if unicode.ToLower(ch) != unicode.ToLower(query[qi]) {
+			continue
+		}
+		score += fuzzy_score_match
+		if ch == query[qi] {
+			score += fuzzy_bonus_same_case
+		}
+		if ci == 0 {
+			score += fuzzy_bonus_first_char
+		} else if is_fuzzy_boundary(candidate[ci-1], ch) {
+			score += fuzzy_bonus_boundary
+		}
+		if prev_match > -1 {
+			if ci == prev_match+1 {
+				score += fuzzy_bonus_consecutive
+			} else {
+				score -= utils.Min(ci-prev_match-1, fuzzy_max_gap_penalty)
+			}
+		}
+		positions = append(positions, ci)
+		prev_match = ci
+		qi++
+	}
+	if qi < len(query) {
+		return 0, nil, false
+	}
+	score -= utils.Min(start, fuzzy_max_gap_penalty)
+	return score, positions, true
+}
+
+// FuzzyMatch checks if query is a case insensitive subsequence of candidate.
+// It returns a score that is higher for better matches, rewarding consecutive
+// matches and matches at the start of words, and the byte offsets in
+// candidate of the matched characters.
+func FuzzyMatch(query, candidate string) (score int, positions []int, matched bool) {
+	if query == "" {
+		return 0, []int{}, true
+	}
+	q, c := []rune(query), []rune(candidate)
+	first := unicode.ToLower(q[0])
+	for i, ch := range c {
+		if unicode.ToLower(ch) != first {
+			continue
+		}
+		if s, p, ok := fuzzy_match_at(q, c, i); ok && (!matched || s > score) {
+			score, positions, matched = s, p, ok
+		}
+	}
+	if matched {
+		byte_offsets := make([]int, len(c)+1)
+		pos := 0
+		for i, ch := range c {
+			byte_offsets[i] = pos
+			pos += utf8.RuneLen(ch)
+		}
+		for i, p := range positions {
+			positions[i] = byte_offsets[p]
+		}
+	}
+	return
+}
+
+func highlight_fuzzy_match(text string, positions []int, highlight func(...any) string) string {
+	if len(positions) == 0 {
+		return text
+	}
+	buf := strings.Builder{}
+	buf.Grow(len(text) * 2)
+	prev := 0
+	for _, p := range positions {
+		if p < prev || p >= len(text) {
+			continue
+		}
+		_, sz := utf8.DecodeRuneInString(text[p:])
+		buf.WriteString(text[prev:p])
+		buf.WriteString(highlight(text[p : p+sz]))
+		prev = p + sz
+	}
+	buf.WriteString(text[prev:])
+	return buf.String()
+}
+
+func (self *Readline) fuzzy_filter_completions(c *completion) {
+	if c.results == nil || c.results.CurrentWordIdx > len(c.before_cursor) {
+		return
+	}
+	c.fuzzy_query = c.before_cursor[c.results.CurrentWordIdx:]
+	type scored struct {
+		match *cli.Match
+		score int
+	}
+	for _, g := range c.results.Groups {
+		matches := make([]scored, 0, len(g.Matches))
+		for _, m := range g.Matches {
+			if score, _, ok := FuzzyMatch(c.fuzzy_query, m.Word); ok {
+				matches = append(matches, scored{m, score})
+			}
+		}
+		matches = utils.StableSort(matches, func(a, b scored) bool { return a.score > b.score })
+		g.Matches = g.Matches[:0]
+		for _, m := range matches {
+			g.Matches = append(g.Matches, m.match)
+		}
+	}
+}
+
+func (self *Readline) highlight_fuzzy_completion(word, query string) string {
+	if query == "" {
+		return word
+	}
+	_, positions, _ := FuzzyMatch(query, word)
+	return highlight_fuzzy_match(word, positions, self.fmt_ctx.Green)
+}
@@ -3,12 +3,14 @@
 package readline
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"strings"
 	"time"
+	"unicode"
 
 	"kitty/tools/utils"
 	"kitty/tools/utils/shlex"
@@ -23,6 +25,10 @@ type HistoryItem struct {
 	Timestamp time.Time     `json:"timestamp"`
 	Duration  time.Duration `json:"duration,omitempty"`
 	ExitCode  int           `json:"exit_code"`
+	// Pinned items are never removed when trimming the history to max_items
+	Pinned bool `json:"pinned,omitempty"`
+	// Arbitrary data about the command, such as a session id or tags
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
 type HistoryMatches struct {
@@ -32,6 +38,28 @@ type HistoryMatches struct {
 	original_input_state InputState
 }
 
+// The text drawn for the recalled history item cmd, see HistoryDisplayFunction
+type recalled_history_item struct {
+	cmd, display string
+}
+
+func is_history_navigation_action(ac Action) bool {
+	switch ac {
+	case ActionHistoryPrevious, ActionHistoryNext, ActionHistoryFirst, ActionHistoryLast, ActionHistoryPreviousOrCursorUp,
+		ActionHistoryNextOrCursorDown:
+		return true
+	}
+	return false
+}
+
+// The text to draw instead of the input, if it is a recalled history item
+func (self *Readline) recalled_history_display() (string, bool) {
+	if self.recalled.cmd == "" || self.history_search != nil || self.recalled.cmd != self.all_text() {
+		return "", false
+	}
+	return self.recalled.display, true
+}
+
 type HistorySearch struct {
 	query                string
 	tokens               []string
@@ -41,12 +69,30 @@ type HistorySearch struct {
 	original_input_state InputState
 }
 
+// Called with errors reading or writing the history file, such as corrupted
+// entries being ignored. They are never printed, as that would corrupt the
+// screen.
+type HistoryErrorFunction = func(err error)
+
 type History struct {
 	file_path string
 	file      *os.File
 	max_items int
 	items     []HistoryItem
 	cmd_map   map[string]int
+	// Entries from read only history files, used for navigation and search
+	// but never written back
+	shared_paths []string
+	shared_items []HistoryItem
+	merged_items []HistoryItem
+	// Formatting policy for interoperating with other consumers of the file
+	trim_entries, final_newline bool
+	// Appended to commands in the file only, so that it is never part of
+	// the input
+	entry_suffix string
+	// A disabled history never stores or returns any items
+	disabled bool
+	on_error HistoryErrorFunction
 }
 
 func map_from_items(items []HistoryItem) map[string]int {
@@ -61,6 +107,7 @@ func (self *History) add_item(x HistoryItem) bool {
 	existing, found := self.cmd_map[x.Cmd]
 	if found {
 		if self.items[existing].Timestamp.Before(x.Timestamp) {
+			x.Pinned = x.Pinned || self.items[existing].Pinned
 			self.items[existing] = x
 			return true
 		}
@@ -72,6 +119,19 @@ func (self *History) add_item(x HistoryItem) bool {
 }
 
 func (self *History) merge_items(items ...HistoryItem) {
+	if self.disabled {
+		return
+	}
+	self.merged_items = nil
+	if self.trim_entries {
+		trimmed := make([]HistoryItem, 0, len(items))
+		for _, x := range items {
+			if x.Cmd = strings.TrimRightFunc(x.Cmd, unicode.IsSpace); x.Cmd != "" {
+				trimmed = append(trimmed, x)
+			}
+		}
+		items = trimmed
+	}
 	if len(self.items) == 0 {
 		self.items = items
 		self.cmd_map = map_from_items(self.items)
@@ -92,90 +152,341 @@ func (self *History) merge_items(items ...HistoryItem) {
 	self.items = utils.StableSort(self.items, func(a, b HistoryItem) bool {
 		return a.Timestamp.Before(b.Timestamp)
 	})
-	if len(self.items) > self.max_items {
-		self.items = self.items[len(self.items)-self.max_items:]
-	}
+	self.trim()
 	self.cmd_map = map_from_items(self.items)
 }
 
-func (self *History) Write() {
-	if self.file == nil {
+// Remove the oldest unpinned items so that there are at most max_items
+// unpinned items
+func (self *History) trim() {
+	if len(self.items) <= self.max_items {
 		return
 	}
-	self.file.Seek(0, 0)
-	utils.LockFileExclusive(self.file)
-	defer utils.UnlockFile(self.file)
-	data, err := io.ReadAll(self.file)
-	if err != nil {
+	num_unpinned := 0
+	for _, x := range self.items {
+		if !x.Pinned {
+			num_unpinned++
+		}
+	}
+	excess := num_unpinned - self.max_items
+	if excess <= 0 {
 		return
 	}
-	var items []HistoryItem
-	err = json.Unmarshal(data, &items)
-	if err != nil {
-		self.merge_items(items...)
+	items := self.items[:0]
+	for _, x := range self.items {
+		if !x.Pinned && excess > 0 {
+			excess--
+			continue
+		}
+		items = append(items, x)
 	}
-	ndata, err := json.MarshalIndent(self.items, "", "  ")
-	if err != nil {
-		return
+	self.items = items
+}
+
+// Pin or unpin the history item with the specified command. Returns false
+// if no such item exists.
+func (self *History) SetPinned(cmd string, pinned bool) bool {
+	idx, found := self.cmd_map[cmd]
+	if !found {
+		return false
 	}
-	self.file.Truncate(int64(len(ndata)))
-	self.file.Seek(0, 0)
-	self.file.Write(ndata)
+	return self.SetPinnedAt(idx, pinned)
 }
 
-func (self *History) Read() {
-	if self.file == nil {
+// Pin or unpin the history item at the specified index, items are ordered
+// from oldest to newest.
+func (self *History) SetPinnedAt(idx int, pinned bool) bool {
+	if idx < 0 || idx >= len(self.items) {
+		return false
+	}
+	self.items[idx].Pinned = pinned
+	self.merged_items = nil
+	return true
+}
+
+// Parse the contents of a history file, recovering as many entries as
+// possible from files that are truncated or otherwise corrupted.
+func parse_history(data []byte) (items []HistoryItem, num_bad int) {
+	if len(bytes.TrimSpace(data)) == 0 {
 		return
 	}
+	if err := json.Unmarshal(data, &items); err == nil {
+		return
+	}
+	items = nil
+	depth, start := 0, -1
+	in_string, escaped := false, false
+	for i, ch := range data {
+		if in_string {
+			switch {
+			case escaped:
+				escaped = false
+			case ch == '\\':
+				escaped = true
+			case ch == '"':
+				in_string = false
+			}
+			continue
+		}
+		switch ch {
+		case '"':
+			in_string = depth > 0
+		case '{':
+			if depth == 0 {
+				start = i
+			}
+			depth++
+		case '}':
+			if depth == 0 {
+				continue
+			}
+			depth--
+			if depth == 0 {
+				var item HistoryItem
+				if err := json.Unmarshal(data[start:i+1], &item); err == nil && item.Cmd != "" {
+					items = append(items, item)
+				} else {
+					num_bad++
+				}
+			}
+		}
+	}
+	if depth > 0 {
+		num_bad++
+	}
+	return
+}
+
+func (self *History) reopen() bool {
+	f, err := os.OpenFile(self.file_path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return false
+	}
+	self.file.Close()
+	self.file = f
+	return true
+}
+
+// Lock the history file, re-opening it first if it has been replaced since
+// it was opened, for example by the atomic write of another process.
+func (self *History) lock(exclusive bool) bool {
+	for {
+		if exclusive {
+			utils.LockFileExclusive(self.file)
+		} else {
+			utils.LockFileShared(self.file)
+		}
+		a, aerr := self.file.Stat()
+		b, berr := os.Stat(self.file_path)
+		if aerr != nil || berr != nil || os.SameFile(a, b) {
+			return true
+		}
+		utils.UnlockFile(self.file)
+		if !self.reopen() {
+			return false
+		}
+	}
+}
+
+func (self *History) read_items() {
 	self.file.Seek(0, 0)
-	utils.LockFileShared(self.file)
 	data, err := io.ReadAll(self.file)
-	utils.UnlockFile(self.file)
 	if err != nil {
 		return
 	}
-	var items []HistoryItem
-	err = json.Unmarshal(data, &items)
-	if err == nil {
-		self.merge_items(items...)
+	items, num_bad := parse_history(data)
+	if num_bad > 0 {
+		self.report_error(fmt.Errorf("Ignored %d corrupted entries in the history file: %s", num_bad, self.file_path))
+	}
+	self.merge_items(self.without_entry_suffix(items)...)
+}
+
+func (self *History) report_error(err error) {
+	if self.on_error != nil {
+		self.on_error(err)
 	}
 }
 
+func (self *History) Write() error {
+	if self.file == nil || !self.lock(true) {
+		return nil
+	}
+	locked := self.file
+	defer func() {
+		utils.UnlockFile(locked)
+		if locked != self.file {
+			locked.Close()
+		}
+	}()
+	self.read_items()
+	items := self.items
+	if self.entry_suffix != "" {
+		items = make([]HistoryItem, len(self.items))
+		for i, x := range self.items {
+			x.Cmd += self.entry_suffix
+			items[i] = x
+		}
+	}
+	ndata, err := json.MarshalIndent(items, "", "  ")
+	if err != nil {
+		return err
+	}
+	if self.final_newline {
+		ndata = append(ndata, '\n')
+	}
+	// Write to a temp file and rename so that a crash cannot leave behind
+	// a partially written history file. Keep the lock on the replaced file
+	// until the new one is opened so that concurrent writers serialize.
+	if err = utils.AtomicUpdateFile(self.file_path, ndata, 0o600); err != nil {
+		return fmt.Errorf("Failed to write history file at: %s with error: %w", self.file_path, err)
+	}
+	if f, err := os.OpenFile(self.file_path, os.O_RDWR, 0o600); err == nil {
+		self.file = f
+	}
+	return nil
+}
+
+func (self *History) without_entry_suffix(items []HistoryItem) []HistoryItem {
+	if self.entry_suffix != "" {
+		for i := range items {
+			items[i].Cmd = strings.TrimSuffix(items[i].Cmd, self.entry_suffix)
+		}
+	}
+	return items
+}
+
+func (self *History) read_shared_items() {
+	self.shared_items, self.merged_items = nil, nil
+	for _, path := range self.shared_paths {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		utils.LockFileShared(f)
+		data, err := io.ReadAll(f)
+		utils.UnlockFile(f)
+		f.Close()
+		if err == nil {
+			items, _ := parse_history(data)
+			self.shared_items = append(self.shared_items, self.without_entry_suffix(items)...)
+		}
+	}
+}
+
+// All history entries, including those from the read only history files,
+// ordered by time with duplicates removed
+func (self *History) all_items() []HistoryItem {
+	if len(self.shared_items) == 0 {
+		return self.items
+	}
+	if self.merged_items == nil {
+		latest := make(map[string]HistoryItem, len(self.items)+len(self.shared_items))
+		for _, items := range [][]HistoryItem{self.shared_items, self.items} {
+			for _, x := range items {
+				if existing, found := latest[x.Cmd]; !found || !x.Timestamp.Before(existing.Timestamp) {
+					latest[x.Cmd] = x
+				}
+			}
+		}
+		self.merged_items = utils.StableSort(utils.Values(latest), func(a, b HistoryItem) bool {
+			if a.Timestamp.Equal(b.Timestamp) {
+				return a.Cmd < b.Cmd
+			}
+			return a.Timestamp.Before(b.Timestamp)
+		})
+	}
+	return self.merged_items
+}
+
+func (self *History) Read() {
+	self.read_shared_items()
+	if self.file == nil || !self.lock(false) {
+		return
+	}
+	defer utils.UnlockFile(self.file)
+	self.read_items()
+}
+
 func (self *History) AddItem(cmd string, duration time.Duration) {
 	self.merge_items(HistoryItem{Cmd: cmd, Duration: duration, Timestamp: time.Now()})
 }
 
 func (self *History) Shutdown() {
 	if self.file != nil {
-		self.Write()
+		if err := self.Write(); err != nil {
+			self.report_error(err)
+		}
 		self.file.Close()
 		self.file = nil
 	}
 }
 
-func NewHistory(path string, max_items int) *History {
-	ans := History{items: []HistoryItem{}, cmd_map: map[string]int{}, max_items: max_items}
+// Create a history backed by the file at path. Entries from the files at
+// read_only_paths are available for navigation and search, but new entries
+// are only saved to path. Errors reading or writing the file are ignored,
+// use NewHistoryWithErrorHandler to be notified of them.
+func NewHistory(path string, max_items int, read_only_paths ...string) *History {
+	return new_history(path, max_items, "", nil, read_only_paths...)
+}
+
+// Like NewHistory except that errors reading or writing the history file are
+// passed to on_error, which may be nil.
+func NewHistoryWithErrorHandler(path string, max_items int, on_error HistoryErrorFunction, read_only_paths ...string) *History {
+	return new_history(path, max_items, "", on_error, read_only_paths...)
+}
+
+func new_history(path string, max_items int, entry_suffix string, on_error HistoryErrorFunction, read_only_paths ...string) *History {
+	ans := History{items: []HistoryItem{}, cmd_map: map[string]int{}, max_items: max_items, shared_paths: read_only_paths, entry_suffix: entry_suffix, on_error: on_error}
 	if path != "" {
 		ans.file_path = path
 		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
 		if err == nil {
 			ans.file = f
 		} else {
-			fmt.Fprintln(os.Stderr, "Failed to open history file at:", path, "with error:", err)
+			ans.report_error(fmt.Errorf("Failed to open history file at: %s with error: %w", path, err))
 		}
 	}
 	ans.Read()
 	return &ans
 }
 
-func (self *History) find_prefix_matches(prefix, current_command string, input_state InputState) *HistoryMatches {
-	ans := HistoryMatches{items: make([]HistoryItem, 0, len(self.items)+1), prefix: prefix, original_input_state: input_state}
+func new_disabled_history() *History {
+	return &History{items: []HistoryItem{}, cmd_map: map[string]int{}, disabled: true}
+}
+
+// Whether s starts with prefix, ignoring case if requested. Case is only
+// ignored for characters whose case variants are the same length in UTF-8, so
+// that offsets into s remain valid.
+func has_prefix(s, prefix string, ignore_case bool) bool {
+	if !ignore_case {
+		return strings.HasPrefix(s, prefix)
+	}
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// The byte offset of the first occurrence of substr in s, ignoring case if
+// requested, or -1
+func index_of(s, substr string, ignore_case bool) int {
+	if !ignore_case {
+		return strings.Index(s, substr)
+	}
+	for i := range s {
+		if has_prefix(s[i:], substr, true) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (self *History) find_prefix_matches(prefix, current_command string, input_state InputState, ignore_case bool) *HistoryMatches {
+	all_items := self.all_items()
+	ans := HistoryMatches{items: make([]HistoryItem, 0, len(all_items)+1), prefix: prefix, original_input_state: input_state}
 	if prefix == "" {
-		ans.items = ans.items[:len(self.items)]
-		copy(ans.items, self.items)
+		ans.items = ans.items[:len(all_items)]
+		copy(ans.items, all_items)
 	} else {
-		for _, x := range self.items {
-			if strings.HasPrefix(x.Cmd, prefix) {
+		for _, x := range all_items {
+			if has_prefix(x.Cmd, prefix, ignore_case) {
 				ans.items = append(ans.items, x)
 			}
 		}
@@ -190,7 +501,7 @@ func (self *Readline) create_history_matches() {
 		return
 	}
 	prefix := self.text_upto_cursor_pos()
-	self.history_matches = self.history.find_prefix_matches(prefix, self.AllText(), self.input_state.copy())
+	self.history_matches = self.history.find_prefix_matches(prefix, self.AllText(), self.input_state.copy(), self.history_search_ignore_case)
 }
 
 func (self *Readline) last_action_was_history_movement() bool {
@@ -208,6 +519,7 @@ func (self *HistoryMatches) apply(rl *Readline) bool {
 	}
 	if self.current_idx == len(self.items)-1 {
 		rl.input_state = self.original_input_state.copy()
+		rl.recalled = recalled_history_item{}
 	} else {
 		item := self.items[self.current_idx]
 		rl.input_state.lines = utils.Splitlines(item.Cmd)
@@ -216,6 +528,9 @@ func (self *HistoryMatches) apply(rl *Readline) bool {
 		}
 		idx := len(rl.input_state.lines) - 1
 		rl.input_state.cursor = Position{Y: idx, X: len(rl.input_state.lines[idx])}
+		if rl.history_display != nil {
+			rl.recalled = recalled_history_item{cmd: item.Cmd, display: rl.history_display(item.Cmd)}
+		}
 	}
 	return true
 }
@@ -275,11 +590,24 @@ func (self *Readline) markup_history_search() {
 		self.input_state.cursor = Position{X: wcswidth.Stringwidth(self.input_state.lines[0])}
 		return
 	}
-	lines := utils.Splitlines(self.history_search.items[self.history_search.current_idx].Cmd)
+	cmd := self.history_search.items[self.history_search.current_idx].Cmd
+	lines := utils.Splitlines(cmd)
 	cursor := Position{Y: len(lines)}
+	if self.fuzzy_matching {
+		if positions := self.fuzzy_history_search_positions(cmd); len(positions) > 0 {
+			before := utils.Splitlines(cmd[:positions[0]])
+			cursor = Position{Y: utils.Max(0, len(before)-1)}
+			if len(before) > 0 {
+				cursor.X = len(before[len(before)-1])
+			}
+		}
+		self.input_state.lines = lines
+		self.input_state.cursor = *self.ensure_position_in_bounds(&cursor)
+		return
+	}
 	for _, tok := range self.history_search.tokens {
 		for i, line := range lines {
-			if idx := strings.Index(line, tok); idx > -1 {
+			if idx := index_of(line, tok, self.history_search_ignore_case); idx > -1 {
 				q := Position{Y: i, X: idx}
 				if q.Less(cursor) {
 					cursor = q
@@ -305,11 +633,14 @@ func (self *Readline) history_search_highlighter(text string, x, y int) string {
 	if len(self.history_search.items) == 0 {
 		return text
 	}
+	if self.fuzzy_matching {
+		return highlight_fuzzy_match(text, self.fuzzy_history_search_positions(text), self.fmt_ctx.Green)
+	}
 	lines := utils.Splitlines(text)
 	for _, tok := range self.history_search.tokens {
 		for i, line := range lines {
-			if idx := strings.Index(line, tok); idx > -1 {
-				lines[i] = line[:idx] + self.fmt_ctx.Green(tok) + line[idx+len(tok):]
+			if idx := index_of(line, tok, self.history_search_ignore_case); idx > -1 {
+				lines[i] = line[:idx] + self.fmt_ctx.Green(line[idx:idx+len(tok)]) + line[idx+len(tok):]
 				break
 			}
 		}
@@ -317,6 +648,46 @@ func (self *Readline) history_search_highlighter(text string, x, y int) string {
 	return strings.Join(lines, "\n")
 }
 
+func (self *Readline) fuzzy_history_search(items []*HistoryItem) []*HistoryItem {
+	type scored struct {
+		item  *HistoryItem
+		score int
+	}
+	matches := make([]scored, 0, len(items))
+	for _, item := range items {
+		total, matched := 0, true
+		for _, token := range self.history_search.tokens {
+			score, _, ok := FuzzyMatch(token, item.Cmd)
+			if !ok {
+				matched = false
+				break
+			}
+			total += score
+		}
+		if matched {
+			matches = append(matches, scored{item, total})
+		}
+	}
+	// the best matches go last as backwards search starts from the end
+	matches = utils.StableSort(matches, func(a, b scored) bool { return a.score < b.score })
+	ans := make([]*HistoryItem, len(matches))
+	for i, m := range matches {
+		ans[i] = m.item
+	}
+	return ans
+}
+
+func (self *Readline) fuzzy_history_search_positions(text string) []int {
+	seen := make(map[int]bool, 16)
+	for _, token := range self.history_search.tokens {
+		_, positions, _ := FuzzyMatch(token, text)
+		for _, p := range positions {
+			seen[p] = true
+		}
+	}
+	return utils.Sort(utils.Keys(seen), func(a, b int) bool { return a < b })
+}
+
 func (self *Readline) add_text_to_history_search(text string) {
 	self.history_search.query += text
 	tokens, err := shlex.Split(self.history_search.query)
@@ -331,18 +702,27 @@ func (self *Readline) add_text_to_history_search(text string) {
 	if len(self.history_search.tokens) == 0 {
 		self.history_search.items = []*HistoryItem{}
 	} else {
-		items := make([]*HistoryItem, len(self.history.items))
-		for i := range self.history.items {
-			items[i] = &self.history.items[i]
+		all_items := self.history.all_items()
+		items := make([]*HistoryItem, len(all_items))
+		for i := range all_items {
+			items[i] = &all_items[i]
 		}
-		for _, token := range self.history_search.tokens {
-			matches := make([]*HistoryItem, 0, len(items))
-			for _, item := range items {
-				if strings.Contains(item.Cmd, token) {
-					matches = append(matches, item)
+		if self.fuzzy_matching {
+			items = self.fuzzy_history_search(items)
+		} else {
+			for _, token := range self.history_search.tokens {
+				matches := make([]*HistoryItem, 0, len(items))
+				for _, item := range items {
+					if index_of(item.Cmd, token, self.history_search_ignore_case) > -1 {
+						matches = append(matches, item)
+					}
 				}
+				items = matches
 			}
-			items = matches
+		}
+		if self.pinned_history_first {
+			// backwards search starts from the end
+			items = utils.StableSort(items, func(a, b *HistoryItem) bool { return !a.Pinned && b.Pinned })
 		}
 		self.history_search.items = items
 	}
@@ -0,0 +1,103 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package readline
+
+import (
+	"fmt"
+	"strings"
+
+	"kitty/tools/utils"
+	"kitty/tools/wcswidth"
+)
+
+var _ = fmt.Print
+
+// The SGR escape codes in text, so that styling in effect at its end can be
+// carried over to text after it
+func sgr_codes(text string) string {
+	buf := strings.Builder{}
+	p := wcswidth.EscapeCodeParser{HandleCSI: func(csi []byte) error {
+		if len(csi) > 0 && csi[len(csi)-1] == 'm' {
+			buf.WriteString("\x1b[")
+			buf.Write(csi)
+		}
+		return nil
+	}}
+	p.ParseString(text)
+	return buf.String()
+}
+
+// The first cell of the line drawn when the line in which the cursor, at
+// column cursor_col, is scrolled horizontally to fit in available cells.
+// When the line is scrolled the first and last cells are used for the
+// indicators, so the cursor is kept between them.
+func (self *Readline) horizontal_scroll_start(cursor_col, width, available int) int {
+	s := self.hscroll
+	if width < available {
+		s = 0
+	} else {
+		s = utils.Min(s, width-available+2)
+		if s > 0 && cursor_col < s+1 {
+			s = utils.Max(0, cursor_col-1)
+		}
+		if cursor_col > s+available-2 {
+			s = cursor_col - available + 2
+		}
+	}
+	self.hscroll = s
+	return s
+}
+
+// The part of line, which is width cells wide, that fits in available cells
+// starting at the cell start, with < and > indicating the parts of the line
+// that are not visible
+func (self *Readline) window_of_line(line string, start, width, available int) (string, int) {
+	if start == 0 && width < available {
+		return line, width
+	}
+	buf := strings.Builder{}
+	cells := 0
+	rest := line
+	if start > 0 {
+		head, hw := self.truncate_to_visual_length_with_width(line, start+1)
+		buf.WriteString("<")
+		cells++
+		if hw < start+1 {
+			// a wide character is under the indicator, blank its other half
+			head, _ = self.truncate_to_visual_length_with_width(line, start+2)
+			buf.WriteString(" ")
+			cells++
+		}
+		buf.WriteString(sgr_codes(head))
+		rest = line[len(head):]
+	}
+	remaining := available - cells
+	if self.stringwidth(rest) < remaining {
+		buf.WriteString(rest)
+		return buf.String(), cells + self.stringwidth(rest)
+	}
+	visible, vw := self.truncate_to_visual_length_with_width(rest, remaining-1)
+	buf.WriteString(visible)
+	buf.WriteString("\x1b[m")
+	buf.WriteString(strings.Repeat(" ", remaining-1-vw))
+	buf.WriteString(">")
+	return buf.String(), available
+}
+
+// Draw line on a single screen row, scrolling it horizontally to keep the
+// cursor visible, instead of wrapping it onto several rows
+func (self *Readline) scrolled_screen_line(i int, line string, prompt Prompt, cursor Position) *ScreenLine {
+	width := self.stringwidth(line)
+	// leave the last column empty so that the line never wraps
+	available := utils.Max(3, self.screen_width-prompt.Length-1)
+	sl := &ScreenLine{ParentLineNumber: i, Prompt: prompt, CursorCell: -1, CursorTextPos: -1, AfterLineBreak: true}
+	start := 0
+	if i == cursor.Y {
+		cursor_col := self.stringwidth(line[:cursor.X])
+		start = self.horizontal_scroll_start(cursor_col, width, available)
+		sl.CursorCell = prompt.Length + cursor_col - start
+	}
+	sl.Text, sl.TextLengthInCells = self.window_of_line(line, start, width, available)
+	sl.ScrolledCells = start
+	return sl
+}
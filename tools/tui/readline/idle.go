@@ -0,0 +1,47 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package readline
+
+import (
+	"fmt"
+	"time"
+
+	"kitty/tools/tui/loop"
+)
+
+var _ = fmt.Print
+
+// Called once when no keys have been pressed for RlInit.IdleTimeout. It may
+// change the input or prompt, calling Redraw() to display the changes. A
+// returned error terminates the loop.
+type IdleFunction = func() error
+
+type idle struct {
+	timeout  time.Duration
+	callback IdleFunction
+	timer_id loop.IdType
+}
+
+func (self *Readline) stop_idle_timer() {
+	if self.idle.timer_id != 0 {
+		self.remove_timer(self.idle.timer_id)
+		self.idle.timer_id = 0
+	}
+}
+
+// (Re)start the idle timer, this fails silently if the loop is not yet
+// running as timers can only be added to a running loop
+func (self *Readline) start_idle_timer() {
+	self.stop_idle_timer()
+	if self.idle.timeout <= 0 || self.idle.callback == nil {
+		return
+	}
+	if id, err := self.add_timer(self.idle.timeout, false, self.on_idle_timer); err == nil {
+		self.idle.timer_id = id
+	}
+}
+
+func (self *Readline) on_idle_timer(loop.IdType) error {
+	self.idle.timer_id = 0
+	return self.idle.callback()
+}
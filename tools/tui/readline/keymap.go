@@ -0,0 +1,156 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package readline
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"kitty/tools/tty"
+	"kitty/tools/tui/loop"
+)
+
+var _ = fmt.Print
+
+var _action_name_map map[string]Action
+
+func action_name_map() map[string]Action {
+	if _action_name_map == nil {
+		_action_name_map = make(map[string]Action, 128)
+		for ac := ActionNil; ; ac++ {
+			name := ac.String()
+			if name == strconv.Itoa(int(ac)) {
+				break
+			}
+			_action_name_map[strings.TrimPrefix(name, "Action")] = ac
+		}
+	}
+	return _action_name_map
+}
+
+// The names of all actions that can be used in a keymap, sorted. Binding a
+// key to Nil removes its default binding.
+func ActionNames() []string {
+	m := action_name_map()
+	ans := make([]string, 0, len(m))
+	for name := range m {
+		ans = append(ans, name)
+	}
+	sort.Strings(ans)
+	return ans
+}
+
+func ActionFromName(name string) (Action, bool) {
+	ac, found := action_name_map()[strings.TrimPrefix(name, "Action")]
+	return ac, found
+}
+
+// Parse a single key, such as ctrl+a, returning nil if it is invalid
+func parse_key(spec string) *loop.ParsedShortcut {
+	if ps := loop.ParseShortcut(spec); ps.KeyName != "" && ps.Mods&(loop.META<<8) == 0 {
+		return ps
+	}
+	return nil
+}
+
+// The key press event for a key such as ctrl+a, with the text a key
+// without modifiers other than shift would produce
+func key_event_for_spec(spec string) (*loop.KeyEvent, error) {
+	ps := parse_key(spec)
+	if ps == nil {
+		return nil, fmt.Errorf("Invalid key specification: %s", spec)
+	}
+	ans := &loop.KeyEvent{Type: loop.PRESS, Mods: ps.Mods, Key: ps.KeyName}
+	if ps.Mods&^loop.SHIFT == 0 && utf8.RuneCountInString(ps.KeyName) == 1 {
+		ans.Text = ps.KeyName
+		if ps.Mods&loop.SHIFT != 0 {
+			ans.ShiftedKey = strings.ToUpper(ps.KeyName)
+			ans.Text = ans.ShiftedKey
+		}
+	}
+	return ans, nil
+}
+
+// Parse a map of key specifications to action names into a shortcut map
+// that overrides the default shortcuts. A key specification is one or more
+// shortcuts separated by spaces, for example: ctrl+x ctrl+t
+func ParseKeymap(bindings map[string]string) (*ShortcutMap, error) {
+	sm := new_default_shortcuts()
+	specs := make([]string, 0, len(bindings))
+	for spec := range bindings {
+		specs = append(specs, spec)
+	}
+	sort.Strings(specs)
+	for _, spec := range specs {
+		keys := strings.Fields(spec)
+		if len(keys) == 0 {
+			return nil, fmt.Errorf("Empty key specification for the action: %s", bindings[spec])
+		}
+		for _, key := range keys {
+			if parse_key(key) == nil {
+				return nil, fmt.Errorf("Invalid key specification: %s", spec)
+			}
+		}
+		ac, found := ActionFromName(bindings[spec])
+		if !found {
+			return nil, fmt.Errorf("Unknown action: %s for the key specification: %s", bindings[spec], spec)
+		}
+		sm.Add(ac, keys...)
+	}
+	return sm, nil
+}
+
+// Use the specified bindings, see ParseKeymap, instead of the default
+// shortcuts
+func (self *Readline) LoadKeymap(bindings map[string]string) error {
+	sm, err := ParseKeymap(bindings)
+	if err != nil {
+		return err
+	}
+	self.shortcuts = sm
+	return nil
+}
+
+// The keys currently bound to each action, including any custom bindings,
+// see ShortcutMap.Bindings()
+func (self *Readline) KeyBindings() map[Action][]string {
+	if self.shortcuts == nil {
+		return default_shortcuts().Bindings()
+	}
+	return self.shortcuts.Bindings()
+}
+
+// The name of the key that sends the specified control character, empty if
+// there is no such key
+func key_for_control_char(ch byte) string {
+	switch {
+	case 1 <= ch && ch <= 26:
+		return "ctrl+" + string(rune('a'+ch-1))
+	case ch == 0x7f:
+		return "backspace"
+	}
+	return ""
+}
+
+func (self *Readline) use_terminal_word_erase() error {
+	term, err := tty.OpenControllingTerm()
+	if err != nil {
+		return err
+	}
+	defer term.Close()
+	ch, stops_at_non_alnum, err := term.WordErase()
+	if err != nil {
+		return err
+	}
+	self.word_erase_blank_delimited = !stops_at_non_alnum
+	if key := key_for_control_char(ch); key != "" {
+		if self.shortcuts == nil {
+			self.shortcuts = new_default_shortcuts()
+		}
+		self.shortcuts.Add(ActionWordErase, key)
+	}
+	return nil
+}
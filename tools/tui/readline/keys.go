@@ -25,78 +25,103 @@ var _default_shortcuts *ShortcutMap
 
 func default_shortcuts() *ShortcutMap {
 	if _default_shortcuts == nil {
-		sm := shortcuts.New[Action]()
-		sm.AddOrPanic(ActionBackspace, "backspace")
-		sm.AddOrPanic(ActionBackspace, "ctrl+h")
-		sm.AddOrPanic(ActionDelete, "delete")
-
-		sm.AddOrPanic(ActionMoveToStartOfLine, "home")
-		sm.AddOrPanic(ActionMoveToStartOfLine, "ctrl+a")
-
-		sm.AddOrPanic(ActionMoveToEndOfLine, "end")
-		sm.AddOrPanic(ActionMoveToEndOfLine, "ctrl+e")
-
-		sm.AddOrPanic(ActionMoveToStartOfDocument, "ctrl+home")
-		sm.AddOrPanic(ActionMoveToEndOfDocument, "ctrl+end")
-
-		sm.AddOrPanic(ActionMoveToEndOfWord, "alt+f")
-		sm.AddOrPanic(ActionMoveToEndOfWord, "ctrl+right")
-		sm.AddOrPanic(ActionMoveToEndOfWord, "alt+right")
-		sm.AddOrPanic(ActionMoveToStartOfWord, "ctrl+left")
-		sm.AddOrPanic(ActionMoveToStartOfWord, "alt+left")
-		sm.AddOrPanic(ActionMoveToStartOfWord, "alt+b")
-
-		sm.AddOrPanic(ActionCursorLeft, "left")
-		sm.AddOrPanic(ActionCursorLeft, "ctrl+b")
-		sm.AddOrPanic(ActionCursorRight, "right")
-		sm.AddOrPanic(ActionCursorRight, "ctrl+f")
-
-		sm.AddOrPanic(ActionClearScreen, "ctrl+l")
-		sm.AddOrPanic(ActionAbortCurrentLine, "ctrl+c")
-		sm.AddOrPanic(ActionAbortCurrentLine, "ctrl+g")
-
-		sm.AddOrPanic(ActionEndInput, "ctrl+d")
-		sm.AddOrPanic(ActionAcceptInput, "enter")
-
-		sm.AddOrPanic(ActionKillToEndOfLine, "ctrl+k")
-		sm.AddOrPanic(ActionKillToStartOfLine, "ctrl+x")
-		sm.AddOrPanic(ActionKillToStartOfLine, "ctrl+u")
-		sm.AddOrPanic(ActionKillNextWord, "alt+d")
-		sm.AddOrPanic(ActionKillPreviousWord, "alt+backspace")
-		sm.AddOrPanic(ActionKillPreviousSpaceDelimitedWord, "ctrl+w")
-		sm.AddOrPanic(ActionYank, "ctrl+y")
-		sm.AddOrPanic(ActionPopYank, "alt+y")
-
-		sm.AddOrPanic(ActionHistoryPreviousOrCursorUp, "up")
-		sm.AddOrPanic(ActionHistoryNextOrCursorDown, "down")
-		sm.AddOrPanic(ActionHistoryPrevious, "ctrl+p")
-		sm.AddOrPanic(ActionHistoryNext, "ctrl+n")
-		sm.AddOrPanic(ActionHistoryFirst, "alt+<")
-		sm.AddOrPanic(ActionHistoryLast, "alt+>")
-		sm.AddOrPanic(ActionHistoryIncrementalSearchBackwards, "ctrl+r")
-		sm.AddOrPanic(ActionHistoryIncrementalSearchBackwards, "ctrl+?")
-		sm.AddOrPanic(ActionHistoryIncrementalSearchForwards, "ctrl+s")
-		sm.AddOrPanic(ActionHistoryIncrementalSearchForwards, "ctrl+/")
-
-		sm.AddOrPanic(ActionNumericArgumentDigit0, "alt+0")
-		sm.AddOrPanic(ActionNumericArgumentDigit1, "alt+1")
-		sm.AddOrPanic(ActionNumericArgumentDigit2, "alt+2")
-		sm.AddOrPanic(ActionNumericArgumentDigit3, "alt+3")
-		sm.AddOrPanic(ActionNumericArgumentDigit4, "alt+4")
-		sm.AddOrPanic(ActionNumericArgumentDigit5, "alt+5")
-		sm.AddOrPanic(ActionNumericArgumentDigit6, "alt+6")
-		sm.AddOrPanic(ActionNumericArgumentDigit7, "alt+7")
-		sm.AddOrPanic(ActionNumericArgumentDigit8, "alt+8")
-		sm.AddOrPanic(ActionNumericArgumentDigit9, "alt+9")
-		sm.AddOrPanic(ActionNumericArgumentDigitMinus, "alt+-")
-
-		sm.AddOrPanic(ActionCompleteForward, "Tab")
-		sm.AddOrPanic(ActionCompleteBackward, "Shift+Tab")
-		_default_shortcuts = sm
+		_default_shortcuts = new_default_shortcuts()
 	}
 	return _default_shortcuts
 }
 
+func new_default_shortcuts() *ShortcutMap {
+	sm := shortcuts.New[Action]()
+	sm.AddOrPanic(ActionBackspace, "backspace")
+	sm.AddOrPanic(ActionBackspace, "ctrl+h")
+	sm.AddOrPanic(ActionDelete, "delete")
+
+	sm.AddOrPanic(ActionHome, "home")
+	sm.AddOrPanic(ActionHome, "ctrl+a")
+	sm.AddOrPanic(ActionMoveToFirstNonBlank, "alt+m")
+
+	sm.AddOrPanic(ActionEnd, "end")
+	sm.AddOrPanic(ActionEnd, "ctrl+e")
+
+	sm.AddOrPanic(ActionMoveToStartOfDocument, "ctrl+home")
+	sm.AddOrPanic(ActionMoveToEndOfDocument, "ctrl+end")
+
+	sm.AddOrPanic(ActionMoveToEndOfWord, "alt+f")
+	sm.AddOrPanic(ActionMoveToEndOfWord, "ctrl+right")
+	sm.AddOrPanic(ActionMoveToEndOfWord, "alt+right")
+	sm.AddOrPanic(ActionMoveToStartOfWord, "ctrl+left")
+	sm.AddOrPanic(ActionMoveToStartOfWord, "alt+left")
+	sm.AddOrPanic(ActionMoveToStartOfWord, "alt+b")
+	sm.AddOrPanic(ActionMoveToNextParagraph, "alt+}")
+	sm.AddOrPanic(ActionMoveToPreviousParagraph, "alt+{")
+	sm.AddOrPanic(ActionQueryReplace, "alt+%")
+	sm.AddOrPanic(ActionExpandAbbreviation, "alt+space")
+
+	sm.AddOrPanic(ActionCursorLeft, "left")
+	sm.AddOrPanic(ActionCursorLeft, "ctrl+b")
+	sm.AddOrPanic(ActionCursorRight, "right")
+	sm.AddOrPanic(ActionCursorRight, "ctrl+f")
+
+	sm.AddOrPanic(ActionClearScreen, "ctrl+l")
+	sm.AddOrPanic(ActionSetMark, "ctrl+space")
+	sm.AddOrPanic(ActionAbortCurrentLine, "ctrl+c")
+	sm.AddOrPanic(ActionAbortCurrentLine, "ctrl+g")
+
+	sm.AddOrPanic(ActionEndInput, "ctrl+d")
+	sm.AddOrPanic(ActionAcceptInput, "enter")
+
+	sm.AddOrPanic(ActionKillToEndOfLine, "ctrl+k")
+	sm.AddOrPanic(ActionKillToStartOfLine, "ctrl+u")
+	sm.AddOrPanic(ActionKillNextWord, "alt+d")
+	sm.AddOrPanic(ActionKillPreviousWord, "alt+backspace")
+	sm.AddOrPanic(ActionKillPreviousSpaceDelimitedWord, "ctrl+w")
+	sm.AddOrPanic(ActionYank, "ctrl+y")
+	sm.AddOrPanic(ActionPopYank, "alt+y")
+
+	sm.AddOrPanic(ActionHistoryPreviousOrCursorUp, "up")
+	sm.AddOrPanic(ActionHistoryNextOrCursorDown, "down")
+	sm.AddOrPanic(ActionMoveLineUp, "alt+up")
+	sm.AddOrPanic(ActionMoveLineDown, "alt+down")
+	sm.AddOrPanic(ActionTransposeLines, "ctrl+x", "ctrl+t")
+	sm.AddOrPanic(ActionStartKeyboardMacro, "ctrl+x", "(")
+	sm.AddOrPanic(ActionEndKeyboardMacro, "ctrl+x", ")")
+	sm.AddOrPanic(ActionCallKeyboardMacro, "ctrl+x", "e")
+	sm.AddOrPanic(ActionDeleteBlankLines, "ctrl+x", "ctrl+o")
+	sm.AddOrPanic(ActionHistoryPrevious, "ctrl+p")
+	sm.AddOrPanic(ActionHistoryNext, "ctrl+n")
+	sm.AddOrPanic(ActionHistoryFirst, "alt+<")
+	sm.AddOrPanic(ActionHistoryLast, "alt+>")
+	sm.AddOrPanic(ActionHistoryIncrementalSearchBackwards, "ctrl+r")
+	sm.AddOrPanic(ActionHistoryIncrementalSearchBackwards, "ctrl+?")
+	sm.AddOrPanic(ActionHistoryIncrementalSearchForwards, "ctrl+s")
+	sm.AddOrPanic(ActionHistoryIncrementalSearchForwards, "ctrl+/")
+
+	sm.AddOrPanic(ActionNumericArgumentDigit0, "alt+0")
+	sm.AddOrPanic(ActionNumericArgumentDigit1, "alt+1")
+	sm.AddOrPanic(ActionNumericArgumentDigit2, "alt+2")
+	sm.AddOrPanic(ActionNumericArgumentDigit3, "alt+3")
+	sm.AddOrPanic(ActionNumericArgumentDigit4, "alt+4")
+	sm.AddOrPanic(ActionNumericArgumentDigit5, "alt+5")
+	sm.AddOrPanic(ActionNumericArgumentDigit6, "alt+6")
+	sm.AddOrPanic(ActionNumericArgumentDigit7, "alt+7")
+	sm.AddOrPanic(ActionNumericArgumentDigit8, "alt+8")
+	sm.AddOrPanic(ActionNumericArgumentDigit9, "alt+9")
+	sm.AddOrPanic(ActionNumericArgumentDigitMinus, "alt+-")
+
+	sm.AddOrPanic(ActionCompleteForward, "Tab")
+	sm.AddOrPanic(ActionCompleteBackward, "Shift+Tab")
+	sm.AddOrPanic(ActionPossibleCompletions, "alt+?")
+	sm.AddOrPanic(ActionInsertTab, "ctrl+v", "tab")
+	sm.AddOrPanic(ActionInsertCodePoint, "ctrl+v", "u")
+	sm.AddOrPanic(ActionInsertCodePoint, "ctrl+x", "8", "enter")
+	sm.AddOrPanic(ActionInsertCommandOutput, "ctrl+v", "!")
+	sm.AddOrPanic(ActionFilterThroughCommand, "ctrl+v", "|")
+	sm.AddOrPanic(ActionIndent, "ctrl+v", ">")
+	sm.AddOrPanic(ActionDedent, "ctrl+v", "<")
+	sm.AddOrPanic(ActionDismissCompletions, "escape")
+	return sm
+}
+
 var _history_search_shortcuts *shortcuts.ShortcutMap[Action]
 
 func history_search_shortcuts() *shortcuts.ShortcutMap[Action] {
@@ -139,6 +164,23 @@ func history_search_shortcuts() *shortcuts.ShortcutMap[Action] {
 	return _history_search_shortcuts
 }
 
+var _completion_paging_shortcuts *shortcuts.ShortcutMap[Action]
+
+func completion_paging_shortcuts() *shortcuts.ShortcutMap[Action] {
+	if _completion_paging_shortcuts == nil {
+		sm := shortcuts.New[Action]()
+		sm.AddOrPanic(ActionShowMoreCompletions, "y")
+		sm.AddOrPanic(ActionShowMoreCompletions, "space")
+		sm.AddOrPanic(ActionDismissCompletions, "n")
+		sm.AddOrPanic(ActionDismissCompletions, "q")
+		sm.AddOrPanic(ActionDismissCompletions, "escape")
+		sm.AddOrPanic(ActionDismissCompletions, "ctrl+c")
+		sm.AddOrPanic(ActionDismissCompletions, "ctrl+g")
+		_completion_paging_shortcuts = sm
+	}
+	return _completion_paging_shortcuts
+}
+
 var ErrCouldNotPerformAction = errors.New("Could not perform the specified action")
 var ErrAcceptInput = errors.New("Accept input")
 
@@ -195,14 +237,52 @@ func (self *Readline) dispatch_key_action(ac Action) error {
 	if err != nil || repeat_count <= 0 {
 		repeat_count = 1
 	}
-	return self.perform_action(ac, uint(repeat_count))
+	if len(self.action_middleware) == 0 {
+		return self.perform_action(ac, uint(repeat_count))
+	}
+	for _, m := range self.action_middleware {
+		if m.Before != nil && !m.Before(ac, uint(repeat_count)) {
+			return ErrCouldNotPerformAction
+		}
+	}
+	err = self.perform_action(ac, uint(repeat_count))
+	for _, m := range self.action_middleware {
+		if m.After != nil {
+			m.After(ac, uint(repeat_count), err)
+		}
+	}
+	return err
+}
+
+var modifier_keys = map[string]bool{
+	"LEFT_SHIFT": true, "LEFT_CONTROL": true, "LEFT_ALT": true, "LEFT_SUPER": true, "LEFT_HYPER": true, "LEFT_META": true,
+	"RIGHT_SHIFT": true, "RIGHT_CONTROL": true, "RIGHT_ALT": true, "RIGHT_SUPER": true, "RIGHT_HYPER": true, "RIGHT_META": true,
+	"ISO_LEVEL3_SHIFT": true, "ISO_LEVEL5_SHIFT": true, "CAPS_LOCK": true, "NUM_LOCK": true,
+}
+
+// Whether the event is for a key that is only ever used as a modifier, such
+// events are reported by the kitty keyboard protocol when all keys are
+// reported as escape codes
+func is_modifier_key(event *loop.KeyEvent) bool {
+	return modifier_keys[event.Key]
 }
 
 func (self *Readline) handle_key_event(event *loop.KeyEvent) error {
-	if event.Text != "" {
+	// releasing the keys of a multi-key shortcut or pressing the modifiers
+	// needed for its next key must not cancel it
+	if len(self.keyboard_state.current_pending_keys) > 0 && (event.Type == loop.RELEASE || is_modifier_key(event)) {
+		event.Handled = true
+		return nil
+	}
+	// keys that produce text are shortcuts only when continuing a multi-key
+	// shortcut such as: ctrl+x (
+	if event.Text != "" && len(self.keyboard_state.active_shortcut_maps) == 0 && len(self.keyboard_state.current_pending_keys) == 0 {
 		return nil
 	}
-	sm := default_shortcuts()
+	sm := self.shortcuts
+	if sm == nil {
+		sm = default_shortcuts()
+	}
 	if len(self.keyboard_state.active_shortcut_maps) > 0 {
 		sm = self.keyboard_state.active_shortcut_maps[len(self.keyboard_state.active_shortcut_maps)-1]
 	}
@@ -219,6 +299,12 @@ func (self *Readline) handle_key_event(event *loop.KeyEvent) error {
 			event.Handled = true
 			return self.dispatch_key_action(ac)
 		}
+		// any other key dismisses the completion paging prompt and is then
+		// handled normally
+		if sm == completion_paging_shortcuts() && event.Type != loop.RELEASE && !is_modifier_key(event) {
+			self.dismiss_completions()
+			return self.handle_key_event(event)
+		}
 	}
 	return nil
 }
@@ -0,0 +1,94 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package readline
+
+import (
+	"fmt"
+
+	"kitty/tools/tui/loop"
+)
+
+var _ = fmt.Print
+
+// A key event or, for input that did not come from a key event, such as
+// pasted text, the arguments to OnText()
+type macro_input struct {
+	event              *loop.KeyEvent
+	text               string
+	in_bracketed_paste bool
+}
+
+type keyboard_macro struct {
+	recording, replaying bool
+	inputs, last         []macro_input
+	// The index of the first input of the key sequence being handled, so
+	// that the keys that end recording are not part of the macro
+	sequence_start int
+}
+
+func (self *Readline) record_key_event(event *loop.KeyEvent) {
+	m := &self.keyboard_macro
+	if !m.recording {
+		return
+	}
+	if len(self.keyboard_state.current_pending_keys) == 0 {
+		m.sequence_start = len(m.inputs)
+	}
+	ev := *event
+	m.inputs = append(m.inputs, macro_input{event: &ev})
+}
+
+func (self *Readline) record_text(text string, in_bracketed_paste bool) {
+	m := &self.keyboard_macro
+	if m.recording {
+		m.inputs = append(m.inputs, macro_input{text: text, in_bracketed_paste: in_bracketed_paste})
+		m.sequence_start = len(m.inputs)
+	}
+}
+
+func (self *Readline) start_keyboard_macro() bool {
+	m := &self.keyboard_macro
+	if m.recording || m.replaying {
+		return false
+	}
+	m.recording, m.inputs = true, nil
+	return true
+}
+
+func (self *Readline) end_keyboard_macro() bool {
+	m := &self.keyboard_macro
+	if !m.recording {
+		return false
+	}
+	m.recording = false
+	if m.inputs = m.inputs[:m.sequence_start]; len(m.inputs) > 0 {
+		m.last = m.inputs
+	}
+	m.inputs = nil
+	return true
+}
+
+// Replay the last recorded macro amt times, stopping at the first error
+func (self *Readline) call_keyboard_macro(amt uint) (bool, error) {
+	m := &self.keyboard_macro
+	if m.recording || m.replaying || len(m.last) == 0 {
+		return false, nil
+	}
+	m.replaying = true
+	defer func() { m.replaying = false }()
+	for ; amt > 0; amt-- {
+		for _, x := range m.last {
+			var err error
+			if x.event != nil {
+				ev := *x.event
+				err = self.FeedKeyEvent(&ev)
+			} else {
+				err = self.OnText(x.text, false, x.in_bracketed_paste)
+			}
+			if err != nil {
+				return true, err
+			}
+		}
+	}
+	return true, nil
+}
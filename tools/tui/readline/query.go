@@ -0,0 +1,93 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package readline
+
+import (
+	"fmt"
+	"strings"
+
+	"kitty/tools/tui/loop"
+)
+
+var _ = fmt.Print
+
+// Called with the key pressed in response to a query. The returned error is
+// returned from OnKeyEvent() or OnText().
+type QueryFunction = func(event *loop.KeyEvent) error
+
+// A question displayed in the message row below the input, answered by the
+// next key press
+type query struct {
+	message  string
+	callback QueryFunction
+}
+
+func (self *Readline) query_message() string {
+	if self.query == nil {
+		return ""
+	}
+	return self.query.message
+}
+
+// Display message in the message row until the next action
+func (self *Readline) show_message(message string) {
+	self.message = message
+}
+
+func (self *Readline) start_query(message string, callback QueryFunction) {
+	self.query = &query{message: message, callback: callback}
+	self.keyboard_state.current_pending_keys = nil
+}
+
+// Answer the current query, if any, with the specified key event, returning
+// true if there was a query
+func (self *Readline) answer_query(event *loop.KeyEvent) (bool, error) {
+	q := self.query
+	if q == nil {
+		return false, nil
+	}
+	event.Handled = true
+	// the modifiers needed to type the answer are not the answer
+	if event.Type == loop.RELEASE || is_modifier_key(event) {
+		return true, nil
+	}
+	self.query = nil
+	err := q.callback(event)
+	self.Redraw()
+	return true, err
+}
+
+func (self *Readline) answer_query_with_text(text string) (bool, error) {
+	if self.query == nil || text == "" {
+		return false, nil
+	}
+	key := string([]rune(text)[:1])
+	return self.answer_query(&loop.KeyEvent{Type: loop.PRESS, Key: strings.ToLower(key), Text: key})
+}
+
+func yes_no_query(callback func(bool) error) QueryFunction {
+	return func(event *loop.KeyEvent) error {
+		return callback(strings.ToLower(event.Text) == "y")
+	}
+}
+
+// Read a line of text in the message row, calling callback with it when
+// enter is pressed. Pressing escape cancels.
+func (self *Readline) read_string(prompt, text string, callback func(string) error) {
+	self.start_query(prompt+text, func(event *loop.KeyEvent) error {
+		switch {
+		case event.MatchesPressOrRepeat("enter"):
+			return callback(text)
+		case event.MatchesPressOrRepeat("escape") || event.MatchesPressOrRepeat("ctrl+c") || event.MatchesPressOrRepeat("ctrl+g"):
+			return nil
+		case event.MatchesPressOrRepeat("backspace"):
+			if r := []rune(text); len(r) > 0 {
+				text = string(r[:len(r)-1])
+			}
+		default:
+			text += event.Text
+		}
+		self.read_string(prompt, text, callback)
+		return nil
+	})
+}
@@ -0,0 +1,95 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package readline
+
+import (
+	"fmt"
+	"strings"
+
+	"kitty/tools/tui/loop"
+)
+
+var _ = fmt.Print
+
+// An interactive replacement of the occurrences of from after the cursor,
+// asking about each one in turn
+type query_replace struct {
+	from, to string
+	// The byte offset into the full text of the current match
+	offset int
+}
+
+func (self *Readline) start_query_replace() {
+	self.read_string("Query replace: ", "", func(from string) error {
+		if from == "" {
+			return nil
+		}
+		self.read_string(fmt.Sprintf("Query replace %s with: ", from), "", func(to string) error {
+			self.query_replace = &query_replace{from: from, to: to}
+			self.next_query_replace_match(position_to_offset(self.input_state.lines, self.input_state.cursor))
+			return nil
+		})
+		return nil
+	})
+}
+
+// Move to the next match at or after offset and ask whether to replace it
+func (self *Readline) next_query_replace_match(offset int) {
+	qr := self.query_replace
+	text := self.all_text()
+	idx := strings.Index(text[offset:], qr.from)
+	if idx < 0 {
+		self.query_replace = nil
+		return
+	}
+	qr.offset = offset + idx
+	self.input_state.cursor = offset_to_position(text, qr.offset)
+	self.ask_query_replace()
+}
+
+func (self *Readline) ask_query_replace() {
+	qr := self.query_replace
+	self.start_query(fmt.Sprintf("Replace %s with %s? (y, n, !, ., q)", qr.from, qr.to), self.on_query_replace_key)
+}
+
+// Replace the current match, returning the offset just after the
+// replacement
+func (self *Readline) replace_query_replace_match() int {
+	qr := self.query_replace
+	text := self.all_text()
+	self.erase_between(offset_to_position(text, qr.offset), offset_to_position(text, qr.offset+len(qr.from)))
+	self.input_state.cursor = offset_to_position(text, qr.offset)
+	self.add_text(qr.to)
+	return qr.offset + len(qr.to)
+}
+
+func (self *Readline) on_query_replace_key(event *loop.KeyEvent) error {
+	qr := self.query_replace
+	switch {
+	case event.Text == "y" || event.Text == " ":
+		self.next_query_replace_match(self.replace_query_replace_match())
+	case event.Text == "n" || event.MatchesPressOrRepeat("backspace") || event.MatchesPressOrRepeat("delete"):
+		self.next_query_replace_match(qr.offset + len(qr.from))
+	case event.Text == "!":
+		for self.query_replace != nil {
+			self.next_query_replace_match(self.replace_query_replace_match())
+		}
+		self.query = nil
+	case event.Text == ".":
+		self.replace_query_replace_match()
+		self.query_replace = nil
+	case event.Text == "q" || event.MatchesPressOrRepeat("enter") || event.MatchesPressOrRepeat("escape") || event.MatchesPressOrRepeat("ctrl+g"):
+		self.query_replace = nil
+	default:
+		self.ask_query_replace()
+	}
+	return nil
+}
+
+func (self *Readline) query_replace_highlighter(text string, x, y int) string {
+	qr := self.query_replace
+	if qr.offset+len(qr.from) > len(text) {
+		return text
+	}
+	return text[:qr.offset] + self.fmt_ctx.Yellow(qr.from) + text[qr.offset+len(qr.from):]
+}
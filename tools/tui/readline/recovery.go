@@ -0,0 +1,88 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package readline
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"kitty/tools/tui/loop"
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// The unaccepted input is saved to path every interval, so that it can be
+// restored if the program crashes
+type recovery struct {
+	path     string
+	interval time.Duration
+	timer_id loop.IdType
+	saved    string
+}
+
+func (self *Readline) stop_recovery_timer() {
+	if self.recovery.timer_id != 0 {
+		self.remove_timer(self.recovery.timer_id)
+		self.recovery.timer_id = 0
+	}
+}
+
+func (self *Readline) start_recovery_timer() {
+	self.stop_recovery_timer()
+	if self.recovery.path == "" {
+		return
+	}
+	interval := self.recovery.interval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	if id, err := self.add_timer(interval, true, func(loop.IdType) error {
+		self.save_recovery()
+		return nil
+	}); err == nil {
+		self.recovery.timer_id = id
+	}
+}
+
+// Write the input to the recovery file if it has changed since it was last
+// written, removing the file when there is no input
+func (self *Readline) save_recovery() {
+	text := self.all_text()[len(self.protected_prefix):]
+	if self.recovery.path == "" || text == self.recovery.saved {
+		return
+	}
+	if text == "" {
+		self.clear_recovery()
+		return
+	}
+	// Write atomically so that a crash while saving cannot destroy the
+	// previously saved input
+	if err := utils.AtomicUpdateFile(self.recovery.path, utils.UnsafeStringToBytes(text), 0o600); err == nil {
+		self.recovery.saved = text
+	}
+}
+
+func (self *Readline) clear_recovery() {
+	if self.recovery.path != "" {
+		if err := os.Remove(self.recovery.path); err == nil || errors.Is(err, fs.ErrNotExist) {
+			self.recovery.saved = ""
+		}
+	}
+}
+
+// The input saved in the RlInit.RecoveryPath file by a previous run that did
+// not end cleanly, if any. Pass it to SetText() to restore it.
+func (self *Readline) RecoveredText() (string, bool) {
+	if self.recovery.path == "" {
+		return "", false
+	}
+	data, err := os.ReadFile(self.recovery.path)
+	if err != nil || len(data) == 0 {
+		return "", false
+	}
+	return string(data), true
+}
@@ -0,0 +1,436 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package readline
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"kitty/tools/tui/loop"
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// The region is the text between the mark and the cursor. It is active from
+// when the mark is set until the next action that is not a cursor movement.
+type region struct {
+	mark   Position
+	active bool
+}
+
+func is_cursor_movement_action(ac Action) bool {
+	switch ac {
+	case ActionMoveToStartOfLine, ActionMoveToFirstNonBlank, ActionMoveToEndOfLine, ActionMoveToStartOfDocument, ActionMoveToEndOfDocument,
+		ActionHome, ActionEnd,
+		ActionMoveToEndOfWord, ActionMoveToStartOfWord, ActionCursorLeft, ActionCursorRight, ActionCursorUp, ActionCursorDown,
+		ActionSetMark, ActionJumpToPreviousEdit, ActionJumpToNextEdit, ActionMoveToFirstLine, ActionMoveToLastLine,
+		ActionMoveToNextParagraph, ActionMoveToPreviousParagraph:
+		return true
+	}
+	return false
+}
+
+// Actions after which the region remains active, so that they can be repeated
+// on it
+func keeps_region_active(ac Action) bool {
+	return is_cursor_movement_action(ac) || ac == ActionIndent || ac == ActionDedent
+}
+
+func (self *Readline) set_mark() {
+	self.region = region{mark: self.input_state.cursor, active: true}
+}
+
+// Draw the text in the active region in reverse video, on top of the
+// highlighting by the wrapped highlighter, if any
+func (self *Readline) region_highlighter(highlight SyntaxHighlightFunction) SyntaxHighlightFunction {
+	return func(text string, x, y int) string {
+		start, end, _ := self.active_region()
+		lines := strings.Split(text, "\n")
+		hlines := lines
+		if highlight != nil {
+			hlines = utils.Splitlines(highlight(text, x, y))
+		}
+		for i := start.Y; i <= end.Y && i < len(lines) && i < len(hlines); i++ {
+			line := lines[i]
+			s, e := 0, len(line)
+			if i == start.Y {
+				s = start.X
+			}
+			if i == end.Y {
+				e = end.X
+			}
+			if s < e && e <= len(line) {
+				hline := hlines[i]
+				before := self.truncate_to_visual_length(hline, self.stringwidth(line[:s]))
+				upto := self.truncate_to_visual_length(hline, self.stringwidth(line[:e]))
+				// Re-apply reverse video after every SGR code in the region
+				// so that the highlighter cannot turn it off
+				inside := utils.MustCompile("\x1b\\[[0-9:;]*m").ReplaceAllString(hline[len(before):len(upto)], "${0}\x1b[7m")
+				hlines[i] = before + self.fmt_ctx.Reverse(inside) + hline[len(upto):]
+			}
+		}
+		return strings.Join(hlines, "\n")
+	}
+}
+
+func (self *Readline) kill_region() bool {
+	start, end, ok := self.active_region()
+	if !ok || start == end {
+		return false
+	}
+	self.kill_text(self.erase_between(start, end))
+	self.input_state.cursor = start
+	return true
+}
+
+// The initial selection, an empty one for a single click, which dragging
+// extends
+type mouse_selection struct {
+	active                   bool
+	anchor_start, anchor_end Position
+}
+
+// Start selecting with the mouse at the screen cell at row and col. A double
+// click selects the word there and a triple click the line.
+func (self *Readline) mouse_press(row, col, clicks int) bool {
+	if !self.move_cursor_to_screen_cell(row, col) {
+		return false
+	}
+	switch clicks {
+	case 2:
+		self.region = region{mark: self.start_of_word_before_cursor(has_word_chars), active: true}
+		self.input_state.cursor = self.end_of_word_after_cursor(has_word_chars)
+	case 3:
+		y := self.input_state.cursor.Y
+		self.region = region{mark: Position{X: self.line_start(y), Y: y}, active: true}
+		self.input_state.cursor.X = len(self.input_state.lines[y])
+	default:
+		self.set_mark()
+	}
+	self.mouse_selection = mouse_selection{active: true, anchor_start: self.region.mark, anchor_end: self.input_state.cursor}
+	return true
+}
+
+// Extend the selection from what was initially selected to the screen cell
+// at row and col
+func (self *Readline) mouse_drag(row, col int) bool {
+	m := &self.mouse_selection
+	if !m.active || !self.move_cursor_to_screen_cell(row, col) {
+		return false
+	}
+	switch pos := self.input_state.cursor; {
+	case pos.Less(m.anchor_start):
+		self.region.mark = m.anchor_end
+	case m.anchor_end.Less(pos):
+		self.region.mark = m.anchor_start
+	default:
+		self.region.mark, self.input_state.cursor = m.anchor_start, m.anchor_end
+	}
+	return true
+}
+
+func (self *Readline) mouse_release(row, col int) bool {
+	if !self.mouse_selection.active {
+		return false
+	}
+	self.mouse_drag(row, col)
+	self.mouse_selection.active = false
+	if self.region.mark == self.input_state.cursor {
+		self.region.active = false
+	}
+	return true
+}
+
+// The start and end of the active region, ok is false if there is no active
+// region
+func (self *Readline) active_region() (start, end Position, ok bool) {
+	if !self.region.active {
+		return
+	}
+	start, end = *self.ensure_position_in_bounds(&self.region.mark), self.input_state.cursor
+	if end.Less(start) {
+		start, end = end, start
+	}
+	return start, end, true
+}
+
+// The range of lines covered by the active region or all lines if there is
+// no active region
+func (self *Readline) lines_in_region() (first, last int) {
+	if start, end, ok := self.active_region(); ok {
+		return start.Y, end.Y
+	}
+	return 0, len(self.input_state.lines) - 1
+}
+
+func (self *Readline) transform_lines_in_region(transform func([]string) []string) bool {
+	first, last := self.lines_in_region()
+	if first == last {
+		return false
+	}
+	lines := make([]string, last-first+1)
+	copy(lines, self.input_state.lines[first:last+1])
+	lines = transform(lines)
+	new_lines := make([]string, 0, len(self.input_state.lines))
+	new_lines = append(new_lines, self.input_state.lines[:first]...)
+	new_lines = append(new_lines, lines...)
+	new_lines = append(new_lines, self.input_state.lines[last+1:]...)
+	self.input_state.lines = new_lines
+	self.input_state.cursor.Y = utils.Min(self.input_state.cursor.Y, len(new_lines)-1)
+	self.input_state.cursor.X = utils.Min(self.input_state.cursor.X, len(new_lines[self.input_state.cursor.Y]))
+	return true
+}
+
+func (self *Readline) sort_lines() bool {
+	return self.transform_lines_in_region(func(lines []string) []string {
+		sort.Strings(lines)
+		return lines
+	})
+}
+
+func (self *Readline) unique_lines() bool {
+	return self.transform_lines_in_region(func(lines []string) []string {
+		seen := make(map[string]bool, len(lines))
+		ans := lines[:0]
+		for _, line := range lines {
+			if !seen[line] {
+				seen[line] = true
+				ans = append(ans, line)
+			}
+		}
+		return ans
+	})
+}
+
+// Remove trailing whitespace from the current line, the lines in the active
+// region or, if all is true, every line
+func (self *Readline) delete_trailing_whitespace(all bool) bool {
+	first, last := self.input_state.cursor.Y, self.input_state.cursor.Y
+	if all {
+		first, last = 0, len(self.input_state.lines)-1
+	} else if start, end, ok := self.active_region(); ok {
+		first, last = start.Y, end.Y
+	}
+	changed := false
+	for i := first; i <= last; i++ {
+		line := self.input_state.lines[i]
+		if trimmed := strings.TrimRightFunc(line, unicode.IsSpace); len(trimmed) != len(line) {
+			self.input_state.lines[i] = trimmed
+			changed = true
+		}
+	}
+	self.input_state.cursor.X = utils.Min(self.input_state.cursor.X, len(self.input_state.lines[self.input_state.cursor.Y]))
+	return changed
+}
+
+// Convert the first letter of every line in the active region, or of every
+// line if there is no region, to title case
+func (self *Readline) capitalize_lines() bool {
+	first, last := self.lines_in_region()
+	changed := false
+	for i := first; i <= last; i++ {
+		line := self.input_state.lines[i]
+		idx := strings.IndexFunc(line, unicode.IsLetter)
+		if idx < 0 {
+			continue
+		}
+		ch, sz := utf8.DecodeRuneInString(line[idx:])
+		title := string(unicode.ToTitle(ch))
+		if title == line[idx:idx+sz] {
+			continue
+		}
+		self.input_state.lines[i] = line[:idx] + title + line[idx+sz:]
+		if self.input_state.cursor.Y == i && self.input_state.cursor.X > idx {
+			self.input_state.cursor.X += len(title) - sz
+		}
+		changed = true
+	}
+	return changed
+}
+
+func swap_case(text string) string {
+	return strings.Map(func(ch rune) rune {
+		switch {
+		case unicode.IsUpper(ch) || unicode.IsTitle(ch):
+			return unicode.ToLower(ch)
+		case unicode.IsLower(ch):
+			return unicode.ToUpper(ch)
+		}
+		return ch
+	}, text)
+}
+
+// Invert the case of the letters in the active region or, if there is none,
+// in the word the cursor is in
+func (self *Readline) swap_case_of_region() bool {
+	start, end, ok := self.active_region()
+	if !ok {
+		start, end = self.start_of_word_before_cursor(has_word_chars), self.end_of_word_after_cursor(has_word_chars)
+	}
+	s, e := position_to_offset(self.input_state.lines, start), position_to_offset(self.input_state.lines, end)
+	text := self.all_text()[s:e]
+	swapped := swap_case(text)
+	if swapped == text {
+		return false
+	}
+	cursor := self.input_state.cursor
+	self.replace_range(s, e, swapped)
+	if len(swapped) == len(text) {
+		self.input_state.cursor = cursor
+	}
+	return true
+}
+
+func (self *Readline) indent_unit() string {
+	if self.insert_spaces_for_tab {
+		return strings.Repeat(" ", self.shift_width)
+	}
+	return "\t"
+}
+
+// The current line or the lines in the active region, excluding the last
+// line if the region ends at its start
+func (self *Readline) lines_to_indent() (first, last int) {
+	first, last = self.input_state.cursor.Y, self.input_state.cursor.Y
+	if start, end, ok := self.active_region(); ok {
+		first, last = start.Y, end.Y
+		if end.X == 0 && last > first {
+			last--
+		}
+	}
+	return
+}
+
+// Change the indentation of the current line or the lines in the active
+// region by amt levels, dedenting if amt is negative. Blank lines are not
+// indented.
+func (self *Readline) indent_lines(amt int) bool {
+	first, last := self.lines_to_indent()
+	unit := self.indent_unit()
+	changed := false
+	for i := first; i <= last; i++ {
+		line := self.input_state.lines[i]
+		if amt > 0 {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			line = strings.Repeat(unit, amt) + line
+		} else {
+			for n := amt; n < 0 && line != ""; n++ {
+				if line[0] == '\t' {
+					line = line[1:]
+					continue
+				}
+				spaces := len(line) - len(strings.TrimLeft(line, " "))
+				if spaces == 0 {
+					break
+				}
+				spaces = utils.Min(spaces, self.shift_width)
+				line = line[spaces:]
+			}
+		}
+		delta := len(line) - len(self.input_state.lines[i])
+		if delta == 0 {
+			continue
+		}
+		self.input_state.lines[i] = line
+		changed = true
+		for _, pos := range []*Position{&self.input_state.cursor, &self.region.mark} {
+			if pos.Y == i {
+				pos.X = utils.Max(0, utils.Min(pos.X+delta, len(line)))
+			}
+		}
+	}
+	return changed
+}
+
+// Remove all leading whitespace from the current line or the lines in the
+// active region. A cursor in the removed whitespace is moved to the first
+// non-whitespace character.
+func (self *Readline) delete_indentation() bool {
+	first, last := self.lines_to_indent()
+	changed := false
+	for i := first; i <= last; i++ {
+		line := self.input_state.lines[i]
+		indent := len(line) - len(strings.TrimLeft(line, " \t"))
+		if indent == 0 {
+			continue
+		}
+		self.input_state.lines[i] = line[indent:]
+		changed = true
+		for _, pos := range []*Position{&self.input_state.cursor, &self.region.mark} {
+			if pos.Y == i {
+				pos.X = utils.Max(0, pos.X-indent)
+			}
+		}
+	}
+	return changed
+}
+
+func clipboard_escape_code(text string) string {
+	return "\x1b]52;c;" + base64.StdEncoding.EncodeToString(utils.UnsafeStringToBytes(text)) + ST
+}
+
+// The text in the active region or, if there is none, the current line
+func (self *Readline) region_or_line_text() string {
+	if start, end, ok := self.active_region(); ok {
+		return self.all_text()[position_to_offset(self.input_state.lines, start):position_to_offset(self.input_state.lines, end)]
+	}
+	return self.input_state.lines[self.input_state.cursor.Y]
+}
+
+// Copy the active region or the current line to the system clipboard using
+// OSC 52, leaving the text and kill ring as they are
+func (self *Readline) copy_to_clipboard() bool {
+	text := self.region_or_line_text()
+	if text == "" {
+		return false
+	}
+	self.queue_write(clipboard_escape_code(text))
+	return true
+}
+
+var surround_pairs = map[string][2]string{
+	"(": {"(", ")"}, ")": {"(", ")"}, "[": {"[", "]"}, "]": {"[", "]"},
+	"{": {"{", "}"}, "}": {"{", "}"}, "<": {"<", ">"}, ">": {"<", ">"},
+}
+
+// Surround the active region or, if there is none, the space delimited word
+// at the cursor with open and close. The cursor is placed after close, or
+// between the two if they surround nothing.
+func (self *Readline) surround_with(open, close string) {
+	start, end, ok := self.active_region()
+	if !ok {
+		start, end = self.start_of_word_before_cursor(has_no_space_chars), self.end_of_word_after_cursor(has_no_space_chars)
+	}
+	so, eo := position_to_offset(self.input_state.lines, start), position_to_offset(self.input_state.lines, end)
+	self.input_state.cursor = end
+	self.add_text(close)
+	self.input_state.cursor = start
+	self.add_text(open)
+	cursor := eo + len(open)
+	if so != eo {
+		cursor += len(close)
+	}
+	self.input_state.cursor = offset_to_position(self.all_text(), cursor)
+	self.region.active = false
+}
+
+// Surround with the pair of delimiters for the pressed key, the character
+// itself on both sides if it is not a bracket
+func (self *Readline) surround_with_key(event *loop.KeyEvent) error {
+	if event.Text == "" {
+		return nil
+	}
+	pair, found := surround_pairs[event.Text]
+	if !found {
+		pair = [2]string{event.Text, event.Text}
+	}
+	self.surround_with(pair[0], pair[1])
+	return nil
+}
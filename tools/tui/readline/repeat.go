@@ -0,0 +1,62 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package readline
+
+import (
+	"fmt"
+)
+
+var _ = fmt.Print
+
+// The last action that changed the text, for ActionRepeatLastChange
+type last_change struct {
+	action       Action
+	repeat_count uint
+	// The text inserted by ActionAddText, consecutive insertions are merged
+	text      string
+	repeating bool
+}
+
+func is_repeatable_change(ac Action) bool {
+	switch ac {
+	case ActionNil, ActionRepeatLastChange, ActionHistoryPreviousOrCursorUp, ActionHistoryNextOrCursorDown, ActionHistoryNext,
+		ActionHistoryPrevious, ActionHistoryFirst, ActionHistoryLast, ActionTerminateHistorySearchAndApply,
+		ActionTerminateHistorySearchAndRestore, ActionAbortCurrentLine, ActionAcceptAutoSuggestion, ActionAcceptAutoSuggestionWord,
+		ActionCallKeyboardMacro:
+		return false
+	}
+	return !is_completion_action(ac)
+}
+
+// Called after ac, which inserted text if it is ActionAddText, changed the
+// text
+func (self *Readline) record_change(ac Action, repeat_count uint, text string) {
+	c := &self.last_change
+	if ac == ActionAddText {
+		if c.action == ActionAddText && self.last_action == ActionAddText {
+			c.text += text
+		} else {
+			c.action, c.repeat_count, c.text = ac, 1, text
+		}
+		return
+	}
+	c.action, c.repeat_count, c.text = ac, repeat_count, ""
+}
+
+// Perform the last change again at the cursor. A repeat count other than one
+// replaces that of the original action.
+func (self *Readline) repeat_last_change(repeat_count uint) (bool, error) {
+	c := &self.last_change
+	if c.action == ActionNil || c.repeating {
+		return false, nil
+	}
+	if repeat_count < 2 {
+		repeat_count = c.repeat_count
+	}
+	c.repeating = true
+	defer func() { c.repeating = false }()
+	if c.action == ActionAddText {
+		self.text_to_be_added = c.text
+	}
+	return true, self.perform_action(c.action, repeat_count)
+}
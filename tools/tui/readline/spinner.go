@@ -0,0 +1,61 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package readline
+
+import (
+	"fmt"
+
+	"kitty/tools/tui"
+	"kitty/tools/tui/loop"
+)
+
+var _ = fmt.Print
+
+// An activity indicator displayed in the message row below the input
+type spinner struct {
+	spinner  *tui.Spinner
+	message  string
+	timer_id loop.IdType
+	// Incremented every time a spinner is started, so that whoever started
+	// one can stop it without stopping one started later by someone else
+	generation uint64
+}
+
+func (self *Readline) spinner_message() string {
+	if self.spinner.spinner == nil {
+		return ""
+	}
+	ans := self.spinner.spinner.Tick()
+	if self.spinner.message != "" {
+		ans += " " + self.spinner.message
+	}
+	return ans
+}
+
+func (self *Readline) start_spinner(message string) uint64 {
+	self.stop_spinner()
+	self.spinner.generation++
+	self.spinner.spinner = tui.NewSpinner("dots")
+	self.spinner.message = message
+	if id, err := self.add_timer(self.spinner.spinner.Interval(), true, func(loop.IdType) error {
+		self.Redraw()
+		return nil
+	}); err == nil {
+		self.spinner.timer_id = id
+	}
+	return self.spinner.generation
+}
+
+func (self *Readline) stop_spinner() {
+	if self.spinner.timer_id != 0 {
+		self.remove_timer(self.spinner.timer_id)
+	}
+	self.spinner = spinner{generation: self.spinner.generation}
+}
+
+// Stop the spinner if it is the one whose start returned generation
+func (self *Readline) stop_spinner_if_current(generation uint64) {
+	if self.spinner.spinner != nil && self.spinner.generation == generation {
+		self.stop_spinner()
+	}
+}
@@ -0,0 +1,64 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package readline
+
+import (
+	"container/list"
+	"fmt"
+)
+
+var _ = fmt.Print
+
+// A snapshot of the editing state of a Readline, see Readline.State()
+type State struct {
+	input_state      InputState
+	kill_ring        kill_ring
+	last_action      Action
+	last_yank_extent struct {
+		start, end Position
+	}
+	region         region
+	edit_locations edit_locations
+	seeded_text    string
+	modified       bool
+}
+
+func (self *kill_ring) copy() kill_ring {
+	ans := kill_ring{items: list.New().Init()}
+	for e := self.items.Front(); e != nil; e = e.Next() {
+		ans.items.PushBack(e.Value)
+	}
+	return ans
+}
+
+func (self edit_locations) copy() edit_locations {
+	self.offsets = append([]int(nil), self.offsets...)
+	return self
+}
+
+func (self *Readline) state() *State {
+	return &State{
+		input_state: self.input_state.copy(), kill_ring: self.kill_ring.copy(), last_action: self.last_action,
+		last_yank_extent: self.last_yank_extent, region: self.region, edit_locations: self.edit_locations.copy(),
+		seeded_text: self.seeded_text, modified: self.modified,
+	}
+}
+
+// The screen position of the cursor is not part of the state as it
+// reflects what is currently on screen
+func (self *Readline) restore_state(s *State) {
+	if self.history_search != nil {
+		self.end_history_search(false)
+	}
+	self.dismiss_completions()
+	self.keyboard_state = KeyboardState{}
+	self.history_matches = nil
+	self.input_state = s.input_state.copy()
+	self.kill_ring = s.kill_ring.copy()
+	self.last_action = s.last_action
+	self.last_yank_extent = s.last_yank_extent
+	self.region = s.region
+	self.edit_locations = s.edit_locations.copy()
+	self.seeded_text, self.modified = s.seeded_text, s.modified
+	self.reset_autosuggestion()
+}
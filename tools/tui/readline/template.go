@@ -0,0 +1,165 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package readline
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// The syntax for placeholders in templates, by default placeholders look
+// like: ${1:default text} or ${2}. Fields are visited in order of their
+// numbers.
+type TemplateSyntax struct {
+	Start, Separator, End string
+}
+
+var default_template_syntax = TemplateSyntax{Start: "${", Separator: ":", End: "}"}
+
+type template_field struct {
+	number, start, end int
+}
+
+// An inserted template whose fields are being filled in. The field extents
+// are byte offsets into text, the full text as of the last action.
+type template struct {
+	fields []template_field
+	// The field containing the cursor and whether its default text is yet
+	// to be replaced
+	current  int
+	pristine bool
+	text     string
+}
+
+func (self *Readline) template_syntax() TemplateSyntax {
+	if self.template_syntax_override != nil {
+		return *self.template_syntax_override
+	}
+	return default_template_syntax
+}
+
+// Render the template, returning the rendered text and the fields, sorted by
+// number, as offsets into it. Malformed placeholders are left as is.
+func parse_template(text string, syntax TemplateSyntax) (string, []template_field) {
+	buf := strings.Builder{}
+	buf.Grow(len(text))
+	var fields []template_field
+	for {
+		idx := strings.Index(text, syntax.Start)
+		if idx < 0 {
+			break
+		}
+		buf.WriteString(text[:idx])
+		rest := text[idx+len(syntax.Start):]
+		digits := 0
+		for digits < len(rest) && '0' <= rest[digits] && rest[digits] <= '9' {
+			digits++
+		}
+		body, after, found := strings.Cut(rest[digits:], syntax.End)
+		if digits == 0 || !found || (body != "" && !strings.HasPrefix(body, syntax.Separator)) {
+			buf.WriteString(syntax.Start)
+			text = rest
+			continue
+		}
+		num, _ := strconv.Atoi(rest[:digits])
+		default_text := strings.TrimPrefix(body, syntax.Separator)
+		fields = append(fields, template_field{number: num, start: buf.Len(), end: buf.Len() + len(default_text)})
+		buf.WriteString(default_text)
+		text = after
+	}
+	buf.WriteString(text)
+	fields = utils.StableSort(fields, func(a, b template_field) bool { return a.number < b.number })
+	return buf.String(), fields
+}
+
+// Insert the template at the cursor and move to its first field, if any
+func (self *Readline) insert_template(text string) {
+	rendered, fields := parse_template(text, self.template_syntax())
+	base := position_to_offset(self.input_state.lines, self.input_state.cursor)
+	self.add_text(rendered)
+	self.template = nil
+	if len(fields) == 0 {
+		return
+	}
+	for i := range fields {
+		fields[i].start += base
+		fields[i].end += base
+	}
+	self.template = &template{fields: fields, current: -1, text: self.all_text()}
+	self.goto_template_field(1)
+}
+
+// Adjust the fields for changes made to the text since the last action
+func (self *Readline) sync_template() {
+	t := self.template
+	if t == nil {
+		return
+	}
+	text := self.all_text()
+	if text == t.text {
+		return
+	}
+	p, old_end, new_end := text_change(t.text, text)
+	for i := range t.fields {
+		f := &t.fields[i]
+		if f.start > p {
+			if f.start >= old_end {
+				f.start += new_end - old_end
+			} else {
+				f.start = p
+			}
+		}
+		if f.end >= old_end {
+			f.end += new_end - old_end
+		} else if f.end > p {
+			f.end = new_end
+		}
+		f.end = utils.Max(f.start, f.end)
+	}
+	t.text = text
+	t.pristine = false
+}
+
+func (self *Readline) goto_template_field(amt int) bool {
+	self.sync_template()
+	t := self.template
+	if t == nil {
+		return false
+	}
+	idx := t.current + amt
+	if idx < 0 {
+		return false
+	}
+	if idx >= len(t.fields) {
+		// done with the template, move to its end
+		end := t.fields[0].end
+		for _, f := range t.fields {
+			end = utils.Max(end, f.end)
+		}
+		self.template = nil
+		self.input_state.cursor = offset_to_position(t.text, end)
+		return true
+	}
+	t.current, t.pristine = idx, true
+	self.input_state.cursor = offset_to_position(t.text, t.fields[idx].end)
+	return true
+}
+
+// Remove the default text of the current field if it has not yet been
+// edited, so that typed text replaces it
+func (self *Readline) clear_pristine_template_field() {
+	t := self.template
+	if t == nil || !t.pristine || t.text != self.all_text() {
+		return
+	}
+	f := t.fields[t.current]
+	if f.start == f.end || position_to_offset(self.input_state.lines, self.input_state.cursor) != f.end {
+		return
+	}
+	self.erase_between(offset_to_position(t.text, f.start), offset_to_position(t.text, f.end))
+}
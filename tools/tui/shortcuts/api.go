@@ -5,6 +5,7 @@ package shortcuts
 import (
 	"fmt"
 	"kitty/tools/tui/loop"
+	"sort"
 	"strings"
 )
 
@@ -18,7 +19,7 @@ type ShortcutMap[T comparable] struct {
 func (self *ShortcutMap[T]) ResolveKeyEvent(k *loop.KeyEvent, pending_keys ...string) (ac T, pending string) {
 	q := self
 	for _, pk := range pending_keys {
-		q = self.children[pk]
+		q = q.children[pk]
 		if q == nil {
 			return
 		}
@@ -51,6 +52,17 @@ func (self *ShortcutMap[T]) AddOrPanic(ac T, keys ...string) {
 	}
 }
 
+// All the key specifications bound to each action, sorted. Keys that must be
+// pressed in sequence are separated by spaces.
+func (self *ShortcutMap[T]) Bindings() map[T][]string {
+	ans := make(map[T][]string)
+	self.collect_bindings("", ans)
+	for _, keys := range ans {
+		sort.Strings(keys)
+	}
+	return ans
+}
+
 func New[T comparable]() *ShortcutMap[T] {
 	return &ShortcutMap[T]{leaves: make(map[string]T), children: make(map[string]*ShortcutMap[T])}
 }
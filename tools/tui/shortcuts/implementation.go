@@ -34,6 +34,18 @@ func (self *ShortcutMap[T]) shortcut_for(ac T) (keys []string) {
 	return
 }
 
+func (self *ShortcutMap[T]) collect_bindings(prefix string, ans map[T][]string) {
+	var zero T
+	for key, ac := range self.leaves {
+		if ac != zero {
+			ans[ac] = append(ans[ac], prefix+key)
+		}
+	}
+	for key, child := range self.children {
+		child.collect_bindings(prefix+key+" ", ans)
+	}
+}
+
 func (self *ShortcutMap[T]) add(ac T, keys []string) (conflict T) {
 	sm := self
 	last := len(keys) - 1
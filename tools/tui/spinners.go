@@ -25,3 +25,7 @@ func (self *Spinner) Tick() string {
 	}
 	return self.frames[self.current_frame]
 }
+
+func (self *Spinner) Interval() time.Duration {
+	return self.interval
+}
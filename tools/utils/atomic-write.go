@@ -3,6 +3,7 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
 	"io/fs"
 	"os"
@@ -12,7 +13,11 @@ import (
 var _ = fmt.Print
 
 func AtomicWriteFile(path string, data []byte, perm os.FileMode) (err error) {
-	path, err = filepath.EvalSymlinks(path)
+	if rpath, serr := filepath.EvalSymlinks(path); serr == nil {
+		path = rpath
+	} else if !errors.Is(serr, fs.ErrNotExist) {
+		err = serr
+	}
 	if err == nil {
 		path, err = filepath.Abs(path)
 		if err == nil {
@@ -58,10 +58,17 @@ type EscapeCodeParser struct {
 	HandlePM                  func([]byte) error
 	HandleSOS                 func([]byte) error
 	HandleAPC                 func([]byte) error
+	// Called with the ASCII byte following an Esc that does not start an
+	// escape code, as sent for Alt+key by terminals that prefix Meta keys
+	// with Esc. When nil such an Esc is dropped.
+	HandleEscPrefixedByte func(byte) error
 }
 
 func (self *EscapeCodeParser) InBracketedPaste() bool { return self.state == bracketed_paste }
 
+// Whether an Esc has been received that is not yet known to start an escape code
+func (self *EscapeCodeParser) PendingEsc() bool { return self.state == esc }
+
 func (self *EscapeCodeParser) ParseString(s string) error {
 	return self.Parse(utils.UnsafeStringToBytes(s))
 }
@@ -272,7 +279,16 @@ func (self *EscapeCodeParser) dispatch_byte(ch byte) error {
 			self.state = st
 			self.current_callback = self.HandleAPC
 		case 'D', 'E', 'H', 'M', 'N', 'O', 'Z', '6', '7', '8', '9', '=', '>', 'F', 'c', 'l', 'm', 'n', 'o', '|', '}', '~':
+			// Esc O starts the SS3 sequences sent for some function keys
+			if self.HandleEscPrefixedByte != nil && ch != 'O' {
+				self.reset_state()
+				return self.HandleEscPrefixedByte(ch)
+			}
 		default:
+			if self.HandleEscPrefixedByte != nil && ch < 0x80 && ch != 0x1b {
+				self.reset_state()
+				return self.HandleEscPrefixedByte(ch)
+			}
 			// we drop this dangling Esc and reparse the byte after the esc
 			self.reset_state()
 			return self.ParseByte(ch)
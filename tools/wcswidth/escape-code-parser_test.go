@@ -53,4 +53,18 @@ func TestEscapeCodeParsing(t *testing.T) {
 	test("a\x1b_b\x1b\x1b\x1bc\x1b\\d", "CH: a\nAPC: b\x1b\x1bc\nCH: d")
 	test("\x1b]X\x07\x1b]X\x1b\x07\x1b\\", "OSC: X\nOSC: X\x1b\x07")
 
+	test("\x1bab", "CH: a\nCH: b")
+	test_parser.HandleEscPrefixedByte = func(b byte) error { return add("ESC", []byte{b}) }
+	test("\x1bab\x1bc\x1b\x7f\x1b[m", "ESC: a\nCH: b\nESC: c\nESC: \x7f\nCSI: m")
+	test("\x1b\x1bx", "ESC: x")
+	reset_test_parser()
+	test_parser.ParseString("a\x1b")
+	if !test_parser.PendingEsc() {
+		t.Fatalf("Trailing Esc not pending")
+	}
+	test_parser.ParseString("[m")
+	if test_parser.PendingEsc() {
+		t.Fatalf("Esc still pending after an escape code")
+	}
+
 }
@@ -91,10 +91,17 @@ func (self *truncate_iterator) parse(b []byte) (ans int, width int) {
 }
 
 func TruncateToVisualLengthWithWidth(text string, length int) (truncated string, width_of_truncated int) {
+	return TruncateToVisualLengthWithAmbiguousWidth(text, length, 1)
+}
+
+// Same as TruncateToVisualLengthWithWidth() except that East Asian ambiguous
+// width characters are ambiguous_width cells wide
+func TruncateToVisualLengthWithAmbiguousWidth(text string, length, ambiguous_width int) (truncated string, width_of_truncated int) {
 	if length < 1 {
 		return text[:0], 0
 	}
 	t := create_truncate_iterator()
+	t.w.ambiguous_width = ambiguous_width
 	t.limit = length
 	t.limit_exceeded_at = nil
 	t.w.current_width = 0
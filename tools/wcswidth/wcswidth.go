@@ -28,6 +28,8 @@ type WCWidthIterator struct {
 	parser                    EscapeCodeParser
 	state                     ecparser_state
 	rune_count                uint
+	// The width of East Asian ambiguous width characters, 1 if not set
+	ambiguous_width int
 }
 
 func CreateWCWidthIterator() *WCWidthIterator {
@@ -101,6 +103,8 @@ func (self *WCWidthIterator) handle_rune(ch rune) error {
 				self.prev_width = 0
 			case 2:
 				self.prev_width = 2
+			case -2:
+				self.prev_width = utils.Max(1, self.ambiguous_width)
 			default:
 				self.prev_width = 1
 			}
@@ -127,6 +131,15 @@ func Stringwidth(text string) int {
 	return w.Parse(utils.UnsafeStringToBytes(text))
 }
 
+// Same as Stringwidth() except that East Asian ambiguous width characters
+// are ambiguous_width cells wide, which should match the setting of the
+// terminal
+func StringwidthWithAmbiguousWidth(text string, ambiguous_width int) int {
+	w := CreateWCWidthIterator()
+	w.ambiguous_width = ambiguous_width
+	return w.Parse(utils.UnsafeStringToBytes(text))
+}
+
 func StripEscapeCodes(text string) string {
 	out := strings.Builder{}
 	out.Grow(len(text))
@@ -63,6 +63,15 @@ func TestWCSWidth(t *testing.T) {
 	truncate("a\x1b[31mb", 2, "a\x1b[31mb", 2)
 	truncate("a\x1b[7bb", 2, "a", 1)
 	truncate("a\x1b[3bbc", 5, "a\x1b[3bb", 5)
+
+	// East Asian ambiguous width
+	wcswidth("a\u00a7b", 3)
+	if w := StringwidthWithAmbiguousWidth("a\u00a7b", 2); w != 4 {
+		t.Fatalf("The width with wide ambiguous chars was %d instead of 4", w)
+	}
+	if actual, w := TruncateToVisualLengthWithAmbiguousWidth("a\u00a7b", 2, 2); actual != "a" || w != 1 {
+		t.Fatalf("Truncating with wide ambiguous chars gave: %#v with width %d", actual, w)
+	}
 }
 
 func TestCellIterator(t *testing.T) {